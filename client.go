@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// adminTimeout is the timeout of requests to admin api.
+const adminTimeout = 10 * time.Second
+
+// adminClient is the json client of api on unix socket, e.g., admin api of running plugin and docker api.
+type adminClient struct {
+	client *http.Client
+}
+
+func newAdminClient(path string) *adminClient {
+	transport := &http.Transport{
+		Dial: func(_, _ string) (net.Conn, error) {
+			return net.DialTimeout("unix", path, adminTimeout)
+		},
+	}
+	return &adminClient{client: &http.Client{Transport: transport, Timeout: adminTimeout}}
+}
+
+// get decode the json response of path to v.
+func (c *adminClient) get(path string, v interface{}) error {
+	return c.do("GET", path, v)
+}
+
+// post decode the json response of path to v, v may be nil.
+func (c *adminClient) post(path string, v interface{}) error {
+	return c.do("POST", path, v)
+}
+
+// postJSON post body as json to path, and decode the json response to v.
+func (c *adminClient) postJSON(path string, body interface{}, v interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return c.request("POST", path, bytes.NewReader(data), v)
+}
+
+func (c *adminClient) do(method, path string, v interface{}) error {
+	return c.request(method, path, nil, v)
+}
+
+func (c *adminClient) request(method, path string, body io.Reader, v interface{}) error {
+	req, err := http.NewRequest(method, "http://hostnic"+path, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		e := struct{ Err string }{}
+		if json.Unmarshal(data, &e) == nil && e.Err != "" {
+			return fmt.Errorf("%s %s error: %s", method, path, e.Err)
+		}
+		return fmt.Errorf("%s %s error: %s", method, path, resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
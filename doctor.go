@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli"
+	"github.com/yunify/docker-plugin-hostnic/driver"
+	"github.com/yunify/docker-plugin-hostnic/log"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// Doctor check the environment the driver depends on, exit with 1 if any check fails.
+func Doctor(ctx *cli.Context) error {
+	// findings are the output, logs of checks are only for debugging.
+	if !ctx.GlobalBool("debug") {
+		log.SetOutput(ioutil.Discard)
+	}
+	options := driver.DoctorOptions{
+		ConfigDir:    instancePath(ctx, "config-dir", driver.DefaultConfigDir),
+		PluginSocket: instancePath(ctx, "socket", defaultPluginSocket),
+	}
+	if adminSocket := instancePath(ctx, "admin-socket", defaultAdminSocket); adminSocket != "" {
+		var networks []driver.NetworkStatus
+		if err := newAdminClient(adminSocket).get("/networks", &networks); err == nil {
+			options.Networks = networks
+			if options.Networks == nil {
+				options.Networks = []driver.NetworkStatus{}
+			}
+		}
+	}
+	findings := driver.Diagnose(options)
+	if ctx.Bool("json") {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(findings); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SEVERITY\tCHECK\tMESSAGE")
+		for _, finding := range findings {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", strings.ToUpper(string(finding.Severity)), finding.Check, finding.Message)
+			if finding.Fix != "" {
+				fmt.Fprintf(w, "\t\tfix: %s\n", finding.Fix)
+			}
+		}
+		w.Flush()
+	}
+	return exitOnError(findings)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const drainPollInterval = 100 * time.Millisecond
+
+// drainListener counts the busy connections of plugin api, so shutdown waits the responses are written,
+// not only the driver calls return. http.Server of go 1.7 has no Shutdown.
+// A connection is busy from reading a request until the server reads again after writing the response, or closes it.
+type drainListener struct {
+	net.Listener
+	busy int64
+}
+
+func (l *drainListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &drainConn{Conn: c, busy: &l.busy}, nil
+}
+
+// wait wait busy connections become idle in timeout, the listener should be closed before.
+func (l *drainListener) wait(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&l.busy) > 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Shutdown timeout, %d requests are in flight", atomic.LoadInt64(&l.busy))
+		}
+		time.Sleep(drainPollInterval)
+	}
+	return nil
+}
+
+type drainConn struct {
+	net.Conn
+	busy    *int64
+	lock    sync.Mutex
+	active  bool // a request is read
+	written bool // the response of the request is being written
+}
+
+func (c *drainConn) Read(b []byte) (int, error) {
+	c.lock.Lock()
+	if c.written {
+		// the response is written, the server reads the next request
+		c.setActive(false)
+	}
+	c.lock.Unlock()
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.lock.Lock()
+		c.written = false
+		c.setActive(true)
+		c.lock.Unlock()
+	}
+	return n, err
+}
+
+func (c *drainConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	c.written = c.active
+	c.lock.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *drainConn) Close() error {
+	c.lock.Lock()
+	c.setActive(false)
+	c.lock.Unlock()
+	return c.Conn.Close()
+}
+
+// setActive update the state and busy count of listener, c.lock must be held.
+func (c *drainConn) setActive(active bool) {
+	if c.active == active {
+		return
+	}
+	c.active = active
+	c.written = false
+	if active {
+		atomic.AddInt64(c.busy, 1)
+	} else {
+		atomic.AddInt64(c.busy, -1)
+	}
+}
@@ -0,0 +1,312 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/yunify/docker-plugin-hostnic/log"
+)
+
+// NicStatus is the nic in nic table with its binding status.
+type NicStatus struct {
+	Name         string
+	HardwareAddr string
+	Address      string
+	Index        int
+	Endpoint     string       `json:",omitempty"`
+	Network      string       `json:",omitempty"`
+	Sandbox      string       `json:",omitempty"` // the nic is in the sandbox of endpoint, not on host
+	Protected    bool         `json:",omitempty"`
+	Cloud        *NicMetadata `json:",omitempty"`
+}
+
+// EndpointStatus is the endpoint with the nic bound to it.
+type EndpointStatus struct {
+	ID            string
+	Network       string
+	HardwareAddr  string
+	SrcName       string
+	Addresses     []string
+	SandboxKey    string
+	Bandwidth     *Bandwidth `json:",omitempty"`
+	AntiSpoof     bool
+	Degraded      bool
+	SetupError    string `json:",omitempty"` // settings failed to apply in sandbox
+	Provisioned   bool   `json:",omitempty"`
+	PolicyRouting bool   `json:",omitempty"`
+}
+
+// NetworkStatus is the network with its pool, options and endpoints.
+type NetworkStatus struct {
+	ID            string
+	IPv4Data      *network.IPAMData
+	IPMap         map[string]string `json:",omitempty"`
+	Bandwidth     *Bandwidth        `json:",omitempty"`
+	AntiSpoof     bool
+	VxNet         string `json:",omitempty"`
+	PolicyRouting bool   `json:",omitempty"`
+	Imported      bool   `json:",omitempty"` // imported from another host, not created by docker on this host yet
+	Name          string `json:",omitempty"`
+	Endpoints     []EndpointStatus
+}
+
+// VersionStatus is the version and config of plugin.
+type VersionStatus struct {
+	Version    string
+	ConfigFile string
+}
+
+// Nics return the status of all nics in nic table.
+func (d *HostNicDriver) Nics() []NicStatus {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	nics := d.nics.Nics()
+	result := make([]NicStatus, 0, len(nics))
+	for _, nic := range nics {
+		status := NicStatus{Name: nic.Name, HardwareAddr: nic.HardwareAddr, Address: nic.Address, Index: nic.Index, Protected: d.isProtected(nic), Cloud: nic.Cloud}
+		if nic.endpoint != nil {
+			status.Endpoint = nic.endpoint.id
+			status.Network = nic.endpoint.networkID
+			status.Sandbox, _ = nic.endpoint.joined.Load().(string)
+		}
+		result = append(result, status)
+	}
+	sort.Sort(nicStatusByName(result))
+	return result
+}
+
+// Networks return the status of all networks and their endpoints.
+func (d *HostNicDriver) Networks() []NetworkStatus {
+	networks := d.networkList()
+	result := make([]NetworkStatus, 0, len(networks))
+	for _, nw := range networks {
+		status := NetworkStatus{ID: nw.ID, IPv4Data: nw.IPv4Data, IPMap: nw.IPMap, Bandwidth: nw.Bandwidth, AntiSpoof: nw.AntiSpoof, VxNet: nw.VxNet,
+			PolicyRouting: nw.PolicyRouting, Imported: nw.Imported, Name: nw.Name}
+		endpoints := nw.endpointList()
+		status.Endpoints = make([]EndpointStatus, 0, len(endpoints))
+		for _, endpoint := range endpoints {
+			status.Endpoints = append(status.Endpoints, endpoint.status())
+		}
+		result = append(result, status)
+	}
+	sort.Sort(networkStatusByID(result))
+	return result
+}
+
+func (endpoint *Endpoint) status() EndpointStatus {
+	endpoint.hostNic.lock.Lock()
+	defer endpoint.hostNic.lock.Unlock()
+	return EndpointStatus{
+		ID:            endpoint.id,
+		Network:       endpoint.networkID,
+		HardwareAddr:  endpoint.hostNic.HardwareAddr,
+		SrcName:       endpoint.srcName,
+		Addresses:     endpoint.addresses,
+		SandboxKey:    endpoint.sandboxKey,
+		Bandwidth:     endpoint.bandwidth,
+		AntiSpoof:     endpoint.antiSpoof,
+		Degraded:      endpoint.degraded,
+		SetupError:    endpoint.setupError,
+		Provisioned:   endpoint.provisioned,
+		PolicyRouting: endpoint.policyRouting,
+	}
+}
+
+// ReleaseNic force unbind the nic (by hardware addr or name) from its endpoint, and delete the endpoint.
+// It is for recovering from docker lost the endpoint, docker will fail on later operations of the endpoint.
+func (d *HostNicDriver) ReleaseNic(nicID string) error {
+	d.lock.RLock()
+	nic := d.nics.ByHardwareAddr(nicID)
+	if nic == nil {
+		nic = d.nics.ByName(nicID)
+	}
+	d.lock.RUnlock()
+	if nic == nil {
+		return fmt.Errorf("Can not find host nic [%s]", nicID)
+	}
+
+	nic.lock.Lock()
+	defer nic.lock.Unlock()
+	d.lock.RLock()
+	endpoint := nic.endpoint
+	var nw *Network
+	if endpoint != nil {
+		nw = d.networks[endpoint.networkID]
+	}
+	d.lock.RUnlock()
+	if endpoint == nil {
+		return fmt.Errorf("Host nic [%s] is not bound", nicID)
+	}
+
+	logger := driverLog.WithFields(log.Fields{"mac": nic.HardwareAddr, "endpoint_id": endpoint.id, "network_id": endpoint.networkID})
+	if endpoint.sandboxKey != "" {
+		cleanupSandbox(logger.WithField("sandbox", endpoint.sandboxKey), endpoint, endpoint.sandboxKey)
+		endpoint.setSandboxKey("")
+	}
+	d.releaseBoundNic(logger, nic, endpoint, nw, "force released by admin")
+	return nil
+}
+
+// Reconcile sync nic table with host, and check the nics of all endpoints.
+func (d *HostNicDriver) Reconcile() {
+	d.syncNics()
+	d.lock.RLock()
+	var (
+		nics      []*HostNic
+		endpoints []*Endpoint
+	)
+	for _, nic := range d.nics.Nics() {
+		if nic.endpoint != nil {
+			nics = append(nics, nic)
+			endpoints = append(endpoints, nic.endpoint)
+		}
+	}
+	d.lock.RUnlock()
+	for i, nic := range nics {
+		d.checkBoundNic(nic, endpoints[i])
+	}
+	driverLog.Info("Reconcile finished, %d nics are bound", len(nics))
+}
+
+// NewAdminHandler return the handler of admin api, it should be served on a socket other than the plugin socket.
+//
+//	GET  /version               plugin version and config file
+//	GET  /nics                  nics in nic table with binding status
+//	GET  /networks              networks with pools, options and endpoints
+//	GET  /endpoints             endpoints with sandbox keys
+//	POST /nics/release?nic=xxx  force release the nic (hardware addr or name)
+//	POST /reconcile             sync nic table and check bound nics
+//	POST /gc?dry_run=true       recover orphaned nics, only return the plan if dry run
+//	POST /reload                load networks from config file again, as SIGHUP
+//	GET  /events                stream lifecycle events, as server-sent events if accept text/event-stream
+//	GET  /loglevels             log levels of subsystems
+//	POST /loglevels?subsystem=xxx&level=debug  set log level of subsystem, all subsystems if subsystem is not set
+func NewAdminHandler(d *HostNicDriver, version string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/version", adminGet(func(r *http.Request) (interface{}, error) {
+		return VersionStatus{Version: version, ConfigFile: d.configFilePath()}, nil
+	}))
+	mux.HandleFunc("/nics", adminGet(func(r *http.Request) (interface{}, error) {
+		return d.Nics(), nil
+	}))
+	mux.HandleFunc("/networks", adminGet(func(r *http.Request) (interface{}, error) {
+		return d.Networks(), nil
+	}))
+	mux.HandleFunc("/endpoints", adminGet(func(r *http.Request) (interface{}, error) {
+		endpoints := []EndpointStatus{}
+		for _, nw := range d.Networks() {
+			endpoints = append(endpoints, nw.Endpoints...)
+		}
+		return endpoints, nil
+	}))
+	mux.HandleFunc("/nics/release", adminPost(func(r *http.Request) (interface{}, error) {
+		nic := r.URL.Query().Get("nic")
+		if nic == "" {
+			return nil, fmt.Errorf("Please set nic argument")
+		}
+		return struct{}{}, d.ReleaseNic(nic)
+	}))
+	mux.HandleFunc("/reconcile", adminPost(func(r *http.Request) (interface{}, error) {
+		d.Reconcile()
+		return d.Nics(), nil
+	}))
+	mux.HandleFunc("/gc", adminPost(func(r *http.Request) (interface{}, error) {
+		var req GCRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, fmt.Errorf("Invalid gc request: %s", err.Error())
+		}
+		var dockerEndpoints map[string]bool
+		if req.DockerEndpoints != nil {
+			dockerEndpoints = make(map[string]bool, len(req.DockerEndpoints))
+			for _, id := range req.DockerEndpoints {
+				dockerEndpoints[id] = true
+			}
+		}
+		return d.GC(r.URL.Query().Get("dry_run") == "true", dockerEndpoints)
+	}))
+	mux.HandleFunc("/reload", adminPost(func(r *http.Request) (interface{}, error) {
+		if err := d.Reload(); err != nil {
+			return nil, err
+		}
+		return d.Networks(), nil
+	}))
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			// reply method not allowed
+			adminGet(nil)(w, r)
+			return
+		}
+		serveEvents(d, w, r)
+	})
+	mux.HandleFunc("/loglevels", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			adminPost(setLogLevel)(w, r)
+		} else {
+			adminGet(func(r *http.Request) (interface{}, error) {
+				return log.Levels(), nil
+			})(w, r)
+		}
+	})
+	return mux
+}
+
+func setLogLevel(r *http.Request) (interface{}, error) {
+	subsystem, level := r.URL.Query().Get("subsystem"), r.URL.Query().Get("level")
+	if level == "" {
+		return nil, fmt.Errorf("Please set level argument")
+	}
+	var err error
+	if subsystem == "" {
+		err = log.SetAllLevels(level)
+	} else {
+		err = log.SetSubsystemLevel(subsystem, level)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return log.Levels(), nil
+}
+
+func adminGet(fn func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return adminHandle(http.MethodGet, fn)
+}
+
+func adminPost(fn func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return adminHandle(http.MethodPost, fn)
+}
+
+func adminHandle(method string, fn func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := httpLog.WithFields(log.Fields{"http_method": r.Method, "path": r.URL.Path})
+		logger.Debug("Admin request")
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != method {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(network.NewErrorResponse(fmt.Sprintf("Method %s is not allowed", r.Method)))
+			return
+		}
+		res, err := fn(r)
+		if err != nil {
+			logger.WithError(err).Error("Admin request failed")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(network.NewErrorResponse(err.Error()))
+			return
+		}
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+type nicStatusByName []NicStatus
+
+func (s nicStatusByName) Len() int           { return len(s) }
+func (s nicStatusByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s nicStatusByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+type networkStatusByID []NetworkStatus
+
+func (s networkStatusByID) Len() int           { return len(s) }
+func (s networkStatusByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s networkStatusByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
@@ -0,0 +1,308 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	// antiSpoofOption enable source address anti spoofing of endpoints, e.g., -o antispoof=true
+	antiSpoofOption = "antispoof"
+
+	// antiSpoofDropPriority is the priority of the filter which drop all packets not allowed.
+	antiSpoofDropPriority = 100
+
+	// offsets of u32 keys are relative to network header.
+	etherSrcOffset = -8
+	ipv4SrcOffset  = 12
+	ipv6SrcOffset  = 8
+	arpSpaOffset   = 14
+
+	// nlaTypeMask clear the nested and byte order flags of netlink attribute type.
+	nlaTypeMask = 0x3fff
+)
+
+// u32Rule is a u32 filter match the keys and pass the packet.
+type u32Rule struct {
+	protocol uint16
+	keys     []nl.TcU32Key
+}
+
+// u32Key return the key match value with mask at offset, value and mask are in network byte order.
+func u32Key(value []byte, mask []byte, offset int32) nl.TcU32Key {
+	native := nl.NativeEndian()
+	return nl.TcU32Key{
+		Mask: native.Uint32(mask),
+		Val:  native.Uint32(value),
+		Off:  offset,
+	}
+}
+
+// u32Keys return the keys match the masked value which start at offset.
+func u32Keys(value []byte, mask []byte, offset int32) []nl.TcU32Key {
+	var keys []nl.TcU32Key
+	for i := 0; i < len(value); i += 4 {
+		v := make([]byte, 4)
+		m := make([]byte, 4)
+		copy(v, value[i:])
+		copy(m, mask[i:])
+		if m[0]|m[1]|m[2]|m[3] == 0 {
+			continue
+		}
+		keys = append(keys, u32Key(v, m, offset+int32(i)))
+	}
+	return keys
+}
+
+// antiSpoofRules return the rules allow packets from hardwareAddr with source of addresses.
+func antiSpoofRules(hardwareAddr string, addresses []string) ([]u32Rule, error) {
+	mac, err := net.ParseMAC(hardwareAddr)
+	if err != nil {
+		return nil, err
+	}
+	macKeys := u32Keys(mac, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, etherSrcOffset)
+	var rules []u32Rule
+	ipv6 := false
+	for _, address := range addresses {
+		ip := net.ParseIP(addressIP(address))
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid endpoint address [%s]", address)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			mask := []byte{0xff, 0xff, 0xff, 0xff}
+			rules = append(rules,
+				u32Rule{protocol: syscall.ETH_P_IP, keys: append(u32Keys(ip4, mask, ipv4SrcOffset), macKeys...)},
+				u32Rule{protocol: syscall.ETH_P_ARP, keys: append(u32Keys(ip4, mask, arpSpaOffset), macKeys...)},
+			)
+		} else {
+			ipv6 = true
+			rules = append(rules, u32Rule{protocol: syscall.ETH_P_IPV6, keys: append(u32Keys(ip.To16(), net.CIDRMask(128, 128), ipv6SrcOffset), macKeys...)})
+		}
+	}
+	if ipv6 {
+		// neighbor discovery and router solicitation use the link local address of the nic.
+		rules = append(rules, u32Rule{protocol: syscall.ETH_P_IPV6, keys: append(u32Keys(eui64LinkLocal(mac), net.CIDRMask(128, 128), ipv6SrcOffset), macKeys...)})
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("Endpoint has no address to allow")
+	}
+	return rules, nil
+}
+
+// eui64LinkLocal return the ipv6 link local address the kernel generates from mac, fe80::/64 with modified EUI-64.
+func eui64LinkLocal(mac net.HardwareAddr) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	ip[0], ip[1] = 0xfe, 0x80
+	ip[8] = mac[0] ^ 0x02
+	ip[9], ip[10] = mac[1], mac[2]
+	ip[11], ip[12] = 0xff, 0xfe
+	ip[13], ip[14], ip[15] = mac[3], mac[4], mac[5]
+	return ip
+}
+
+// u32Action add the action of u32 filter to its options.
+type u32Action func(options *nl.RtAttr) error
+
+// gactAction pass or drop the matched packets.
+func gactAction(action netlink.TcAct) u32Action {
+	return func(options *nl.RtAttr) error {
+		actions := nl.NewRtAttrChild(options, nl.TCA_U32_ACT, nil)
+		return netlink.EncodeActions(actions, []netlink.Action{
+			&netlink.GenericAction{ActionAttrs: netlink.ActionAttrs{Action: action}},
+		})
+	}
+}
+
+// addU32Filter add u32 filter with the action to the clsact parent (egress or ingress) of link,
+// netlink.U32 only match all packets, so build the request by hand.
+func addU32Filter(sb *sandbox, parent uint32, priority uint16, protocol uint16, keys []nl.TcU32Key, action u32Action) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWTFILTER, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(sb.link.Attrs().Index),
+		Parent:  parent,
+		Info:    netlink.MakeHandle(priority, nl.Swap16(protocol)),
+	})
+	req.AddData(nl.NewRtAttr(nl.TCA_KIND, nl.ZeroTerminated("u32")))
+	options := nl.NewRtAttr(nl.TCA_OPTIONS, nil)
+	if len(keys) == 0 {
+		// match all
+		keys = []nl.TcU32Key{{}}
+	}
+	sel := nl.TcU32Sel{
+		Nkeys: uint8(len(keys)),
+		Flags: nl.TC_U32_TERMINAL,
+		Keys:  keys,
+	}
+	nl.NewRtAttrChild(options, nl.TCA_U32_SEL, sel.Serialize())
+	if err := action(options); err != nil {
+		return err
+	}
+	req.AddData(options)
+	return sb.execute(req)
+}
+
+// setupAntiSpoof install egress filters only allow packets from the address and hardware addr of endpoint.
+func setupAntiSpoof(sb *sandbox, endpoint *Endpoint) error {
+	rules, err := antiSpoofRules(endpoint.hostNic.HardwareAddr, endpoint.addresses)
+	if err != nil {
+		return err
+	}
+	if err := sb.ensureClsact(); err != nil {
+		return fmt.Errorf("add clsact qdisc error: %s", err.Error())
+	}
+	for i, rule := range rules {
+		if err := addU32Filter(sb, netlink.HANDLE_MIN_EGRESS, uint16(i+1), rule.protocol, rule.keys, gactAction(netlink.TC_ACT_OK)); err != nil {
+			return fmt.Errorf("add anti spoof filter error: %s", err.Error())
+		}
+	}
+	if err := addU32Filter(sb, netlink.HANDLE_MIN_EGRESS, antiSpoofDropPriority, syscall.ETH_P_ALL, nil, gactAction(netlink.TC_ACT_SHOT)); err != nil {
+		return fmt.Errorf("add anti spoof drop filter error: %s", err.Error())
+	}
+	return nil
+}
+
+// vfSpoofCheck is the spoof check setting of the vf on its pf.
+type vfSpoofCheck struct {
+	pf       int // index of pf link
+	vf       int
+	previous bool
+}
+
+// enableVfSpoofCheck enable spoof check of the sr-iov vf on its pf, return its previous setting to restore,
+// or nil if the nic is not a vf.
+// It must be called before the nic is moved into sandbox, when the vf is still visible in host sysfs.
+func enableVfSpoofCheck(name string) (*vfSpoofCheck, error) {
+	device := filepath.Join("/sys/class/net", name, "device")
+	physfn := filepath.Join(device, "physfn")
+	if exists, err := FileExists(physfn); err != nil || !exists {
+		return nil, err
+	}
+	pfNames, err := ioutil.ReadDir(filepath.Join(physfn, "net"))
+	if err != nil {
+		return nil, err
+	}
+	if len(pfNames) == 0 {
+		return nil, fmt.Errorf("Can not find pf of vf [%s]", name)
+	}
+	vf, err := vfIndex(device, physfn)
+	if err != nil {
+		return nil, err
+	}
+	pf, err := netlink.LinkByName(pfNames[0].Name())
+	if err != nil {
+		return nil, err
+	}
+	check := &vfSpoofCheck{pf: pf.Attrs().Index, vf: vf}
+	if check.previous, err = getVfSpoofCheck(check.pf, vf); err != nil {
+		return nil, fmt.Errorf("Read spoof check of vf [%d] error: %s", vf, err.Error())
+	}
+	if err := setVfSpoofCheck(check.pf, vf, true); err != nil {
+		return nil, err
+	}
+	return check, nil
+}
+
+// restore set the spoof check of vf back to the previous setting.
+func (check *vfSpoofCheck) restore() error {
+	return setVfSpoofCheck(check.pf, check.vf, check.previous)
+}
+
+func setVfSpoofCheck(pf int, vf int, on bool) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_SETLINK, syscall.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(pf)
+	req.AddData(msg)
+	data := nl.NewRtAttr(nl.IFLA_VFINFO_LIST, nil)
+	info := nl.NewRtAttrChild(data, nl.IFLA_VF_INFO, nil)
+	spoofchk := nl.VfSpoofchk{Vf: uint32(vf)}
+	if on {
+		spoofchk.Setting = 1
+	}
+	nl.NewRtAttrChild(info, nl.IFLA_VF_SPOOFCHK, spoofchk.Serialize())
+	req.AddData(data)
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// getVfSpoofCheck read the spoof check of vf from the vf list of pf link.
+func getVfSpoofCheck(pf int, vf int) (bool, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETLINK, syscall.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(pf)
+	req.AddData(msg)
+	// RTEXT_FILTER_VF, the vf list is not dumped without it
+	req.AddData(nl.NewRtAttr(nl.IFLA_EXT_MASK, nl.Uint32Attr(1)))
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWLINK)
+	if err != nil {
+		return false, err
+	}
+	if len(msgs) != 1 {
+		return false, fmt.Errorf("Unexpect %d replies of link [%d]", len(msgs), pf)
+	}
+	attrs, err := nl.ParseRouteAttr(msgs[0][syscall.SizeofIfInfomsg:])
+	if err != nil {
+		return false, err
+	}
+	return parseVfSpoofCheck(attrs, vf)
+}
+
+// parseVfSpoofCheck find the spoof check of vf in IFLA_VFINFO_LIST of link attributes.
+func parseVfSpoofCheck(attrs []syscall.NetlinkRouteAttr, vf int) (bool, error) {
+	for _, attr := range attrs {
+		if attr.Attr.Type&nlaTypeMask != nl.IFLA_VFINFO_LIST {
+			continue
+		}
+		infos, err := nl.ParseRouteAttr(attr.Value)
+		if err != nil {
+			return false, err
+		}
+		for _, info := range infos {
+			if info.Attr.Type&nlaTypeMask != nl.IFLA_VF_INFO {
+				continue
+			}
+			settings, err := nl.ParseRouteAttr(info.Value)
+			if err != nil {
+				return false, err
+			}
+			for _, setting := range settings {
+				if setting.Attr.Type&nlaTypeMask != nl.IFLA_VF_SPOOFCHK || len(setting.Value) < nl.SizeofVfSpoofchk {
+					continue
+				}
+				if spoofchk := nl.DeserializeVfSpoofchk(setting.Value); int(spoofchk.Vf) == vf {
+					return spoofchk.Setting != 0, nil
+				}
+			}
+		}
+	}
+	return false, fmt.Errorf("No spoof check of vf [%d]", vf)
+}
+
+// vfIndex find the index of vf device by the virtfn links of pf.
+func vfIndex(device string, physfn string) (int, error) {
+	target, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return 0, err
+	}
+	virtfns, err := filepath.Glob(filepath.Join(physfn, "virtfn*"))
+	if err != nil {
+		return 0, err
+	}
+	for _, virtfn := range virtfns {
+		if t, err := filepath.EvalSymlinks(virtfn); err == nil && t == target {
+			var index int
+			if _, err := fmt.Sscanf(strings.TrimPrefix(filepath.Base(virtfn), "virtfn"), "%d", &index); err != nil {
+				return 0, err
+			}
+			return index, nil
+		}
+	}
+	return 0, fmt.Errorf("Can not find vf index of [%s]", device)
+}
@@ -0,0 +1,187 @@
+package driver
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	egressRateOption   = "egress_rate"
+	egressBurstOption  = "egress_burst"
+	ingressRateOption  = "ingress_rate"
+	ingressBurstOption = "ingress_burst"
+
+	// tbfLatency is the max time (in microseconds) a packet can sit in the egress queue.
+	tbfLatency = 25000
+	// policeMtu is large enough for packets merged by GRO before ingress policing.
+	policeMtu = 65535
+)
+
+// Bandwidth is the traffic limit of endpoint, rates are in bits per second, bursts are in bytes.
+type Bandwidth struct {
+	EgressRate   uint64 `json:",omitempty"`
+	EgressBurst  uint64 `json:",omitempty"`
+	IngressRate  uint64 `json:",omitempty"`
+	IngressBurst uint64 `json:",omitempty"`
+}
+
+// parseBandwidth parse bandwidth options, options not set fall back to defaults.
+// Return nil if no limit is set.
+func parseBandwidth(options map[string]string, defaults *Bandwidth) (*Bandwidth, error) {
+	b := Bandwidth{}
+	if defaults != nil {
+		b = *defaults
+	}
+	var err error
+	if v, ok := options[egressRateOption]; ok {
+		if b.EgressRate, err = parseRate(v); err != nil {
+			return nil, fmt.Errorf("Invalid %s [%s]: %s", egressRateOption, v, err.Error())
+		}
+	}
+	if v, ok := options[egressBurstOption]; ok {
+		if b.EgressBurst, err = parseSize(v); err != nil {
+			return nil, fmt.Errorf("Invalid %s [%s]: %s", egressBurstOption, v, err.Error())
+		}
+	}
+	if v, ok := options[ingressRateOption]; ok {
+		if b.IngressRate, err = parseRate(v); err != nil {
+			return nil, fmt.Errorf("Invalid %s [%s]: %s", ingressRateOption, v, err.Error())
+		}
+	}
+	if v, ok := options[ingressBurstOption]; ok {
+		if b.IngressBurst, err = parseSize(v); err != nil {
+			return nil, fmt.Errorf("Invalid %s [%s]: %s", ingressBurstOption, v, err.Error())
+		}
+	}
+	if b.EgressRate == 0 && b.IngressRate == 0 {
+		return nil, nil
+	}
+	return &b, nil
+}
+
+// parseRate parse rate in bits per second, e.g., 100000, 500kbit, 100mbit, 1gbit
+func parseRate(value string) (uint64, error) {
+	rate, err := parseQuantity(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(value)), "bit"), 1000)
+	if err != nil {
+		return 0, err
+	}
+	// tc rate spec holds bytes per second in uint32.
+	if rate/8 > math.MaxUint32 || rate > math.MaxUint32 {
+		return 0, fmt.Errorf("rate must be less than %d bit", uint64(math.MaxUint32))
+	}
+	return rate, nil
+}
+
+// parseSize parse size in bytes, e.g., 32768, 32k, 1m
+func parseSize(value string) (uint64, error) {
+	size, err := parseQuantity(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(value)), "b"), 1024)
+	if err != nil {
+		return 0, err
+	}
+	if size > math.MaxUint32 {
+		return 0, fmt.Errorf("size must be less than %d", uint64(math.MaxUint32))
+	}
+	return size, nil
+}
+
+func parseQuantity(value string, base uint64) (uint64, error) {
+	multiplier := uint64(1)
+	switch {
+	case strings.HasSuffix(value, "k"):
+		multiplier = base
+	case strings.HasSuffix(value, "m"):
+		multiplier = base * base
+	case strings.HasSuffix(value, "g"):
+		multiplier = base * base * base
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
+}
+
+// burst return the configured burst, or the bytes rate can send in 10 ms (at least 32k).
+func burst(rate uint64, configured uint64) uint64 {
+	if configured != 0 {
+		return configured
+	}
+	b := rate / 8 / 100
+	if b < 32*1024 {
+		b = 32 * 1024
+	}
+	return b
+}
+
+// info add bandwidth limits to endpoint info.
+func (b *Bandwidth) info(value map[string]string) {
+	if b.EgressRate != 0 {
+		value["bandwidth.EgressRate"] = strconv.FormatUint(b.EgressRate, 10)
+		value["bandwidth.EgressBurst"] = strconv.FormatUint(burst(b.EgressRate, b.EgressBurst), 10)
+	}
+	if b.IngressRate != 0 {
+		value["bandwidth.IngressRate"] = strconv.FormatUint(b.IngressRate, 10)
+		value["bandwidth.IngressBurst"] = strconv.FormatUint(burst(b.IngressRate, b.IngressBurst), 10)
+	}
+}
+
+// setupBandwidth install tbf qdisc for egress rate, and police filter on clsact ingress for ingress rate.
+func setupBandwidth(sb *sandbox, b *Bandwidth) error {
+	index := sb.link.Attrs().Index
+	if b.EgressRate != 0 {
+		rate := b.EgressRate / 8
+		buffer := burst(b.EgressRate, b.EgressBurst)
+		tbf := &netlink.Tbf{
+			QdiscAttrs: netlink.QdiscAttrs{
+				LinkIndex: index,
+				Handle:    netlink.MakeHandle(1, 0),
+				Parent:    netlink.HANDLE_ROOT,
+			},
+			Rate:   rate,
+			Limit:  uint32(rate*tbfLatency/1000000 + buffer),
+			Buffer: uint32(netlink.Xmittime(rate, uint32(buffer))),
+		}
+		if err := sb.handle.QdiscReplace(tbf); err != nil {
+			return fmt.Errorf("add tbf qdisc error: %s", err.Error())
+		}
+	}
+	if b.IngressRate != 0 {
+		if err := sb.ensureClsact(); err != nil {
+			return fmt.Errorf("add clsact qdisc error: %s", err.Error())
+		}
+		// netlink.NewFw only calculates the police, a fw filter matches marked packets only,
+		// so police all packets by a match all u32 filter.
+		police, err := netlink.NewFw(netlink.FilterAttrs{}, netlink.FilterFwAttrs{
+			Rate:   uint32(b.IngressRate),
+			Buffer: uint32(burst(b.IngressRate, b.IngressBurst)),
+			Mtu:    policeMtu,
+			Action: netlink.TC_POLICE_SHOT,
+		})
+		if err != nil {
+			return err
+		}
+		if err := addU32Filter(sb, netlink.HANDLE_MIN_INGRESS, 1, syscall.ETH_P_ALL, nil, policeAction(police)); err != nil {
+			return fmt.Errorf("add ingress police filter error: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// policeAction drop the matched packets over the rate of police.
+func policeAction(police *netlink.Fw) u32Action {
+	return func(options *nl.RtAttr) error {
+		attr := nl.NewRtAttrChild(options, nl.TCA_U32_POLICE, nil)
+		nl.NewRtAttrChild(attr, nl.TCA_POLICE_TBF, police.Police.Serialize())
+		nl.NewRtAttrChild(attr, nl.TCA_POLICE_RATE, netlink.SerializeRtab(police.Rtab))
+		return nil
+	}
+}
@@ -0,0 +1,315 @@
+package driver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// Severity is the severity of doctor finding.
+type Severity string
+
+const (
+	SeverityOK      Severity = "ok"
+	SeverityInfo    Severity = "info"
+	SeverityWarning Severity = "warning"
+	SeverityError   Severity = "error"
+)
+
+// capabilities required by the driver, bit numbers of linux capabilities.
+const (
+	capNetAdmin = 12
+	capSysAdmin = 21
+)
+
+// procStatus is the status file of current process.
+var procStatus = "/proc/self/status"
+
+// Finding is the result of a doctor check, Fix is the suggested fix if the check is not ok.
+type Finding struct {
+	Check    string
+	Severity Severity
+	Message  string
+	Fix      string `json:",omitempty"`
+}
+
+// DoctorOptions are the environment of the driver checked by doctor.
+type DoctorOptions struct {
+	ConfigDir    string
+	PluginSocket string
+	// Networks are the status of the running plugin from admin api, nil if the plugin is not running.
+	Networks []NetworkStatus
+}
+
+// Diagnose check the environment the driver depends on, it does not change anything.
+func Diagnose(options DoctorOptions) []Finding {
+	var findings []Finding
+	findings = append(findings, checkCapabilities())
+	findings = append(findings, checkPidNamespace())
+	findings = append(findings, checkPluginSocket(options.PluginSocket)...)
+	networks, finding := checkConfig(options.ConfigDir)
+	findings = append(findings, finding)
+	links, netlinkFindings := checkNetlink()
+	findings = append(findings, netlinkFindings...)
+	findings = append(findings, checkGateways(networks, links)...)
+	findings = append(findings, checkBoundNics(options.Networks, links)...)
+	return findings
+}
+
+func checkCapabilities() Finding {
+	finding := Finding{Check: "capabilities"}
+	capEff, err := effectiveCapabilities()
+	if err != nil {
+		finding.Severity = SeverityWarning
+		finding.Message = fmt.Sprintf("Can not read capabilities: %s", err.Error())
+		return finding
+	}
+	var missing []string
+	for name, bit := range map[string]uint{"CAP_NET_ADMIN": capNetAdmin, "CAP_SYS_ADMIN": capSysAdmin} {
+		if capEff&(1<<bit) == 0 {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		finding.Severity = SeverityError
+		finding.Message = fmt.Sprintf("Missing capabilities %s", strings.Join(missing, ","))
+		finding.Fix = "Run as root, or grant the capabilities (docker run --privileged, or linux.capabilities of managed plugin)"
+		return finding
+	}
+	finding.Severity = SeverityOK
+	finding.Message = "CAP_NET_ADMIN and CAP_SYS_ADMIN are effective"
+	return finding
+}
+
+// effectiveCapabilities return CapEff of current process.
+func effectiveCapabilities() (uint64, error) {
+	f, err := os.Open(procStatus)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value := strings.TrimPrefix(scanner.Text(), "CapEff:"); value != scanner.Text() {
+			return strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("Can not find CapEff in [%s]", procStatus)
+}
+
+// checkPluginSocket check the plugin dir is writable, and the socket is not stale.
+func checkPluginSocket(socket string) []Finding {
+	dir := filepath.Dir(socket)
+	finding := Finding{Check: "plugin_dir"}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		finding.Severity = SeverityInfo
+		finding.Message = fmt.Sprintf("Plugin dir [%s] does not exist, it is created on start", dir)
+	} else if err := syscall.Access(dir, 2); err != nil {
+		finding.Severity = SeverityError
+		finding.Message = fmt.Sprintf("Plugin dir [%s] is not writable: %s", dir, err.Error())
+		finding.Fix = fmt.Sprintf("Run as root, or make [%s] writable, e.g., mount it read-write into the plugin container", dir)
+	} else {
+		finding.Severity = SeverityOK
+		finding.Message = fmt.Sprintf("Plugin dir [%s] is writable", dir)
+	}
+	findings := []Finding{finding}
+
+	finding = Finding{Check: "plugin_socket"}
+	if _, err := os.Stat(socket); os.IsNotExist(err) {
+		finding.Severity = SeverityInfo
+		finding.Message = fmt.Sprintf("Plugin socket [%s] does not exist, the plugin is not running", socket)
+	} else if conn, err := net.Dial("unix", socket); err != nil {
+		finding.Severity = SeverityError
+		finding.Message = fmt.Sprintf("Plugin socket [%s] is stale: %s", socket, err.Error())
+		finding.Fix = fmt.Sprintf("Remove [%s] or restart the plugin, docker fails to connect the stale socket", socket)
+	} else {
+		conn.Close()
+		finding.Severity = SeverityOK
+		finding.Message = fmt.Sprintf("Plugin socket [%s] is accepting connections", socket)
+	}
+	return append(findings, finding)
+}
+
+// checkConfig check config dir is readable and config file parses, return networks in config file.
+func checkConfig(configDir string) (Networks, Finding) {
+	finding := Finding{Check: "config"}
+	d := &HostNicDriver{configDir: configDir}
+	if _, err := os.Stat(configDir); os.IsNotExist(err) {
+		finding.Severity = SeverityInfo
+		finding.Message = fmt.Sprintf("Config dir [%s] does not exist, it is created on start", configDir)
+		return nil, finding
+	} else if f, err := os.Open(configDir); err != nil {
+		finding.Severity = SeverityError
+		finding.Message = fmt.Sprintf("Config dir [%s] is not readable: %s", configDir, err.Error())
+		finding.Fix = "Run as root, or fix the permission of config dir"
+		return nil, finding
+	} else {
+		f.Close()
+	}
+	networks, err := d.readConfig()
+	if err != nil {
+		finding.Severity = SeverityError
+		finding.Message = fmt.Sprintf("Config file [%s] is invalid: %s", d.configFilePath(), err.Error())
+		finding.Fix = "Fix or remove the config file, networks in it are lost if it is removed"
+		return nil, finding
+	}
+	finding.Severity = SeverityOK
+	finding.Message = fmt.Sprintf("Config file [%s] has %d networks", d.configFilePath(), len(networks))
+	return networks, finding
+}
+
+// checkPidNamespace check the plugin is in the pid namespace of host, gc needs it to find live sandboxes.
+func checkPidNamespace() Finding {
+	finding := Finding{Check: "pid_namespace"}
+	if err := checkHostPidNamespace(); err != nil {
+		finding.Severity = SeverityWarning
+		finding.Message = err.Error()
+		finding.Fix = "Run in host pid namespace (docker run --pid host, or pidhost of managed plugin), gc refuses to run otherwise"
+		return finding
+	}
+	finding.Severity = SeverityOK
+	finding.Message = "Processes of containers are visible"
+	return finding
+}
+
+// checkNetlink check netlink and network namespace access, return host links.
+func checkNetlink() ([]netlink.Link, []Finding) {
+	finding := Finding{Check: "netlink"}
+	links, err := netlink.LinkList()
+	if err != nil {
+		finding.Severity = SeverityError
+		finding.Message = fmt.Sprintf("List links by netlink error: %s", err.Error())
+		finding.Fix = "Run in host network namespace with CAP_NET_ADMIN (docker run --network host)"
+	} else {
+		finding.Severity = SeverityOK
+		finding.Message = fmt.Sprintf("Netlink works, %d links on host", len(links))
+	}
+	findings := []Finding{finding}
+
+	finding = Finding{Check: "netns"}
+	if err := checkSetns(); err != nil {
+		finding.Severity = SeverityError
+		finding.Message = fmt.Sprintf("Switch network namespace error: %s", err.Error())
+		finding.Fix = "Grant CAP_SYS_ADMIN, nics are moved into container network namespace by setns"
+	} else {
+		finding.Severity = SeverityOK
+		finding.Message = "Network namespace can be switched"
+	}
+	return links, append(findings, finding)
+}
+
+// checkSetns switch to the current network namespace, it needs the same permission as switching to sandbox.
+func checkSetns() error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		return err
+	}
+	defer origin.Close()
+	return netns.Set(origin)
+}
+
+// checkGateways flag networks with same gateway, which are not loaded, overlapped pools, and gateways used by host nics.
+func checkGateways(networks Networks, links []netlink.Link) []Finding {
+	var findings []Finding
+	hostAddrs := make(map[string]string)
+	for _, link := range links {
+		addrs, _ := netlink.AddrList(link, netlink.FAMILY_V4)
+		for _, addr := range addrs {
+			hostAddrs[addr.IP.String()] = link.Attrs().Name
+		}
+	}
+	ids := make([]string, 0, len(networks))
+	for id := range networks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for i, id := range ids {
+		nw := networks[id]
+		if nw.IPv4Data == nil {
+			continue
+		}
+		gateway, pool, _ := net.ParseCIDR(nw.IPv4Data.Gateway)
+		if name, ok := hostAddrs[gateway.String()]; gateway != nil && ok {
+			findings = append(findings, Finding{
+				Check:    "gateway",
+				Severity: SeverityWarning,
+				Message:  fmt.Sprintf("Gateway [%s] of network [%s] is the address of host nic [%s]", nw.IPv4Data.Gateway, id, name),
+				Fix:      "Containers use the host as gateway, make sure it is expected, or recreate the network with the gateway of the nic subnet",
+			})
+		}
+		for _, otherID := range ids[i+1:] {
+			other := networks[otherID]
+			if other.IPv4Data == nil {
+				continue
+			}
+			otherGateway, otherPool, _ := net.ParseCIDR(other.IPv4Data.Gateway)
+			if gateway != nil && gateway.Equal(otherGateway) {
+				findings = append(findings, Finding{
+					Check:    "gateway",
+					Severity: SeverityError,
+					Message:  fmt.Sprintf("Networks [%s] and [%s] have same gateway [%s], only one of them is loaded", id, otherID, nw.IPv4Data.Gateway),
+					Fix:      "Remove one of the networks by docker network rm, or remove it from the config file",
+				})
+			} else if pool != nil && otherPool != nil && (pool.Contains(otherPool.IP) || otherPool.Contains(pool.IP)) {
+				findings = append(findings, Finding{
+					Check:    "gateway",
+					Severity: SeverityWarning,
+					Message:  fmt.Sprintf("Subnets of networks [%s] [%s] and [%s] [%s] overlap", id, nw.IPv4Data.Gateway, otherID, other.IPv4Data.Gateway),
+					Fix:      "Recreate one of the networks with a subnet not overlapped",
+				})
+			}
+		}
+	}
+	if len(findings) == 0 {
+		findings = append(findings, Finding{Check: "gateway", Severity: SeverityOK, Message: "Gateways of networks do not conflict"})
+	}
+	return findings
+}
+
+// checkBoundNics report bound nics of the running plugin missing from host, nics in sandbox are not on host.
+func checkBoundNics(networks []NetworkStatus, links []netlink.Link) []Finding {
+	if networks == nil {
+		return []Finding{{Check: "bound_nics", Severity: SeverityInfo, Message: "Plugin is not running or admin api is disabled, bound nics are not checked"}}
+	}
+	hostAddrs := make(map[string]bool, len(links))
+	for _, link := range links {
+		hostAddrs[link.Attrs().HardwareAddr.String()] = true
+	}
+	var findings []Finding
+	for _, nw := range networks {
+		for _, endpoint := range nw.Endpoints {
+			if endpoint.SandboxKey != "" && !endpoint.Degraded {
+				continue
+			}
+			if !endpoint.Degraded && hostAddrs[endpoint.HardwareAddr] {
+				continue
+			}
+			findings = append(findings, Finding{
+				Check:    "bound_nics",
+				Severity: SeverityError,
+				Message:  fmt.Sprintf("Nic [%s] bound to endpoint [%s] of network [%s] is missing from host", endpoint.HardwareAddr, endpoint.ID, endpoint.Network),
+				Fix:      fmt.Sprintf("Check the nic is attached to host, or remove the container and release the nic by POST /nics/release?nic=%s of admin api", endpoint.HardwareAddr),
+			})
+		}
+	}
+	if len(findings) == 0 {
+		findings = append(findings, Finding{Check: "bound_nics", Severity: SeverityOK, Message: "Bound nics are on host or in container"})
+	}
+	return findings
+}
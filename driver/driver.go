@@ -4,287 +4,629 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/docker/go-plugins-helpers/network"
-	"github.com/vishvananda/netlink"
 	"github.com/yunify/docker-plugin-hostnic/log"
 	"io/ioutil"
 	"net"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	networkType         = "hostnic"
+	// DefaultName is the default driver name, which is the network type of docker network create -d.
+	DefaultName = "hostnic"
+	// DefaultConfigDir is the default dir of config file.
+	DefaultConfigDir = "/etc/docker/hostnic"
+
 	containerVethPrefix = "eth"
-	configDir           = "/etc/docker/hostnic"
+
+	// shutdownPollInterval is the interval to check whether in flight requests finish.
+	shutdownPollInterval = 50 * time.Millisecond
 )
 
-type NicTable map[string]*HostNic
+// loggers of subsystems, log levels of them can be changed separately.
+var (
+	driverLog    = log.Subsystem(log.Driver)
+	inventoryLog = log.Subsystem(log.Inventory)
+	configLog    = log.Subsystem(log.Config)
+	httpLog      = log.Subsystem(log.HTTP)
+)
 
+// HostNic fields except HardwareAddr are guarded by HostNicDriver.lock,
+// lock serializes the operations on the nic, e.g., join, leave and sandbox setup.
 type HostNic struct {
 	Name         string // e.g., "en0", "lo0", "eth0.100"
 	HardwareAddr string
 	Address      string
+	Index        int          // ifindex on host, 0 if the nic is not on host
+	Cloud        *NicMetadata // cloud subnet of the nic from metadata, nil if unknown
 	endpoint     *Endpoint
+	lock         sync.Mutex
 }
 
+// Endpoint fields are immutable after created, except srcName, degraded, setupError, sandboxKey and updated which are guarded by hostNic.lock.
 type Endpoint struct {
-	id      string
-	hostNic *HostNic
-	srcName string
+	id        string
+	networkID string
+	hostNic   *HostNic
+	srcName   string
+	bandwidth *Bandwidth
+	antiSpoof bool
+	addresses []string
+	degraded  bool // the bound nic disappeared
+	// the error of applying settings in sandbox, the endpoint is degraded if it is set
+	setupError string
+	// the nic is provisioned by nic provider for the endpoint, and deleted with it
+	provisioned   bool
+	policyRouting bool
 	//portMapping []types.PortBinding // Operation port bindings
 	dbIndex    uint64
 	dbExists   bool
 	sandboxKey string
+	// joined is a copy of sandboxKey for readers which must not wait hostNic.lock, e.g., metrics scrape
+	joined atomic.Value
+	// updated is the time the endpoint is created or joined
+	updated time.Time
+	// spoofCheck is the spoof check of vf before anti spoof enables it, restored when the endpoint leaves
+	spoofCheck *vfSpoofCheck
+}
+
+// setSandboxKey bind the endpoint to sandbox, or unbind it by "", hostNic.lock must be held.
+func (endpoint *Endpoint) setSandboxKey(sandboxKey string) {
+	endpoint.sandboxKey = sandboxKey
+	endpoint.joined.Store(sandboxKey)
+	if sandboxKey != "" {
+		endpoint.updated = time.Now()
+	}
 }
 
-func New() (*HostNicDriver, error) {
+func New(configDir string) (*HostNicDriver, error) {
 	err := os.MkdirAll(configDir, os.FileMode(0755))
 	if err != nil {
 		return nil, err
 	}
 	d := &HostNicDriver{
-		networks: Networks{},
-		lock:     sync.RWMutex{},
-		nics:     make(NicTable),
+		configDir: configDir,
+		networks:  Networks{},
+		lock:      sync.RWMutex{},
+		nics:      NewNicTable(),
+		done:      make(chan struct{}),
 	}
+	d.nics.emit = d.emit
 	err = d.loadConfig()
 	if err != nil {
 		return nil, err
 	}
+	err = d.watchNics()
+	if err != nil {
+		return nil, err
+	}
 	return d, nil
 }
 
 type Networks map[string]*Network
 
+// Network exported fields are immutable after registered, endpoints is guarded by lock.
 type Network struct {
 	ID        string
 	IPv4Data  *network.IPAMData
+	IPMap     map[string]string // container ip to host nic hardware addr or name
+	Bandwidth *Bandwidth        `json:",omitempty"` // default bandwidth of endpoints
+	AntiSpoof bool              `json:",omitempty"`
+	VxNet     string            `json:",omitempty"` // cloud network to provision nics on
+	// default policy routing of endpoints
+	PolicyRouting bool `json:",omitempty"`
+	// network imported from another host, registered by its id there until docker creates a network of same gateway,
+	// which adopts its reservations. Name is the docker network name on the old host.
+	Imported  bool   `json:",omitempty"`
+	Name      string `json:",omitempty"`
 	endpoints map[string]*Endpoint
+	lock      sync.RWMutex
 }
 
 //HostNicDriver implements github.com/docker/go-plugins-helpers/network.Driver
+// lock only guards networks and nics, slow operations on a nic hold the lock of the nic.
+// Lock order: HostNic.lock, Network.lock, HostNicDriver.lock.
 type HostNicDriver struct {
-	networks Networks
-	nics     NicTable
-	lock     sync.RWMutex
+	requests   int64  // in flight requests, first for 64 bit alignment of atomic operations
+	configDir  string // networks are not persisted if it is empty
+	networks   Networks
+	nics       *NicTable
+	protected  map[string]bool // names and hardware addrs of nics never bound to endpoints
+	lock       sync.RWMutex
+	configLock sync.Mutex
+	events     eventBus
+	hooks      hookRunner
+	provider   NicProvider // nil if nics are not provisioned
+	// max time to wait a provisioned nic appears on host
+	provisionTimeout time.Duration
+	done             chan struct{}
+	stopOnce         sync.Once
+	// watchers are the goroutines which run until done is closed, e.g., watching nics
+	watchers sync.WaitGroup
+	// probe is closed when the pending probe of Alive acquires the lock, nil if no probe is pending
+	probe     chan struct{}
+	probeLock sync.Mutex
 }
 
 func (d *HostNicDriver) RegisterNetwork(networkID string, ipv4Data *network.IPAMData) error {
-	if nw := d.getNetworkByGateway(ipv4Data.Gateway); nw != nil {
-		return fmt.Errorf("Exist network [%s] with same gateway [%s]", nw.ID, nw.IPv4Data.Gateway)
-	}
-	nw := Network{
-		IPv4Data:  ipv4Data,
-		ID:        networkID,
-		endpoints: make(map[string]*Endpoint),
+	return d.registerNetwork(driverLog.WithFields(log.Fields{"network_id": networkID}), &Network{
+		IPv4Data: ipv4Data,
+		ID:       networkID,
+	}, nil)
+}
+
+// registerNetwork register the network, the network of same gateway is replaced if it is adopt, or it is an error.
+func (d *HostNicDriver) registerNetwork(logger *log.Entry, nw *Network, adopt *Network) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if exist := d.getNetworkByGateway(nw.IPv4Data.Gateway); exist != nil {
+		if exist != adopt {
+			return fmt.Errorf("Exist network [%s] with same gateway [%s]", exist.ID, exist.IPv4Data.Gateway)
+		}
+		delete(d.networks, exist.ID)
+		logger.WithFields(log.Fields{"imported_id": exist.ID, "name": exist.Name}).Info("Adopt imported network of same gateway")
 	}
-	d.networks[networkID] = &nw
-	log.Info("RegisterNetwork [%s] IPv4Data : [ %+v ]", nw.ID, nw.IPv4Data)
+	nw.endpoints = make(map[string]*Endpoint)
+	d.networks[nw.ID] = nw
+	logger.WithFields(log.Fields{"pool": nw.IPv4Data.Pool, "gateway": nw.IPv4Data.Gateway}).Info("Register network")
 	return nil
 }
 
-func (d *HostNicDriver) GetCapabilities() (*network.CapabilitiesResponse, error) {
+func (d *HostNicDriver) getNetwork(networkID string) (*Network, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	nw := d.networks[networkID]
+	if nw == nil {
+		return nil, fmt.Errorf("Can not find network [ %s ].", networkID)
+	}
+	return nw, nil
+}
+
+func (d *HostNicDriver) getEndpoint(networkID string, endpointID string) (*Network, *Endpoint, error) {
+	nw, err := d.getNetwork(networkID)
+	if err != nil {
+		return nil, nil, err
+	}
+	nw.lock.RLock()
+	defer nw.lock.RUnlock()
+	endpoint := nw.endpoints[endpointID]
+	if endpoint == nil {
+		return nil, nil, fmt.Errorf("Cannot find endpoint by id: %s", endpointID)
+	}
+	return nw, endpoint, nil
+}
+
+// networkList return all networks, the endpoints of networks may be changed after return.
+func (d *HostNicDriver) networkList() []*Network {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	networks := make([]*Network, 0, len(d.networks))
+	for _, nw := range d.networks {
+		networks = append(networks, nw)
+	}
+	return networks
+}
+
+// endpointList return all endpoints of network.
+func (nw *Network) endpointList() []*Endpoint {
+	nw.lock.RLock()
+	defer nw.lock.RUnlock()
+	endpoints := make([]*Endpoint, 0, len(nw.endpoints))
+	for _, endpoint := range nw.endpoints {
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints
+}
+
+func (d *HostNicDriver) GetCapabilities() (resp *network.CapabilitiesResponse, err error) {
+	_, finish := d.startRequest("GetCapabilities", nil)
+	defer finish(&err)
 	return &network.CapabilitiesResponse{Scope: network.LocalScope}, nil
 }
 
-func (d *HostNicDriver) CreateNetwork(r *network.CreateNetworkRequest) error {
-	log.Debug("CreateNetwork Called: [ %+v ]", r)
-	log.Debug("CreateNetwork IPv4Data len : [ %v ]", len(r.IPv4Data))
-	d.lock.Lock()
-	defer d.lock.Unlock()
+func (d *HostNicDriver) CreateNetwork(r *network.CreateNetworkRequest) (err error) {
+	logger, finish := d.startRequest("CreateNetwork", log.Fields{"network_id": r.NetworkID})
+	defer finish(&err)
 	if r.IPv4Data == nil || len(r.IPv4Data) == 0 {
 		return fmt.Errorf("Network gateway config miss.")
 	}
 	ipv4Data := r.IPv4Data[0]
-	err := d.RegisterNetwork(r.NetworkID, ipv4Data)
+	options := genericOptions(r.Options)
+	ipMap, err := parseIPMap(options[ipMapOption])
 	if err != nil {
 		return err
 	}
-	d.saveConfig()
+	bandwidth, err := parseBandwidth(options, nil)
+	if err != nil {
+		return err
+	}
+	antiSpoof := false
+	if v, ok := options[antiSpoofOption]; ok {
+		if antiSpoof, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("Invalid %s [%s]: %s", antiSpoofOption, v, err.Error())
+		}
+	}
+	policyRouting, err := parsePolicyRouting(options, false)
+	if err != nil {
+		return err
+	}
+	// the network imported from another host is adopted with its reservations, docker knows it by the new id only.
+	adopt := d.importedNetwork(ipv4Data.Gateway)
+	reason := ""
+	if adopt != nil {
+		for ip, nic := range adopt.IPMap {
+			if _, ok := ipMap[ip]; !ok {
+				ipMap[ip] = nic
+			}
+		}
+		reason = fmt.Sprintf("adopt imported network [%s]", adopt.ID)
+	}
+	err = d.registerNetwork(logger, &Network{
+		ID:            r.NetworkID,
+		IPv4Data:      ipv4Data,
+		IPMap:         ipMap,
+		Bandwidth:     bandwidth,
+		AntiSpoof:     antiSpoof,
+		VxNet:         options[vxnetOption],
+		PolicyRouting: policyRouting,
+	}, adopt)
+	if err != nil {
+		return err
+	}
+	d.emit(Event{Type: NetworkCreated, Network: r.NetworkID, Reason: reason})
+	d.saveConfig(logger)
 	return nil
 }
 
-func (d *HostNicDriver) AllocateNetwork(r *network.AllocateNetworkRequest) (*network.AllocateNetworkResponse, error) {
-	log.Debug("AllocateNetwork Called: [ %+v ]", r)
+func (d *HostNicDriver) AllocateNetwork(r *network.AllocateNetworkRequest) (resp *network.AllocateNetworkResponse, err error) {
+	_, finish := d.startRequest("AllocateNetwork", log.Fields{"network_id": r.NetworkID})
+	defer finish(&err)
 	return nil, nil
 }
 
-func (d *HostNicDriver) DeleteNetwork(r *network.DeleteNetworkRequest) error {
-	log.Debug("DeleteNetwork Called: [ %+v ]", r)
+func (d *HostNicDriver) DeleteNetwork(r *network.DeleteNetworkRequest) (err error) {
+	logger, finish := d.startRequest("DeleteNetwork", log.Fields{"network_id": r.NetworkID})
+	defer finish(&err)
 	d.lock.Lock()
-	defer d.lock.Unlock()
 	delete(d.networks, r.NetworkID)
-	d.saveConfig()
+	d.lock.Unlock()
+	d.emit(Event{Type: NetworkDeleted, Network: r.NetworkID})
+	d.saveConfig(logger)
 	return nil
 }
-func (d *HostNicDriver) FreeNetwork(r *network.FreeNetworkRequest) error {
-	log.Debug("FreeNetwork Called: [ %+v ]", r)
+func (d *HostNicDriver) FreeNetwork(r *network.FreeNetworkRequest) (err error) {
+	_, finish := d.startRequest("FreeNetwork", log.Fields{"network_id": r.NetworkID})
+	defer finish(&err)
 	return nil
 }
-func (d *HostNicDriver) CreateEndpoint(r *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
-	d.lock.Lock()
-	defer d.lock.Unlock()
-
-	log.Debug("CreateEndpoint Called: [ %+v ]", r)
-	log.Debug("r.Interface: [ %+v ]", r.Interface)
-	nw := d.networks[r.NetworkID]
-
-	if nw == nil {
-		return nil, fmt.Errorf("Can not find network [ %s ].", r.NetworkID)
+func (d *HostNicDriver) CreateEndpoint(r *network.CreateEndpointRequest) (resp *network.CreateEndpointResponse, err error) {
+	logger, finish := d.startRequest("CreateEndpoint", log.Fields{"network_id": r.NetworkID, "endpoint_id": r.EndpointID})
+	defer finish(&err)
+	nw, err := d.getNetwork(r.NetworkID)
+	if err != nil {
+		return nil, err
 	}
 
-	var hostNic *HostNic
-
-	if r.Interface.MacAddress == "" {
-		return nil, fmt.Errorf("Please set --mac-address argument. Request interface [%+v] ", r.Interface)
+	options := endpointOptions(r.Options)
+	bandwidth, err := parseBandwidth(options, nw.Bandwidth)
+	if err != nil {
+		return nil, err
 	}
-
-	hostNic = d.FindNicByHardwareAddr(r.Interface.MacAddress)
-
-	if hostNic == nil {
-		return nil, fmt.Errorf("Can not find host nic by mac address [%+v] ", r.Interface.MacAddress)
+	policyRouting, err := parsePolicyRouting(options, nw.PolicyRouting)
+	if err != nil {
+		return nil, err
 	}
 
-	if hostNic.endpoint != nil {
-		return nil, fmt.Errorf("Host nic [%s] has bind to endpoint [ %+v ] ", hostNic.Name, hostNic.endpoint)
+	var hostNic *HostNic
+	provisioned := false
+	address := r.Interface.Address
+	cloudNic, cloudAddress, cloudErr := d.findNicByMetadata(nw, address)
+	switch {
+	case r.Interface.MacAddress != "":
+		hostNic = d.FindNicByHardwareAddr(r.Interface.MacAddress)
+		if hostNic == nil {
+			return nil, fmt.Errorf("Can not find host nic by mac address [%+v] ", r.Interface.MacAddress)
+		}
+	case r.Interface.Address != "" && nw.IPMap[addressIP(r.Interface.Address)] != "":
+		hostNic, err = d.findNicByIPMap(nw, r.Interface.Address)
+		if err != nil {
+			return nil, err
+		}
+	case cloudNic != nil:
+		hostNic, address = cloudNic, cloudAddress
+	case d.provider != nil && nw.VxNet != "":
+		hostNic, err = d.provisionNic(logger, nw, r.EndpointID, r.Interface.Address)
+		if err != nil {
+			return nil, err
+		}
+		provisioned = true
+		// delete the nic if the endpoint is not created
+		defer func() {
+			if err != nil {
+				d.deprovisionNic(logger, hostNic.HardwareAddr)
+			}
+		}()
+	case r.Interface.Address != "" && len(nw.IPMap) > 0:
+		hostNic, err = d.findNicByIPMap(nw, r.Interface.Address)
+		if err != nil {
+			return nil, err
+		}
+	case cloudErr != nil:
+		return nil, cloudErr
+	default:
+		return nil, fmt.Errorf("Please set --mac-address argument, or set --ip argument with network option [%s] or of a nic in metadata. Request interface [%+v] ", ipMapOption, r.Interface)
 	}
 
-	hostNic.Address = r.Interface.Address
-	hostIfName := hostNic.Name
 	endpoint := &Endpoint{}
-
-	// Store the sandbox side pipe interface parameters
-	endpoint.srcName = hostIfName
 	endpoint.hostNic = hostNic
 	endpoint.id = r.EndpointID
+	endpoint.networkID = nw.ID
+	endpoint.bandwidth = bandwidth
+	endpoint.antiSpoof = nw.AntiSpoof
+	endpoint.provisioned = provisioned
+	endpoint.policyRouting = policyRouting
+	endpoint.updated = time.Now()
+	for _, addr := range []string{address, r.Interface.AddressIPv6} {
+		if addr != "" {
+			endpoint.addresses = append(endpoint.addresses, addr)
+		}
+	}
 
-	nw.endpoints[endpoint.id] = endpoint
-	hostNic.endpoint = endpoint
+	// serialize with the operations on the nic, so hooks and events of the nic are in order.
+	hostNic.lock.Lock()
+	defer hostNic.lock.Unlock()
+	if err := d.runHook(logger, d.hookPayload(PreCreateEndpoint, nw, endpoint, "")); err != nil {
+		return nil, err
+	}
+	hostAddress, err := d.bindEndpoint(nw, endpoint, address)
+	if err != nil {
+		return nil, err
+	}
+	logger.WithFields(log.Fields{"mac": hostNic.HardwareAddr, "nic": endpoint.srcName, "address": hostAddress}).Info("Bind host nic to endpoint")
+	d.emit(Event{Type: EndpointCreated, Network: nw.ID, Endpoint: endpoint.id, HardwareAddr: hostNic.HardwareAddr, Nic: endpoint.srcName, Address: hostAddress})
+	d.runHook(logger, d.hookPayload(PostCreateEndpoint, nw, endpoint, ""))
 
 	endpointInterface := &network.EndpointInterface{}
 	if r.Interface.Address == "" {
-		endpointInterface.Address = hostNic.Address
+		endpointInterface.Address = hostAddress
 	}
 	if r.Interface.MacAddress == "" {
 		endpointInterface.MacAddress = hostNic.HardwareAddr
 	}
-	resp := &network.CreateEndpointResponse{Interface: endpointInterface}
-	log.Debug("CreateEndpoint resp interface: [ %+v ] ", resp.Interface)
-	return resp, nil
+	return &network.CreateEndpointResponse{Interface: endpointInterface}, nil
 }
 
-func (d *HostNicDriver) EndpointInfo(r *network.InfoRequest) (*network.InfoResponse, error) {
-	log.Debug("EndpointInfo Called: [ %+v ]", r)
-	d.lock.RLock()
-	defer d.lock.RUnlock()
-	nw := d.networks[r.NetworkID]
-	if nw == nil {
-		return nil, fmt.Errorf("Can not find network [ %s ].", r.NetworkID)
+// bindEndpoint bind the host nic of endpoint to it, and add the endpoint to network. Return the address of the nic.
+func (d *HostNicDriver) bindEndpoint(nw *Network, endpoint *Endpoint, address string) (string, error) {
+	hostNic := endpoint.hostNic
+	nw.lock.Lock()
+	defer nw.lock.Unlock()
+	if nw.endpoints[endpoint.id] != nil {
+		return "", fmt.Errorf("Endpoint [%s] is exist", endpoint.id)
 	}
 
-	endpoint := nw.endpoints[r.EndpointID]
-	if endpoint == nil {
-		return nil, fmt.Errorf("Cannot find endpoint by id: %s", r.EndpointID)
+	// bind the nic to endpoint
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.nics.ByHardwareAddr(hostNic.HardwareAddr) != hostNic {
+		return "", fmt.Errorf("Host nic [%s] is not exist on host", hostNic.HardwareAddr)
+	}
+	if d.isProtected(hostNic) {
+		return "", fmt.Errorf("Host nic [%s] is protected, it can not be bound to endpoint", hostNic.Name)
 	}
+	if hostNic.endpoint != nil {
+		return "", fmt.Errorf("Host nic [%s] has bind to endpoint [ %+v ] ", hostNic.Name, hostNic.endpoint.id)
+	}
+	if address != "" {
+		hostNic.Address = address
+	}
+	// Store the sandbox side pipe interface parameters
+	endpoint.srcName = hostNic.Name
+	hostNic.endpoint = endpoint
+	nw.endpoints[endpoint.id] = endpoint
+	return hostNic.Address, nil
+}
+
+func (d *HostNicDriver) EndpointInfo(r *network.InfoRequest) (resp *network.InfoResponse, err error) {
+	logger, finish := d.startRequest("EndpointInfo", log.Fields{"network_id": r.NetworkID, "endpoint_id": r.EndpointID})
+	defer finish(&err)
+	_, endpoint, err := d.getEndpoint(r.NetworkID, r.EndpointID)
+	if err != nil {
+		return nil, err
+	}
+	endpoint.hostNic.lock.Lock()
+	defer endpoint.hostNic.lock.Unlock()
 
 	value := make(map[string]string)
 	value["id"] = endpoint.id
 	value["srcName"] = endpoint.srcName
+	d.lock.RLock()
 	value["hostNic.Name"] = endpoint.hostNic.Name
 	value["hostNic.Addr"] = endpoint.hostNic.Address
+	d.lock.RUnlock()
 	value["hostNic.HardwareAddr"] = endpoint.hostNic.HardwareAddr
-	resp := &network.InfoResponse{
-		Value: value,
+	if endpoint.bandwidth != nil {
+		endpoint.bandwidth.info(value)
 	}
-	log.Debug("EndpointInfo resp.Value : [ %+v ]", resp.Value)
-	return resp, nil
-}
-func (d *HostNicDriver) Join(r *network.JoinRequest) (*network.JoinResponse, error) {
-	d.lock.Lock()
-	defer d.lock.Unlock()
-	log.Debug("Join Called: [ %+v ]", r)
-
-	nw := d.networks[r.NetworkID]
-	if nw == nil {
-		return nil, fmt.Errorf("Can not find network [ %s ].", r.NetworkID)
+	if endpoint.antiSpoof {
+		value["antiSpoof"] = "true"
 	}
-
-	endpoint := nw.endpoints[r.EndpointID]
-	if endpoint == nil {
-		return nil, fmt.Errorf("Cannot find endpoint by id: %s", r.EndpointID)
+	if endpoint.degraded || endpoint.setupError != "" {
+		value["degraded"] = "true"
+	}
+	if endpoint.setupError != "" {
+		value["setupError"] = endpoint.setupError
+	}
+	if endpoint.provisioned {
+		value["provisioned"] = "true"
 	}
+	if endpoint.policyRouting {
+		value["policyRouting"] = "true"
+	}
+	value["sandboxKey"] = endpoint.sandboxKey
+	var sb *sandbox
+	if endpoint.sandboxKey != "" {
+		sb, err = openSandbox(endpoint.sandboxKey, endpoint.hostNic.HardwareAddr)
+	} else {
+		sb, err = hostSandbox(endpoint.hostNic.HardwareAddr)
+	}
+	if err == nil {
+		linkInfo(logger, sb, value)
+		sb.Close()
+	} else {
+		logger.WithError(err).Debug("Get link of endpoint error")
+	}
+	return &network.InfoResponse{Value: value}, nil
+}
+func (d *HostNicDriver) Join(r *network.JoinRequest) (resp *network.JoinResponse, err error) {
+	logger, finish := d.startRequest("Join", log.Fields{"network_id": r.NetworkID, "endpoint_id": r.EndpointID, "sandbox": r.SandboxKey})
+	defer finish(&err)
+	nw, endpoint, err := d.getEndpoint(r.NetworkID, r.EndpointID)
+	if err != nil {
+		return nil, err
+	}
+	endpoint.hostNic.lock.Lock()
+	defer endpoint.hostNic.lock.Unlock()
 
 	if endpoint.sandboxKey != "" {
 		return nil, fmt.Errorf("Endpoint [%s] has bean bind to sandbox [%s]", r.EndpointID, endpoint.sandboxKey)
 	}
+	d.lock.RLock()
+	name, index := endpoint.hostNic.Name, endpoint.hostNic.Index
+	d.lock.RUnlock()
+	if endpoint.degraded || index == 0 {
+		return nil, fmt.Errorf("Host nic [%s] of endpoint [%s] is not exist on host", endpoint.hostNic.HardwareAddr, r.EndpointID)
+	}
+	// nic dev name may be changed by os, so ensure it is update.
+	endpoint.srcName = name
+	logger = logger.WithFields(log.Fields{"mac": endpoint.hostNic.HardwareAddr, "nic": name})
 	gw, _, err := net.ParseCIDR(nw.IPv4Data.Gateway)
 	if err != nil {
 		return nil, fmt.Errorf("Parse gateway [%s] error: %s", nw.IPv4Data.Gateway, err.Error())
 	}
-	endpoint.sandboxKey = r.SandboxKey
-	resp := network.JoinResponse{
+	if err := d.runHook(logger, d.hookPayload(PreJoin, nw, endpoint, r.SandboxKey)); err != nil {
+		return nil, err
+	}
+	var watch *linkWatch
+	if endpoint.bandwidth != nil || endpoint.antiSpoof || endpoint.policyRouting {
+		// watch the sandbox before join returns, so settings are applied as soon as docker moves the nic into it.
+		if watch, err = watchSandbox(r.SandboxKey); err != nil {
+			if endpoint.antiSpoof {
+				return nil, fmt.Errorf("Watch sandbox [%s] for anti spoof error: %s", r.SandboxKey, err.Error())
+			}
+			logger.WithError(err).Warning("Watch sandbox error, poll it instead")
+		}
+	}
+	if endpoint.antiSpoof && endpoint.spoofCheck == nil {
+		if endpoint.spoofCheck, err = enableVfSpoofCheck(endpoint.srcName); err != nil {
+			watch.Close()
+			return nil, fmt.Errorf("Enable spoof check of host nic [%s] error: %s", endpoint.srcName, err.Error())
+		}
+	}
+	endpoint.setSandboxKey(r.SandboxKey)
+	if endpoint.bandwidth != nil || endpoint.antiSpoof || endpoint.policyRouting {
+		go d.setupSandbox(logger, endpoint, r.SandboxKey, gw, watch)
+	}
+	logger.Info("Join sandbox with gateway [%s]", gw.String())
+	d.emit(Event{Type: EndpointJoined, Network: nw.ID, Endpoint: endpoint.id, HardwareAddr: endpoint.hostNic.HardwareAddr, Nic: endpoint.srcName, Sandbox: r.SandboxKey})
+	d.runHook(logger, d.hookPayload(PostJoin, nw, endpoint, r.SandboxKey))
+	return &network.JoinResponse{
 		InterfaceName:         network.InterfaceName{SrcName: endpoint.srcName, DstPrefix: containerVethPrefix},
 		DisableGatewayService: false,
 		Gateway:               gw.String(),
-	}
-
-	log.Debug("Join resp : [ %+v ]", resp)
-	return &resp, nil
+	}, nil
 }
-func (d *HostNicDriver) Leave(r *network.LeaveRequest) error {
-	log.Debug("Leave Called: [ %+v ]", r)
-	d.lock.Lock()
-	defer d.lock.Unlock()
-
-	nw := d.networks[r.NetworkID]
-	if nw == nil {
-		return fmt.Errorf("Can not find network [ %s ].", r.NetworkID)
+func (d *HostNicDriver) Leave(r *network.LeaveRequest) (err error) {
+	logger, finish := d.startRequest("Leave", log.Fields{"network_id": r.NetworkID, "endpoint_id": r.EndpointID})
+	defer finish(&err)
+	nw, endpoint, err := d.getEndpoint(r.NetworkID, r.EndpointID)
+	if err != nil {
+		return err
 	}
+	endpoint.hostNic.lock.Lock()
+	defer endpoint.hostNic.lock.Unlock()
 
-	endpoint := nw.endpoints[r.EndpointID]
-	if endpoint == nil {
-		return fmt.Errorf("Cannot find endpoint by id: %s", r.EndpointID)
+	sandboxKey := endpoint.sandboxKey
+	logger = logger.WithFields(log.Fields{"mac": endpoint.hostNic.HardwareAddr, "sandbox": sandboxKey})
+	if err := d.runHook(logger, d.hookPayload(PreLeave, nw, endpoint, sandboxKey)); err != nil {
+		return err
 	}
-
-	endpoint.sandboxKey = ""
+	cleanupSandbox(logger, endpoint, sandboxKey)
+	d.emit(Event{Type: EndpointLeft, Network: r.NetworkID, Endpoint: endpoint.id, HardwareAddr: endpoint.hostNic.HardwareAddr, Nic: endpoint.srcName, Sandbox: sandboxKey})
+	endpoint.setSandboxKey("")
+	endpoint.setupError = ""
+	logger.Info("Leave sandbox")
+	d.runHook(logger, d.hookPayload(PostLeave, nw, endpoint, sandboxKey))
 	return nil
 }
 
-func (d *HostNicDriver) DeleteEndpoint(r *network.DeleteEndpointRequest) error {
-	log.Debug("DeleteEndpoint Called: [ %+v ]", r)
-	d.lock.Lock()
-	defer d.lock.Unlock()
-	nw := d.networks[r.NetworkID]
-	if nw == nil {
-		return fmt.Errorf("Can not find network [ %s ].", r.NetworkID)
+func (d *HostNicDriver) DeleteEndpoint(r *network.DeleteEndpointRequest) (err error) {
+	logger, finish := d.startRequest("DeleteEndpoint", log.Fields{"network_id": r.NetworkID, "endpoint_id": r.EndpointID})
+	defer finish(&err)
+	nw, endpoint, err := d.getEndpoint(r.NetworkID, r.EndpointID)
+	if err != nil {
+		return err
 	}
-
-	endpoint := nw.endpoints[r.EndpointID]
-	if endpoint == nil {
+	// wait the operations on the nic finish
+	endpoint.hostNic.lock.Lock()
+	defer endpoint.hostNic.lock.Unlock()
+	if err := d.runHook(logger, d.hookPayload(PreDeleteEndpoint, nw, endpoint, "")); err != nil {
+		return err
+	}
+	nw.lock.Lock()
+	if nw.endpoints[r.EndpointID] != endpoint {
+		nw.lock.Unlock()
 		return fmt.Errorf("Cannot find endpoint by id: %s", r.EndpointID)
 	}
 	delete(nw.endpoints, r.EndpointID)
-	endpoint.hostNic.endpoint = nil
+	d.lock.Lock()
+	d.nics.release(endpoint.hostNic)
+	d.lock.Unlock()
+	nw.lock.Unlock()
+	logger.WithFields(log.Fields{"mac": endpoint.hostNic.HardwareAddr}).Info("Release host nic of endpoint")
+	d.emit(Event{Type: EndpointDeleted, Network: r.NetworkID, Endpoint: endpoint.id, HardwareAddr: endpoint.hostNic.HardwareAddr, Nic: endpoint.srcName})
+	if endpoint.provisioned {
+		d.deprovisionNic(logger, endpoint.hostNic.HardwareAddr)
+	}
+	d.runHook(logger, d.hookPayload(PostDeleteEndpoint, nw, endpoint, ""))
 	return nil
 }
 
-func (d *HostNicDriver) DiscoverNew(r *network.DiscoveryNotification) error {
-	log.Debug("DiscoverNew Called: [ %+v ]", r)
+func (d *HostNicDriver) DiscoverNew(r *network.DiscoveryNotification) (err error) {
+	_, finish := d.startRequest("DiscoverNew", log.Fields{"discovery_type": r.DiscoveryType})
+	defer finish(&err)
 	return nil
 }
-func (d *HostNicDriver) DiscoverDelete(r *network.DiscoveryNotification) error {
-	log.Debug("DiscoverDelete Called: [ %+v ]", r)
+func (d *HostNicDriver) DiscoverDelete(r *network.DiscoveryNotification) (err error) {
+	_, finish := d.startRequest("DiscoverDelete", log.Fields{"discovery_type": r.DiscoveryType})
+	defer finish(&err)
 	return nil
 }
-func (d *HostNicDriver) ProgramExternalConnectivity(r *network.ProgramExternalConnectivityRequest) error {
-	log.Debug("ProgramExternalConnectivity Called: [ %+v ]", r)
+func (d *HostNicDriver) ProgramExternalConnectivity(r *network.ProgramExternalConnectivityRequest) (err error) {
+	_, finish := d.startRequest("ProgramExternalConnectivity", log.Fields{"network_id": r.NetworkID, "endpoint_id": r.EndpointID})
+	defer finish(&err)
 	return nil
 }
-func (d *HostNicDriver) RevokeExternalConnectivity(r *network.RevokeExternalConnectivityRequest) error {
-	log.Debug("RevokeExternalConnectivity Called: [ %+v ]", r)
+func (d *HostNicDriver) RevokeExternalConnectivity(r *network.RevokeExternalConnectivityRequest) (err error) {
+	_, finish := d.startRequest("RevokeExternalConnectivity", log.Fields{"network_id": r.NetworkID, "endpoint_id": r.EndpointID})
+	defer finish(&err)
 	return nil
 }
 
+// importedNetwork return the imported network of gateway without endpoints, nil if not found.
+func (d *HostNicDriver) importedNetwork(gateway string) *Network {
+	d.lock.RLock()
+	nw := d.getNetworkByGateway(gateway)
+	d.lock.RUnlock()
+	if nw == nil || !nw.Imported || len(nw.endpointList()) > 0 {
+		return nil
+	}
+	return nw
+}
+
 func (d *HostNicDriver) getNetworkByGateway(gateway string) *Network {
 	for _, nw := range d.networks {
 		if nw.IPv4Data.Gateway == gateway {
@@ -294,99 +636,221 @@ func (d *HostNicDriver) getNetworkByGateway(gateway string) *Network {
 	return nil
 }
 
-func (d *HostNicDriver) findNicFromInterfaces(hardwareAddr string) *HostNic {
-	nics, err := net.Interfaces()
-	if err == nil {
-		for _, nic := range nics {
-			if nic.HardwareAddr.String() == hardwareAddr {
-				return &HostNic{Name: nic.Name, HardwareAddr: nic.HardwareAddr.String(), Address: GetInterfaceIPAddr(nic)}
-			}
-		}
-	} else {
-		log.Error("Get Interfaces error:%s", err.Error())
+// FindNicByHardwareAddr find nic in nic table, sync nic table once if not found.
+func (d *HostNicDriver) FindNicByHardwareAddr(hardwareAddr string) *HostNic {
+	find := func() *HostNic {
+		d.lock.RLock()
+		defer d.lock.RUnlock()
+		return d.nics.ByHardwareAddr(hardwareAddr)
 	}
-	return nil
+	if nic := find(); nic != nil {
+		return nic
+	}
+	d.syncNics()
+	nic := find()
+	if nic == nil {
+		errorsTotal.inc(findNicError)
+	}
+	return nic
 }
 
-func (d *HostNicDriver) findNicFromLinks(hardwareAddr string) *HostNic {
-	links, err := netlink.LinkList()
-	if err == nil {
-		for _, link := range links {
-			attr := link.Attrs()
-			if attr.HardwareAddr.String() == hardwareAddr {
-				return &HostNic{Name: attr.Name, HardwareAddr: attr.HardwareAddr.String()}
-			}
-		}
-	} else {
-		log.Error("Get LinkList error:%s", err.Error())
+// FindNicByName find nic in nic table, sync nic table once if not found.
+func (d *HostNicDriver) FindNicByName(name string) *HostNic {
+	find := func() *HostNic {
+		d.lock.RLock()
+		defer d.lock.RUnlock()
+		return d.nics.ByName(name)
 	}
-	return nil
+	if nic := find(); nic != nil {
+		return nic
+	}
+	d.syncNics()
+	nic := find()
+	if nic == nil {
+		errorsTotal.inc(findNicError)
+	}
+	return nic
 }
 
-func (d *HostNicDriver) FindNicByHardwareAddr(hardwareAddr string) *HostNic {
-	for _, nic := range d.nics {
-		//ensure nic in cache is exist on host.
-		if !d.ensureNic(nic) {
-			log.Info("Delete nic [%+v] to nic talbe", nic)
-			delete(d.nics, nic.HardwareAddr)
-			continue
-		}
-		if nic.HardwareAddr == hardwareAddr {
-			return nic
-		}
+// findNicByIPMap find the host nic mapped by the ip of address in network ip map.
+func (d *HostNicDriver) findNicByIPMap(nw *Network, address string) (*HostNic, error) {
+	ip := addressIP(address)
+	mapped, ok := nw.IPMap[ip]
+	if !ok {
+		return nil, fmt.Errorf("Ip [%s] is not in [%s] of network [%s] ", ip, ipMapOption, nw.ID)
 	}
-	nic := d.findNicFromInterfaces(hardwareAddr)
-	if nic == nil {
-		nic = d.findNicFromLinks(hardwareAddr)
+	var hostNic *HostNic
+	if _, err := net.ParseMAC(mapped); err == nil {
+		hostNic = d.FindNicByHardwareAddr(mapped)
+	} else {
+		hostNic = d.FindNicByName(mapped)
 	}
-	if nic != nil {
-		log.Info("Add nic [%+v] to nic talbe ", nic)
-		d.nics[nic.HardwareAddr] = nic
+	if hostNic == nil {
+		return nil, fmt.Errorf("Can not find host nic [%s] mapped by ip [%s] ", mapped, ip)
 	}
-	return nic
+	return hostNic, nil
 }
 
-// ensureNic ensure nic exist and info is update
-func (d *HostNicDriver) ensureNic(nic *HostNic) bool {
-	existNic := d.findNicFromInterfaces(nic.HardwareAddr)
-	if existNic == nil {
-		existNic = d.findNicFromLinks(nic.HardwareAddr)
+// configFilePath return the file which networks are saved to.
+func (d *HostNicDriver) configFilePath() string {
+	if d.configDir == "" {
+		return ""
 	}
-	if existNic != nil {
-		// nic dev name may be changed by os, so ensure it is update.
-		nic.Name = existNic.Name
+	return fmt.Sprintf("%s/%s", d.configDir, "config.json")
+}
+
+// readConfig read networks from config file, return empty networks if the file not exists.
+func (d *HostNicDriver) readConfig() (Networks, error) {
+	configFile := d.configFilePath()
+	networks := Networks{}
+	if configFile == "" {
+		return networks, nil
+	}
+	exists, err := FileExists(configFile)
+	if err != nil || !exists {
+		return networks, err
 	}
-	return existNic != nil
+	configData, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(configData, &networks)
+	if err != nil {
+		return nil, err
+	}
+	configLog.WithFields(log.Fields{"file": configFile}).Info("Load config")
+	return networks, nil
 }
 
 func (d *HostNicDriver) loadConfig() error {
-	configFile := fmt.Sprintf("%s/%s", configDir, "config.json")
-	exists, err := FileExists(configFile)
+	networks, err := d.readConfig()
 	if err != nil {
 		return err
 	}
-	if exists {
-		configData, err := ioutil.ReadFile(configFile)
-		if err != nil {
-			return err
+	for _, nw := range networks {
+		logger := configLog.WithFields(log.Fields{"network_id": nw.ID})
+		if err := d.registerNetwork(logger, nw, nil); err != nil {
+			logger.WithError(err).Error("Load network error")
 		}
-		networks := Networks{}
-		err = json.Unmarshal(configData, &networks)
-		if err != nil {
-			return err
+	}
+	return nil
+}
+
+// Reload load networks from config file again. Networks added to the file are registered,
+// networks removed from or changed in the file are unregistered or replaced if they have no endpoint.
+func (d *HostNicDriver) Reload() error {
+	networks, err := d.readConfig()
+	if err != nil {
+		return err
+	}
+	busy := make(map[string]bool)
+	for _, nw := range d.networkList() {
+		busy[nw.ID] = len(nw.endpointList()) > 0
+	}
+	d.lock.Lock()
+	var changed []*Network
+	for id, nw := range d.networks {
+		reloaded := networks[id]
+		if reloaded != nil && sameNetwork(nw, reloaded) {
+			delete(networks, id)
+			continue
 		}
-		log.Info("Load config from [%s]", configFile)
-		for _, nw := range networks {
-			d.RegisterNetwork(nw.ID, nw.IPv4Data)
+		if busy[id] {
+			configLog.WithFields(log.Fields{"network_id": id}).Warning("Network has endpoints, it is not reloaded")
+			delete(networks, id)
+			continue
+		}
+		delete(d.networks, id)
+		if reloaded == nil {
+			configLog.WithFields(log.Fields{"network_id": id}).Info("Unregister network removed from config")
+		}
+	}
+	for _, nw := range networks {
+		changed = append(changed, nw)
+	}
+	d.lock.Unlock()
+	for _, nw := range changed {
+		logger := configLog.WithFields(log.Fields{"network_id": nw.ID})
+		if err := d.registerNetwork(logger, nw, nil); err != nil {
+			logger.WithError(err).Error("Reload network error")
 		}
 	}
 	return nil
 }
 
+// sameNetwork return whether the saved fields of networks are same.
+func sameNetwork(a *Network, b *Network) bool {
+	da, _ := json.Marshal(a)
+	db, _ := json.Marshal(b)
+	return string(da) == string(db)
+}
+
+// Alive return whether the lock of driver can be acquired in timeout, the driver is wedged if not.
+// A probe still blocked on the lock is waited again instead of starting another one, so a wedged driver
+// does not pile up goroutines every watchdog tick.
+func (d *HostNicDriver) Alive(timeout time.Duration) bool {
+	d.probeLock.Lock()
+	if d.probe == nil {
+		acquired := make(chan struct{})
+		d.probe = acquired
+		go func() {
+			d.lock.Lock()
+			d.lock.Unlock()
+			d.probeLock.Lock()
+			d.probe = nil
+			d.probeLock.Unlock()
+			close(acquired)
+		}()
+	}
+	acquired := d.probe
+	d.probeLock.Unlock()
+	select {
+	case <-acquired:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Shutdown wait in flight requests finish in timeout, then flush networks to config file and stop watching nics.
+func (d *HostNicDriver) Shutdown(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&d.requests) > 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Shutdown timeout, %d requests are in flight", atomic.LoadInt64(&d.requests))
+		}
+		time.Sleep(shutdownPollInterval)
+	}
+	d.stopOnce.Do(func() {
+		close(d.done)
+	})
+	d.watchers.Wait()
+	if err := d.saveConfig(configLog); err != nil {
+		return err
+	}
+	d.events.closeAudit()
+	driverLog.Info("Driver is shutdown")
+	return nil
+}
+
 //write driver network to file, wait docker 1.3 to support plugin data persistence.
-func (d *HostNicDriver) saveConfig() error {
-	configFile := fmt.Sprintf("%s/%s", configDir, "config.json")
+func (d *HostNicDriver) saveConfig(logger *log.Entry) (err error) {
+	logger = logger.Subsystem(log.Config)
+	defer func() {
+		if err != nil {
+			errorsTotal.inc(saveConfigError)
+			logger.WithError(err).Error("Save config error")
+		}
+	}()
+	configFile := d.configFilePath()
+	if configFile == "" {
+		return nil
+	}
+	d.configLock.Lock()
+	defer d.configLock.Unlock()
+	d.lock.RLock()
 	data, err := json.Marshal(d.networks)
+	d.lock.RUnlock()
 	if err != nil {
 		return err
 	}
@@ -394,6 +858,6 @@ func (d *HostNicDriver) saveConfig() error {
 	if err != nil {
 		return err
 	}
-	log.Debug("Save config [%+v] to [%s]", d.networks, configFile)
+	logger.WithFields(log.Fields{"file": configFile}).Debug("Save config [%s]", data)
 	return nil
 }
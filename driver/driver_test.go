@@ -1,12 +1,29 @@
 package driver
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/docker/go-plugins-helpers/network"
-	"github.com/hashicorp/netlink"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+	"github.com/yunify/docker-plugin-hostnic/log"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+	"unsafe"
 )
 
 func TestLink(t *testing.T) {
@@ -21,16 +38,17 @@ func TestLink(t *testing.T) {
 }
 
 func TestConfig(t *testing.T) {
-	os.Remove(path.Join(configDir, "config.json"))
-
-	driver, err := New()
+	dir, err := ioutil.TempDir("", "hostnic-config")
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer os.RemoveAll(dir)
 
+	driver, err := New(dir)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer driver.Shutdown(time.Second)
 	ipv4data := &network.IPAMData{
 		Gateway:      "192.168.0.1/24",
 		Pool:         "192.168.0.0/24",
@@ -51,11 +69,1711 @@ func TestConfig(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	driver.saveConfig()
+	driver.saveConfig(log.WithFields(nil))
 
-	driver2, _ := New()
+	driver2, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if len(driver2.networks) != 2 {
 		t.Fatal("expect networks len is 2")
 	}
+	// shutdown waits the nic watcher exits
+	start := time.Now()
+	if err := driver2.Shutdown(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*linkReceiveTimeout+resubscribeInterval {
+		t.Errorf("expect nic watcher exits on shutdown, took %s", elapsed)
+	}
+}
+
+func TestParseIPMap(t *testing.T) {
+	ipMap, err := parseIPMap("192.168.1.5=52:54:0E:E5:00:F7, 192.168.1.6=eth2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipMap["192.168.1.5"] != "52:54:0e:e5:00:f7" {
+		t.Fatalf("expect mac 52:54:0e:e5:00:f7, got [%s]", ipMap["192.168.1.5"])
+	}
+	if ipMap["192.168.1.6"] != "eth2" {
+		t.Fatalf("expect name eth2, got [%s]", ipMap["192.168.1.6"])
+	}
+	if addressIP("192.168.1.5/24") != "192.168.1.5" {
+		t.Fatal("expect address ip is 192.168.1.5")
+	}
+
+	for _, value := range []string{"192.168.1.5", "bad=eth2", "192.168.1.5=eth2,192.168.1.5=eth3"} {
+		if _, err := parseIPMap(value); err == nil {
+			t.Fatalf("expect parse [%s] error", value)
+		}
+	}
+}
+
+func TestParseBandwidth(t *testing.T) {
+	defaults, err := parseBandwidth(map[string]string{egressRateOption: "100mbit", ingressRateOption: "1gbit"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if defaults.EgressRate != 100000000 || defaults.IngressRate != 1000000000 {
+		t.Fatalf("unexpect bandwidth [%+v]", defaults)
+	}
+
+	b, err := parseBandwidth(map[string]string{egressRateOption: "500kbit", egressBurstOption: "64k"}, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.EgressRate != 500000 || b.EgressBurst != 65536 || b.IngressRate != 1000000000 {
+		t.Fatalf("unexpect bandwidth [%+v]", b)
+	}
+
+	b, err = parseBandwidth(map[string]string{}, nil)
+	if err != nil || b != nil {
+		t.Fatalf("expect no bandwidth, got [%+v] [%v]", b, err)
+	}
+
+	for _, value := range []string{"fast", "10gbit", "-1"} {
+		if _, err := parseBandwidth(map[string]string{egressRateOption: value}, nil); err == nil {
+			t.Fatalf("expect parse [%s] error", value)
+		}
+	}
+}
+
+func TestAntiSpoofRules(t *testing.T) {
+	rules, err := antiSpoofRules("52:54:0e:e5:00:f7", []string{"192.168.1.5/24", "fd00::5/64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 4 {
+		t.Fatalf("expect 4 rules, got %d", len(rules))
+	}
+	// ip src key and 2 keys for ether src
+	if len(rules[0].keys) != 3 || rules[0].keys[0].Off != ipv4SrcOffset || rules[0].keys[1].Off != etherSrcOffset {
+		t.Fatalf("unexpect ipv4 rule [%+v]", rules[0])
+	}
+	// 4 keys for ipv6 src and 2 keys for ether src
+	if len(rules[2].keys) != 6 {
+		t.Fatalf("unexpect ipv6 rule [%+v]", rules[2])
+	}
+	// only the link local address of the nic, not fe80::/10
+	mac, _ := net.ParseMAC("52:54:0e:e5:00:f7")
+	if ip := eui64LinkLocal(mac); !ip.Equal(net.ParseIP("fe80::5054:eff:fee5:f7")) {
+		t.Fatalf("unexpect link local address [%s]", ip)
+	}
+	if len(rules[3].keys) != 6 || rules[3].keys[0].Mask != 0xffffffff {
+		t.Fatalf("unexpect ipv6 link local rule [%+v]", rules[3])
+	}
+	// one link local rule for all ipv6 addresses
+	if rules, err = antiSpoofRules("52:54:0e:e5:00:f7", []string{"fd00::5/64", "fd00::6/64"}); err != nil || len(rules) != 3 {
+		t.Fatalf("expect 3 rules, got %d, error %v", len(rules), err)
+	}
+
+	if _, err := antiSpoofRules("52:54:0e:e5:00:f7", nil); err == nil {
+		t.Fatal("expect error when endpoint has no address")
+	}
+}
+
+func TestParseVfSpoofCheck(t *testing.T) {
+	list := nl.NewRtAttr(nl.IFLA_VFINFO_LIST, nil)
+	for vf, setting := range []uint32{1, 0} {
+		info := nl.NewRtAttrChild(list, nl.IFLA_VF_INFO, nil)
+		mac := make([]byte, nl.SizeofVfMac)
+		nl.NewRtAttrChild(info, nl.IFLA_VF_MAC, mac)
+		spoofchk := nl.VfSpoofchk{Vf: uint32(vf), Setting: setting}
+		nl.NewRtAttrChild(info, nl.IFLA_VF_SPOOFCHK, spoofchk.Serialize())
+	}
+	attrs, err := nl.ParseRouteAttr(append(nl.NewRtAttr(syscall.IFLA_MTU, nl.Uint32Attr(1500)).Serialize(), list.Serialize()...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if on, err := parseVfSpoofCheck(attrs, 0); err != nil || !on {
+		t.Fatalf("expect spoof check of vf 0 on, got %v, error %v", on, err)
+	}
+	if on, err := parseVfSpoofCheck(attrs, 1); err != nil || on {
+		t.Fatalf("expect spoof check of vf 1 off, got %v, error %v", on, err)
+	}
+	if _, err := parseVfSpoofCheck(attrs, 2); err == nil {
+		t.Fatal("expect error for unknown vf")
+	}
+}
+
+func TestListNics(t *testing.T) {
+	links, err := hostLinks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := NewNicTable()
+	table.sync(links, nil)
+	nics, err := ListNics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same nics as nic table holds
+	if len(nics) != len(table.Nics()) {
+		t.Fatalf("expect %d nics of nic table, got %+v", len(table.Nics()), nics)
+	}
+	for _, nic := range nics {
+		if table.ByHardwareAddr(nic.HardwareAddr) == nil {
+			t.Fatalf("nic [%s] is not in nic table", nic.Name)
+		}
+	}
+}
+
+func TestLinkInfo(t *testing.T) {
+	if unsafe.Sizeof(ethtoolDrvInfo{}) != 196 || unsafe.Sizeof(ethtoolCmd{}) != 44 {
+		t.Fatal("unexpect size of ethtool struct")
+	}
+	// loopback has no hardware addr
+	sb, err := hostSandbox("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sb.Close()
+	value := make(map[string]string)
+	linkInfo(log.WithFields(nil), sb, value)
+	if value["link.Name"] == "" || value["link.MTU"] == "" || value["link.Carrier"] == "" || value["link.RxBytes"] == "" {
+		t.Fatalf("unexpect link info [%+v]", value)
+	}
+
+	// counters are read from IFLA_STATS64, same as sysfs
+	data, err := ioutil.ReadFile("/sys/class/net/" + sb.link.Attrs().Name + "/statistics/tx_packets")
+	if err != nil {
+		t.Skip(err)
+	}
+	before, _ := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	stats, err := sb.statistics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TxPackets < before || stats.RxBytes < stats.RxPackets {
+		t.Fatalf("unexpect statistics [%+v], tx packets in sysfs %d", stats, before)
+	}
+}
+
+func TestNicTable(t *testing.T) {
+	link := func(name string, index int, mac string) netlink.Link {
+		hwAddr, _ := net.ParseMAC(mac)
+		return &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: name, Index: index, HardwareAddr: hwAddr}}
+	}
+	table := NewNicTable()
+	table.sync([]netlink.Link{link("eth1", 10001, "52:54:0e:e5:00:01"), link("eth2", 10002, "52:54:0e:e5:00:02")}, map[int]string{10001: "10.10.0.5/16"})
+	nic := table.ByHardwareAddr("52:54:0e:e5:00:01")
+	if nic == nil || table.ByName("eth1") != nic || table.ByIndex(10001) != nic {
+		t.Fatal("expect eth1 indexed by mac, name and index")
+	}
+	// addresses are read before the lock of driver
+	if nic.Address != "10.10.0.5/16" || table.ByName("eth2").Address != "" {
+		t.Fatalf("unexpect addresses of nics [%s] [%s]", nic.Address, table.ByName("eth2").Address)
+	}
+
+	// renamed by os
+	table.update(link("eth3", 10001, "52:54:0e:e5:00:01"), "")
+	if table.ByName("eth1") != nil || table.ByName("eth3") != nic {
+		t.Fatal("expect eth1 renamed to eth3")
+	}
+
+	// bound nic is kept after it left host
+	nic.endpoint = &Endpoint{id: "ep1"}
+	removed := table.sync([]netlink.Link{link("eth2", 10002, "52:54:0e:e5:00:02")}, nil)
+	if len(removed) != 1 || removed[0] != nic || nic.Index != 0 {
+		t.Fatalf("expect eth3 removed from host, got [%+v]", removed)
+	}
+	if table.ByHardwareAddr("52:54:0e:e5:00:01") != nic || table.ByName("eth3") != nil {
+		t.Fatal("expect bound nic kept by mac only")
+	}
+	table.release(nic)
+	if table.ByHardwareAddr("52:54:0e:e5:00:01") != nil {
+		t.Fatal("expect released nic deleted")
+	}
+
+	table.remove(link("eth2", 10002, "52:54:0e:e5:00:02"))
+	if len(table.Nics()) != 0 {
+		t.Fatal("expect nic table empty")
+	}
+}
+
+// TestConcurrentEndpoints drives parallel endpoint operations, run it with -race.
+func TestConcurrentEndpoints(t *testing.T) {
+	d := &HostNicDriver{
+		networks: Networks{},
+		nics:     NewNicTable(),
+		done:     make(chan struct{}),
+	}
+	err := d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: "concurrent",
+		IPv4Data:  []*network.IPAMData{{Gateway: "10.10.0.1/16", Pool: "10.10.0.0/16"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.DeleteNetwork(&network.DeleteNetworkRequest{NetworkID: "concurrent"})
+
+	const count = 16
+	links := make([]netlink.Link, count)
+	for i := range links {
+		links[i] = &netlink.Device{LinkAttrs: netlink.LinkAttrs{
+			Name:         fmt.Sprintf("test%d", i),
+			Index:        100000 + i,
+			HardwareAddr: net.HardwareAddr{0x52, 0x54, 0x0e, 0xff, 0x00, byte(i)},
+		}}
+		d.nics.update(links[i], "")
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, count*2)
+	for i := 0; i < count; i++ {
+		wg.Add(2)
+		// link updates race with endpoint operations on the same nic
+		go func(link netlink.Link) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				d.handleLinkUpdate(netlink.LinkUpdate{Header: syscall.NlMsghdr{Type: syscall.RTM_NEWLINK}, Link: link})
+			}
+		}(links[i])
+		go func(i int) {
+			defer wg.Done()
+			mac := links[i].Attrs().HardwareAddr.String()
+			for j := 0; j < 5; j++ {
+				endpointID := fmt.Sprintf("ep-%d-%d", i, j)
+				_, err := d.CreateEndpoint(&network.CreateEndpointRequest{
+					NetworkID:  "concurrent",
+					EndpointID: endpointID,
+					Interface:  &network.EndpointInterface{Address: fmt.Sprintf("10.10.1.%d/16", i+2), MacAddress: mac},
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+				_, err = d.Join(&network.JoinRequest{NetworkID: "concurrent", EndpointID: endpointID, SandboxKey: "/var/run/docker/netns/" + endpointID})
+				if err != nil {
+					errs <- err
+					return
+				}
+				if _, err = d.EndpointInfo(&network.InfoRequest{NetworkID: "concurrent", EndpointID: endpointID}); err != nil {
+					errs <- err
+					return
+				}
+				if err = d.Leave(&network.LeaveRequest{NetworkID: "concurrent", EndpointID: endpointID}); err != nil {
+					errs <- err
+					return
+				}
+				if err = d.DeleteEndpoint(&network.DeleteEndpointRequest{NetworkID: "concurrent", EndpointID: endpointID}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// two endpoints can not bind the same nic
+	mac := links[0].Attrs().HardwareAddr.String()
+	for _, endpointID := range []string{"ep-a", "ep-b"} {
+		wg.Add(1)
+		go func(endpointID string) {
+			defer wg.Done()
+			d.CreateEndpoint(&network.CreateEndpointRequest{
+				NetworkID:  "concurrent",
+				EndpointID: endpointID,
+				Interface:  &network.EndpointInterface{Address: "10.10.1.100/16", MacAddress: mac},
+			})
+		}(endpointID)
+	}
+	wg.Wait()
+	if n := len(d.networks["concurrent"].endpoints); n != 1 {
+		t.Fatalf("expect 1 endpoint bind the nic, got %d", n)
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	d := &HostNicDriver{
+		networks: Networks{},
+		nics:     NewNicTable(),
+		done:     make(chan struct{}),
+	}
+	err := d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: "admin",
+		IPv4Data:  []*network.IPAMData{{Gateway: "10.20.0.1/16", Pool: "10.20.0.0/16"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.DeleteNetwork(&network.DeleteNetworkRequest{NetworkID: "admin"})
+	mac := "52:54:0e:ff:01:00"
+	hw, _ := net.ParseMAC(mac)
+	d.nics.update(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "admin0", Index: 100100, HardwareAddr: hw}}, "")
+	_, err = d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  "admin",
+		EndpointID: "ep-admin",
+		Interface:  &network.EndpointInterface{Address: "10.20.0.2/16", MacAddress: mac},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(NewAdminHandler(d, "test"))
+	defer server.Close()
+	get := func(url string, v interface{}) int {
+		resp, err := http.Get(server.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+	post := func(url string) int {
+		resp, err := http.Post(server.URL+url, "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	version := VersionStatus{}
+	get("/version", &version)
+	if version.Version != "test" || version.ConfigFile != d.configFilePath() {
+		t.Errorf("unexpected version %+v", version)
+	}
+	var nics []NicStatus
+	get("/nics", &nics)
+	if len(nics) != 1 || nics[0].Endpoint != "ep-admin" || nics[0].Network != "admin" {
+		t.Errorf("unexpected nics %+v", nics)
+	}
+	var endpoints []EndpointStatus
+	get("/endpoints", &endpoints)
+	if len(endpoints) != 1 || endpoints[0].HardwareAddr != mac || endpoints[0].SrcName != "admin0" {
+		t.Errorf("unexpected endpoints %+v", endpoints)
+	}
+
+	if code := get("/nics/release?nic=admin0", &struct{}{}); code != http.StatusMethodNotAllowed {
+		t.Errorf("get release expect %d, got %d", http.StatusMethodNotAllowed, code)
+	}
+	if code := post("/nics/release?nic=admin0"); code != http.StatusOK {
+		t.Errorf("release expect %d, got %d", http.StatusOK, code)
+	}
+	if code := post("/nics/release?nic=admin0"); code != http.StatusBadRequest {
+		t.Errorf("release unbound nic expect %d, got %d", http.StatusBadRequest, code)
+	}
+	var networks []NetworkStatus
+	get("/networks", &networks)
+	if len(networks) != 1 || len(networks[0].Endpoints) != 0 {
+		t.Errorf("unexpected networks %+v", networks)
+	}
+	if nic := d.nics.ByName("admin0"); nic == nil || nic.endpoint != nil {
+		t.Errorf("nic is not released %+v", nic)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	// counters are global, reset them so the test can run repeatedly.
+	requestsTotal.values = make(map[string]*counterValue)
+	errorsTotal.values = make(map[string]*counterValue)
+	requestDuration.values = make(map[string]*histogramValue)
+	d := NewMetricsDriver(&HostNicDriver{
+		networks: Networks{},
+		nics:     NewNicTable(),
+		done:     make(chan struct{}),
+	})
+	err := d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: "metrics",
+		IPv4Data:  []*network.IPAMData{{Gateway: "10.30.0.1/16", Pool: "10.30.0.0/16"}},
+		Options:   map[string]interface{}{genericOptionKey: map[string]interface{}{ipMapOption: "10.30.0.2=metrics0,10.30.0.3=metrics1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.DeleteNetwork(&network.DeleteNetworkRequest{NetworkID: "metrics"})
+	if err := d.CreateNetwork(&network.CreateNetworkRequest{NetworkID: "metrics-error"}); err == nil {
+		t.Fatal("expect error of network without gateway")
+	}
+	for i := 0; i < 2; i++ {
+		d.nics.update(&netlink.Device{LinkAttrs: netlink.LinkAttrs{
+			Name:         fmt.Sprintf("metrics%d", i),
+			Index:        100200 + i,
+			HardwareAddr: net.HardwareAddr{0x52, 0x54, 0x0e, 0xff, 0x02, byte(i)},
+		}}, "")
+	}
+	_, err = d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  "metrics",
+		EndpointID: "ep-metrics",
+		Interface:  &network.EndpointInterface{Address: "10.30.0.2/16"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(NewMetricsHandler(d.HostNicDriver))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`hostnic_requests_total{method="CreateNetwork",outcome="success"} 1`,
+		`hostnic_requests_total{method="CreateNetwork",outcome="error"} 1`,
+		`hostnic_request_duration_seconds_bucket{method="CreateEndpoint",outcome="success",le="+Inf"} 1`,
+		`hostnic_request_duration_seconds_count{method="CreateEndpoint",outcome="success"} 1`,
+		`hostnic_networks 1`,
+		`hostnic_endpoints{network="metrics"} 1`,
+		`hostnic_network_nics{network="metrics",state="free"} 1`,
+		`hostnic_network_nics{network="metrics",state="bound"} 1`,
+		`# TYPE hostnic_endpoint_receive_bytes_total counter`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("metrics miss line [%s]:\n%s", line, body)
+		}
+	}
+
+	// scrape is not blocked by the nic in sandbox setup
+	nic := d.nics.ByName("metrics0")
+	nic.lock.Lock()
+	defer nic.lock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		d.writeMetrics(ioutil.Discard)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect scrape does not wait the lock of nic")
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	level := "info"
+	if log.IsDebugEnable() {
+		level = "debug"
+	}
+	log.SetLevel("debug")
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	log.SetFormat("json")
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFormat("text")
+		log.SetLevel(level)
+	}()
+
+	d := &HostNicDriver{networks: Networks{}, nics: NewNicTable()}
+	if err := d.Leave(&network.LeaveRequest{NetworkID: "not-exist", EndpointID: "ep-log"}); err == nil {
+		t.Fatal("expect error of endpoint not exist")
+	}
+	var entries []map[string]interface{}
+	decoder := json.NewDecoder(buf)
+	for decoder.More() {
+		entry := map[string]interface{}{}
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expect called and failed entries, got %+v", entries)
+	}
+	for _, entry := range entries {
+		if entry["request_id"] == nil || entry["request_id"] != entries[0]["request_id"] {
+			t.Errorf("request id not follow entry %+v", entry)
+		}
+		if entry["method"] != "Leave" || entry["network_id"] != "not-exist" || entry["endpoint_id"] != "ep-log" || entry["subsystem"] != log.Driver {
+			t.Errorf("unexpected fields of entry %+v", entry)
+		}
+	}
+	failed := entries[1]
+	if failed["level"] != "error" || failed["error"] == nil || failed["duration"] == nil {
+		t.Errorf("unexpected failed entry %+v", failed)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostnic-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := &HostNicDriver{
+		networks: Networks{},
+		nics:     NewNicTable(),
+		done:     make(chan struct{}),
+	}
+	d.nics.emit = d.emit
+	if err := d.SetAuditFile(path.Join(dir, "audit.log"), 1<<20, 1); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewAdminHandler(d, "test"))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	err = d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: "events",
+		IPv4Data:  []*network.IPAMData{{Gateway: "10.40.0.1/16", Pool: "10.40.0.0/16"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := "52:54:0e:ff:04:00"
+	hw, _ := net.ParseMAC(mac)
+	d.nics.update(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "events0", Index: 100400, HardwareAddr: hw}}, "")
+	_, err = d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  "events",
+		EndpointID: "ep-events",
+		Interface:  &network.EndpointInterface{Address: "10.40.0.2/16", MacAddress: mac},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteEndpoint(&network.DeleteEndpointRequest{NetworkID: "events", EndpointID: "ep-events"}); err != nil {
+		t.Fatal(err)
+	}
+	d.DeleteNetwork(&network.DeleteNetworkRequest{NetworkID: "events"})
+
+	expect := []EventType{NetworkCreated, NicAppeared, EndpointCreated, EndpointDeleted, NetworkDeleted}
+	decoder := json.NewDecoder(resp.Body)
+	for _, eventType := range expect {
+		e := Event{}
+		if err := decoder.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Type != eventType {
+			t.Fatalf("expect event %s, got %+v", eventType, e)
+		}
+		if e.Type == EndpointCreated && (e.Endpoint != "ep-events" || e.HardwareAddr != mac || e.Nic != "events0") {
+			t.Errorf("unexpected event %+v", e)
+		}
+	}
+	// the audit file is written by its writer, wait it is flushed
+	d.events.closeAudit()
+	data, err := ioutil.ReadFile(path.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != len(expect) {
+		t.Errorf("expect %d events in audit file, got %s", len(expect), data)
+	}
+}
+
+// blockingAudit is an audit file whose writes wait until it is released.
+type blockingAudit struct {
+	release chan struct{}
+	lock    sync.Mutex
+	lines   int
+	closed  bool
+}
+
+func (a *blockingAudit) Write(b []byte) (int, error) {
+	<-a.release
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.lines++
+	return len(b), nil
+}
+
+func (a *blockingAudit) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.closed = true
+	return nil
+}
+
+func TestAuditWriteUnlocked(t *testing.T) {
+	bus := &eventBus{}
+	audit := &blockingAudit{release: make(chan struct{})}
+	bus.openAudit(audit)
+	ch := bus.subscribe()
+	// publish does not wait the audit file
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			bus.publish(Event{Type: NicAppeared})
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("publish is blocked by audit file")
+	}
+	if len(ch) != 3 {
+		t.Fatalf("expect 3 events delivered, got %d", len(ch))
+	}
+	close(audit.release)
+	bus.closeAudit()
+	audit.lock.Lock()
+	defer audit.lock.Unlock()
+	if audit.lines != 3 || !audit.closed {
+		t.Fatalf("expect 3 events written and audit file closed, got %d lines, closed %v", audit.lines, audit.closed)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	d := &HostNicDriver{networks: Networks{}, nics: NewNicTable(), done: make(chan struct{})}
+	_, finish := d.startRequest("Join", log.Fields{"network_id": "shutdown"})
+	if err := d.Shutdown(100 * time.Millisecond); err == nil {
+		t.Fatal("expect shutdown timeout with request in flight")
+	}
+	var err error
+	finish(&err)
+	if err := d.Shutdown(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-d.done:
+	default:
+		t.Error("expect done closed after shutdown")
+	}
+	if err := d.Shutdown(time.Second); err != nil {
+		t.Errorf("expect shutdown twice ok: %s", err)
+	}
+}
+
+func TestAlive(t *testing.T) {
+	d := &HostNicDriver{networks: Networks{}, nics: NewNicTable()}
+	if !d.Alive(time.Second) {
+		t.Fatal("expect driver alive")
+	}
+	d.lock.RLock()
+	if d.Alive(100 * time.Millisecond) {
+		t.Error("expect driver not alive when the lock is held")
+	}
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 5; i++ {
+		if d.Alive(10 * time.Millisecond) {
+			t.Error("expect driver not alive when the lock is held")
+		}
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("expect pending probe reused, goroutines %d -> %d", goroutines, n)
+	}
+	d.lock.RUnlock()
+	if !d.Alive(time.Second) {
+		t.Fatal("expect driver alive after the lock is released")
+	}
+}
+
+func TestProtectedNics(t *testing.T) {
+	d := &HostNicDriver{networks: Networks{}, nics: NewNicTable(), done: make(chan struct{})}
+	err := d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: "protected",
+		IPv4Data:  []*network.IPAMData{{Gateway: "10.42.0.1/16", Pool: "10.42.0.0/16"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	macs := []string{"52:54:0e:ff:04:20", "52:54:0e:ff:04:21"}
+	for i, mac := range macs {
+		hw, _ := net.ParseMAC(mac)
+		d.nics.update(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: fmt.Sprintf("protected%d", i), Index: 100420 + i, HardwareAddr: hw}}, "")
+	}
+	d.SetProtectedNics([]string{"protected0", "52:54:0E:FF:04:21"})
+	for i, mac := range macs {
+		_, err := d.CreateEndpoint(&network.CreateEndpointRequest{
+			NetworkID:  "protected",
+			EndpointID: fmt.Sprintf("ep-protected%d", i),
+			Interface:  &network.EndpointInterface{Address: fmt.Sprintf("10.42.0.%d/16", i+2), MacAddress: mac},
+		})
+		if err == nil || !strings.Contains(err.Error(), "protected") {
+			t.Errorf("expect protected error of nic %s, got %v", mac, err)
+		}
+	}
+	for _, nic := range d.Nics() {
+		if !nic.Protected {
+			t.Errorf("expect nic protected %+v", nic)
+		}
+	}
+	d.SetProtectedNics(nil)
+	_, err = d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  "protected",
+		EndpointID: "ep-protected0",
+		Interface:  &network.EndpointInterface{Address: "10.42.0.2/16", MacAddress: macs[0]},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the nic moved into sandbox is listed with its sandbox
+	nic := d.nics.ByHardwareAddr(macs[0])
+	nic.lock.Lock()
+	nic.endpoint.setSandboxKey("/var/run/docker/netns/protected")
+	nic.lock.Unlock()
+	d.nics.remove(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Index: nic.Index}})
+	for _, status := range d.Nics() {
+		if status.HardwareAddr == macs[0] && (status.Index != 0 || status.Endpoint != "ep-protected0" || status.Sandbox != "/var/run/docker/netns/protected") {
+			t.Errorf("unexpect status of nic in sandbox %+v", status)
+		}
+	}
+}
+
+func TestSriovFunctions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostnic-sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(origin string) { sysClassNet = origin }(sysClassNet)
+	sysClassNet = path.Join(dir, "class/net")
+	devices := path.Join(dir, "devices")
+	for name, pci := range map[string]string{"pf0": "0000:03:00.0", "vf0": "0000:03:10.0", "vf1": "0000:03:10.2"} {
+		os.MkdirAll(path.Join(devices, pci, "net", name), 0755)
+		os.MkdirAll(path.Join(sysClassNet, name), 0755)
+		os.Symlink(path.Join(devices, pci), path.Join(sysClassNet, name, "device"))
+	}
+	os.MkdirAll(path.Join(devices, "0000:03:10.4"), 0755)
+	ioutil.WriteFile(path.Join(devices, "0000:03:00.0", "numa_node"), []byte("1\n"), 0644)
+	for i, pci := range []string{"0000:03:10.0", "0000:03:10.2", "0000:03:10.4"} {
+		os.Symlink(path.Join(devices, pci), path.Join(devices, "0000:03:00.0", fmt.Sprintf("virtfn%d", i)))
+		os.Symlink(path.Join(devices, "0000:03:00.0"), path.Join(devices, pci, "physfn"))
+	}
+
+	pf, vfs := sriovFunctions("pf0")
+	if pf != "" || strings.Join(vfs, ",") != "vf0,vf1,0000:03:10.4" {
+		t.Errorf("unexpected functions of pf %q %v", pf, vfs)
+	}
+	pf, vfs = sriovFunctions("vf1")
+	if pf != "pf0" || len(vfs) != 0 {
+		t.Errorf("unexpected functions of vf %q %v", pf, vfs)
+	}
+	if node := numaNode("pf0"); node != 1 {
+		t.Errorf("expect numa node 1, got %d", node)
+	}
+	if node := numaNode("vf0"); node != -1 {
+		t.Errorf("expect unknown numa node, got %d", node)
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostnic-doctor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	networks := Networks{
+		"a": {ID: "a", IPv4Data: &network.IPAMData{Gateway: "10.50.0.1/16", Pool: "10.50.0.0/16"}},
+		"b": {ID: "b", IPv4Data: &network.IPAMData{Gateway: "10.50.0.1/16", Pool: "10.50.0.0/16"}},
+		"c": {ID: "c", IPv4Data: &network.IPAMData{Gateway: "10.50.1.1/24", Pool: "10.50.1.0/24"}},
+		"d": {ID: "d", IPv4Data: &network.IPAMData{Gateway: "10.60.0.1/24", Pool: "10.60.0.0/24"}},
+	}
+	data, _ := json.Marshal(networks)
+	ioutil.WriteFile(path.Join(dir, "config.json"), data, 0644)
+	socket := path.Join(dir, "hostnic.sock")
+	// the socket file is left after the socket is closed without unlink.
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrUnix{Name: socket}); err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(fd)
+
+	findings := Diagnose(DoctorOptions{
+		ConfigDir:    dir,
+		PluginSocket: socket,
+		Networks: []NetworkStatus{{ID: "a", Endpoints: []EndpointStatus{
+			{ID: "ep-missing", Network: "a", HardwareAddr: "52:54:0e:ff:05:00"},
+			{ID: "ep-sandbox", Network: "a", HardwareAddr: "52:54:0e:ff:05:01", SandboxKey: "/var/run/docker/netns/x"},
+		}}},
+	})
+	checkName := regexp.MustCompile(`^[a-z]+(_[a-z]+)*$`)
+	count := make(map[string]int)
+	for _, finding := range findings {
+		if finding.Severity != SeverityOK && finding.Severity != SeverityInfo && finding.Fix == "" {
+			t.Errorf("expect fix of finding %+v", finding)
+		}
+		if !checkName.MatchString(finding.Check) {
+			t.Errorf("expect snake case check name, got [%s]", finding.Check)
+		}
+		count[finding.Check+"/"+string(finding.Severity)]++
+	}
+	for key, expect := range map[string]int{
+		"plugin_socket/error": 1,
+		"config/ok":           1,
+		"gateway/error":       1, // a and b
+		"gateway/warning":     2, // a and c, b and c
+		"bound_nics/error":    1,
+	} {
+		if count[key] != expect {
+			t.Errorf("expect %d findings of %s, got %+v", expect, key, findings)
+		}
+	}
+
+	ioutil.WriteFile(path.Join(dir, "config.json"), []byte("{"), 0644)
+	if _, finding := checkConfig(dir); finding.Severity != SeverityError {
+		t.Errorf("expect error of invalid config, got %+v", finding)
+	}
+}
+
+func TestGC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostnic-gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := &HostNicDriver{networks: Networks{}, nics: NewNicTable(), done: make(chan struct{})}
+	err = d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: "gc",
+		IPv4Data:  []*network.IPAMData{{Gateway: "10.44.0.1/16", Pool: "10.44.0.0/16"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a link renamed by kernel after its sandbox died, it is renamed back to the name before join.
+	ifb := &netlink.Ifb{LinkAttrs: netlink.LinkAttrs{Name: "hnicgc1"}}
+	if err := netlink.LinkAdd(ifb); err != nil {
+		t.Skipf("Add ifb link error: %s", err.Error())
+	}
+	defer func() {
+		if link, err := netlink.LinkByName("hnicgc0"); err == nil {
+			netlink.LinkDel(link)
+		}
+		netlink.LinkDel(ifb)
+	}()
+	link, err := netlink.LinkByName("hnicgc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := link.Attrs().HardwareAddr.String()
+	d.nics.update(link, "")
+	_, err = d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  "gc",
+		EndpointID: "ep-dead",
+		Interface:  &network.EndpointInterface{Address: "10.44.0.2/16", MacAddress: mac},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, endpoint, _ := d.getEndpoint("gc", "ep-dead")
+	endpoint.srcName = "hnicgc0"
+	endpoint.sandboxKey = path.Join(dir, "dead")
+
+	// a nic bound to an endpoint not registered in network.
+	staleHw, _ := net.ParseMAC("52:54:0e:ff:04:41")
+	stale := d.nics.update(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "hnicgc2", Index: 100441, HardwareAddr: staleHw}}, "")
+	stale.endpoint = &Endpoint{id: "ep-stale", networkID: "gc", hostNic: stale, srcName: "hnicgc2", updated: time.Now()}
+
+	expect := []string{"ep-dead/" + gcRename, "ep-dead/" + gcRelease, "ep-stale/" + gcRelease}
+	check := func(actions []GCAction) {
+		var got []string
+		for _, action := range actions {
+			if action.Error != "" {
+				t.Errorf("unexpected error of action %+v", action)
+			}
+			got = append(got, action.Endpoint+"/"+action.Action)
+		}
+		if strings.Join(got, ",") != strings.Join(expect, ",") {
+			t.Errorf("expect actions %v, got %+v", expect, actions)
+		}
+	}
+	gc := func(dryRun bool) []GCAction {
+		actions, err := d.GC(dryRun, map[string]bool{"ep-known": true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return actions
+	}
+	// endpoints just created or joined are left alone, the container may be starting.
+	if actions := gc(true); len(actions) != 0 {
+		t.Errorf("expect endpoints in grace period left alone, got %+v", actions)
+	}
+	defer func(origin time.Duration) { gcGracePeriod = origin }(gcGracePeriod)
+	gcGracePeriod = 0
+
+	// a nic bound to an endpoint docker knows is never collected.
+	knownHw, _ := net.ParseMAC("52:54:0e:ff:04:42")
+	known := d.nics.update(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "hnicgc3", Index: 100442, HardwareAddr: knownHw}}, "")
+	known.endpoint = &Endpoint{id: "ep-known", networkID: "gc", hostNic: known, srcName: "hnicgc3", sandboxKey: path.Join(dir, "starting")}
+
+	if _, err := d.GC(true, nil); err == nil {
+		t.Error("expect gc refused without endpoints of docker")
+	}
+	check(gc(true))
+	if stale.endpoint == nil || endpoint.hostNic.endpoint == nil {
+		t.Fatal("expect nothing changed by dry run")
+	}
+	check(gc(false))
+	if stale.endpoint != nil || endpoint.hostNic.endpoint != nil {
+		t.Error("expect bindings cleared")
+	}
+	if known.endpoint == nil {
+		t.Error("expect binding of endpoint docker knows kept")
+	}
+	if _, err := netlink.LinkByName("hnicgc0"); err != nil {
+		t.Errorf("expect link renamed back: %s", err)
+	}
+	if len(d.Networks()[0].Endpoints) != 0 {
+		t.Errorf("expect endpoint deleted")
+	}
+	if actions := gc(false); len(actions) != 0 {
+		t.Errorf("expect nothing to collect, got %+v", actions)
+	}
+
+	// containers are not visible in the pid namespace of a container, gc refuses to run.
+	defer func(origin string) { procStatus = origin }(procStatus)
+	procStatus = path.Join(dir, "status")
+	if err := ioutil.WriteFile(procStatus, []byte("Name:\thostnic\nNSpid:\t4213\t1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GC(true, map[string]bool{}); err == nil {
+		t.Error("expect gc refused out of the pid namespace of host")
+	}
+}
+
+func TestState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostnic-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	networks := Networks{
+		"n1": &Network{
+			ID:        "n1",
+			IPv4Data:  &network.IPAMData{AddressSpace: "LocalDefault", Pool: "192.168.1.0/24", Gateway: "192.168.1.1/24"},
+			IPMap:     map[string]string{"192.168.1.10": "52:54:00:00:00:01"},
+			Bandwidth: &Bandwidth{EgressRate: 1000},
+			AntiSpoof: true,
+		},
+	}
+	if err := WriteConfigFile(dir, networks); err != nil {
+		t.Fatal(err)
+	}
+	networks, err = ReadConfigFile(dir)
+	if err != nil || len(networks) != 1 {
+		t.Fatalf("expect 1 network in config, got %v, %v", networks, err)
+	}
+
+	oldNics := []NicInfo{
+		{Name: "eth1", HardwareAddr: "52:54:00:00:00:01", BusInfo: "0000:00:05.0"},
+		{Name: "eth2", HardwareAddr: "52:54:00:00:00:02", BusInfo: "0000:00:06.0"},
+	}
+	statuses := []NetworkStatus{{ID: "n1", Endpoints: []EndpointStatus{
+		{ID: "e1", HardwareAddr: "52:54:00:00:00:02", Addresses: []string{"192.168.1.20/24"}},
+	}}}
+	state := ExportState(networks, statuses, oldNics, map[string]string{"n1": "web"})
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := &State{}
+	if err := json.Unmarshal(data, imported); err != nil {
+		t.Fatal(err)
+	}
+
+	// nics on the new host have the same pci addresses but different macs.
+	newNics := []NicInfo{
+		{Name: "eth1", HardwareAddr: "52:54:00:00:01:01", BusInfo: "0000:00:05.0"},
+		{Name: "eth2", HardwareAddr: "52:54:00:00:01:02", BusInfo: "0000:00:06.0"},
+	}
+	resolved, findings := imported.Resolve(newNics)
+	nw := resolved["n1"]
+	if nw == nil {
+		t.Fatalf("expect network n1 resolved, findings %v", findings)
+	}
+	if nw.IPMap["192.168.1.10"] != "52:54:00:00:01:01" || nw.IPMap["192.168.1.20"] != "52:54:00:00:01:02" {
+		t.Fatalf("expect ips reserved for nics by pci address, got %v", nw.IPMap)
+	}
+	if nw.Bandwidth == nil || nw.Bandwidth.EgressRate != 1000 || !nw.AntiSpoof || !nw.Imported || nw.Name != "web" {
+		t.Fatalf("expect options imported, got %+v", nw)
+	}
+
+	_, findings = imported.Resolve(newNics[:1])
+	if len(findings) == 0 || findings[0].Severity != SeverityWarning {
+		t.Fatalf("expect warning of missing nic, got %v", findings)
+	}
+
+	existing := Networks{"n2": &Network{ID: "n2", IPv4Data: &network.IPAMData{Pool: "192.168.1.0/24", Gateway: "192.168.1.1/24"}}}
+	merged, findings := MergeNetworks(existing, resolved, false)
+	if len(merged) != 1 || merged["n2"] == nil || len(findings) != 1 || findings[0].Severity != SeverityError {
+		t.Fatalf("expect network of same gateway conflict, got %v, %v", merged, findings)
+	}
+	merged, findings = MergeNetworks(existing, resolved, true)
+	if len(merged) != 1 || merged["n1"] == nil || len(findings) != 0 {
+		t.Fatalf("expect existing networks replaced, got %v, %v", merged, findings)
+	}
+
+	commands := NetworkCreateCommands(imported, resolved, "hostnic")
+	expect := "docker network create -d hostnic --subnet=192.168.1.0/24 --gateway=192.168.1.1 " +
+		"-o ipmap=192.168.1.10=52:54:00:00:01:01,192.168.1.20=52:54:00:00:01:02 -o egress_rate=1000 -o antispoof=true web"
+	if len(commands) != 1 || commands[0] != expect {
+		t.Fatalf("expect command %q, got %v", expect, commands)
+	}
+
+	// the plugin on the new host loads the imported network, docker network create of same gateway adopts it by a new id.
+	newDir := path.Join(dir, "new")
+	if err := WriteConfigFile(newDir, resolved); err != nil {
+		t.Fatal(err)
+	}
+	d := &HostNicDriver{configDir: newDir, networks: Networks{}, nics: NewNicTable(), done: make(chan struct{})}
+	if err := d.loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	err = d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: "new-n1",
+		IPv4Data:  []*network.IPAMData{{AddressSpace: "LocalDefault", Pool: "192.168.1.0/24", Gateway: "192.168.1.1/24"}},
+		Options:   map[string]interface{}{genericOptionKey: map[string]interface{}{"antispoof": "true"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses = d.Networks()
+	if len(statuses) != 1 || statuses[0].ID != "new-n1" || statuses[0].Imported {
+		t.Fatalf("expect imported network adopted by new id, got %+v", statuses)
+	}
+	if statuses[0].IPMap["192.168.1.10"] != "52:54:00:00:01:01" || statuses[0].IPMap["192.168.1.20"] != "52:54:00:00:01:02" {
+		t.Fatalf("expect reservations adopted, got %v", statuses[0].IPMap)
+	}
+	saved, err := ReadConfigFile(newDir)
+	if err != nil || len(saved) != 1 || saved["new-n1"] == nil {
+		t.Fatalf("expect adopted network saved, got %v, %v", saved, err)
+	}
+	// the ip assigned on the old host is bound to the same nic on the new host.
+	mac, _ := net.ParseMAC("52:54:00:00:01:02")
+	d.nics.update(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth2", Index: 100602, HardwareAddr: mac}}, "")
+	resp, err := d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  "new-n1",
+		EndpointID: "e1",
+		Interface:  &network.EndpointInterface{Address: "192.168.1.20/24"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Interface.MacAddress != mac.String() {
+		t.Fatalf("expect endpoint bound to the reserved nic, got %+v", resp.Interface)
+	}
+	// only imported networks are adopted
+	err = d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: "new-n2",
+		IPv4Data:  []*network.IPAMData{{Pool: "192.168.1.0/24", Gateway: "192.168.1.1/24"}},
+	})
+	if err == nil {
+		t.Fatal("expect network of same gateway conflict")
+	}
+}
+
+func TestHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostnic-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hooks := map[string]string{
+		// payloads of hooks are appended to the log, one per line.
+		PreCreateEndpoint + ".10-log": "#!/bin/sh\ncat >> payloads.log; echo >> payloads.log\n",
+		PostJoin:                      "#!/bin/sh\ncat >> payloads.log; echo >> payloads.log\n",
+		PreLeave:                      "#!/bin/sh\necho \"deny $HOSTNIC_NIC\"; exit 1\n",
+		PreDeleteEndpoint:             "#!/bin/sh\nsleep 10\n",
+		PostDeleteEndpoint:            "#!/bin/sh\nexit 1\n",
+		PreJoin + ".disabled":         "not executable",
+	}
+	for name, script := range hooks {
+		mode := os.FileMode(0755)
+		if strings.HasSuffix(name, ".disabled") {
+			mode = 0644
+		}
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(script), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := &HostNicDriver{
+		networks: Networks{},
+		nics:     NewNicTable(),
+		done:     make(chan struct{}),
+	}
+	if err := d.SetHooks(dir, 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	err = d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: "hooks",
+		IPv4Data:  []*network.IPAMData{{Gateway: "10.11.0.1/16", Pool: "10.11.0.0/16"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.nics.update(&netlink.Device{LinkAttrs: netlink.LinkAttrs{
+		Name:         "hooktest",
+		Index:        100100,
+		HardwareAddr: net.HardwareAddr{0x52, 0x54, 0x0e, 0xff, 0x01, 0x01},
+	}}, "")
+	_, err = d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  "hooks",
+		EndpointID: "ep",
+		Interface:  &network.EndpointInterface{Address: "10.11.0.2/16", MacAddress: "52:54:0e:ff:01:01"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Join(&network.JoinRequest{NetworkID: "hooks", EndpointID: "ep", SandboxKey: "/var/run/docker/netns/ep"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, "payloads.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expect payloads of pre-create-endpoint and post-join, got %q", data)
+	}
+	var payload HookPayload
+	if err := json.Unmarshal([]byte(lines[1]), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Hook != PostJoin || payload.Network.Gateway != "10.11.0.1/16" || payload.Endpoint.ID != "ep" ||
+		payload.Nic.Name != "hooktest" || payload.Nic.HardwareAddr != "52:54:0e:ff:01:01" || payload.Sandbox != "/var/run/docker/netns/ep" {
+		t.Fatalf("unexpected payload %+v", payload)
+	}
+
+	// failing pre hook fails the request
+	err = d.Leave(&network.LeaveRequest{NetworkID: "hooks", EndpointID: "ep"})
+	if err == nil || !strings.Contains(err.Error(), "deny hooktest") {
+		t.Fatalf("expect pre-leave error with hook output, got %v", err)
+	}
+	if _, endpoint, _ := d.getEndpoint("hooks", "ep"); endpoint.sandboxKey == "" {
+		t.Fatal("expect endpoint still in sandbox")
+	}
+
+	// slow pre hook is killed
+	start := time.Now()
+	err = d.DeleteEndpoint(&network.DeleteEndpointRequest{NetworkID: "hooks", EndpointID: "ep"})
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("expect pre-delete-endpoint timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expect hook killed on timeout, took %s", elapsed)
+	}
+
+	// failing post hook does not fail the request
+	os.Remove(path.Join(dir, PreDeleteEndpoint))
+	if err := d.DeleteEndpoint(&network.DeleteEndpointRequest{NetworkID: "hooks", EndpointID: "ep"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeProvider attach nics by link updates of devices, the devices are not on host.
+type fakeProvider struct {
+	d       *HostNicDriver
+	attach  bool
+	delay   time.Duration // the time CreateNic takes
+	lock    sync.Mutex
+	created []string
+	deleted []string
+}
+
+func (p *fakeProvider) CreateNic(vxnet string, ip string, name string) (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	i := len(p.created)
+	mac := net.HardwareAddr{0x52, 0x54, 0x0e, 0xfe, 0x00, byte(i)}
+	p.created = append(p.created, mac.String())
+	if p.attach {
+		link := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: fmt.Sprintf("prov%d", i), Index: 100200 + i, HardwareAddr: mac}}
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			p.d.handleLinkUpdate(netlink.LinkUpdate{Header: syscall.NlMsghdr{Type: syscall.RTM_NEWLINK}, Link: link})
+		}()
+	}
+	time.Sleep(p.delay)
+	return strings.ToUpper(mac.String()), nil
+}
+
+func (p *fakeProvider) DeleteNic(hardwareAddr string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.deleted = append(p.deleted, hardwareAddr)
+	return nil
+}
+
+func TestNicProvider(t *testing.T) {
+	d := &HostNicDriver{
+		networks: Networks{},
+		nics:     NewNicTable(),
+		done:     make(chan struct{}),
+	}
+	d.nics.emit = d.emit
+	provider := &fakeProvider{d: d, attach: true}
+	d.SetNicProvider(provider, 200*time.Millisecond)
+	err := d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: "vxnet",
+		IPv4Data:  []*network.IPAMData{{Gateway: "10.12.0.1/16", Pool: "10.12.0.0/16"}},
+		Options:   map[string]interface{}{genericOptionKey: map[string]interface{}{vxnetOption: "vxnet-test"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  "vxnet",
+		EndpointID: "ep1",
+		Interface:  &network.EndpointInterface{Address: "10.12.0.2/16"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Interface.MacAddress != provider.created[0] {
+		t.Fatalf("expect provisioned nic [%s] bound, got %+v", provider.created[0], resp.Interface)
+	}
+	if status := d.Networks()[0].Endpoints[0]; !status.Provisioned {
+		t.Fatalf("expect endpoint provisioned, got %+v", status)
+	}
+	if err := d.DeleteEndpoint(&network.DeleteEndpointRequest{NetworkID: "vxnet", EndpointID: "ep1"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(provider.deleted) != 1 || provider.deleted[0] != provider.created[0] {
+		t.Fatalf("expect provisioned nic deleted with endpoint, got %v", provider.deleted)
+	}
+
+	// the nic is deleted if it does not appear on host
+	provider.attach = false
+	_, err = d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  "vxnet",
+		EndpointID: "ep2",
+		Interface:  &network.EndpointInterface{Address: "10.12.0.3/16"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "does not appear") {
+		t.Fatalf("expect provision timeout, got %v", err)
+	}
+	if len(provider.deleted) != 2 || provider.deleted[1] != provider.created[1] {
+		t.Fatalf("expect nic not on host deleted, got %v", provider.deleted)
+	}
+
+	// the timeout counts from the request, a nic attached after it is deleted, docker may have failed the request
+	provider.attach, provider.delay = true, 300*time.Millisecond
+	_, err = d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  "vxnet",
+		EndpointID: "ep3",
+		Interface:  &network.EndpointInterface{Address: "10.12.0.4/16"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "does not appear") {
+		t.Fatalf("expect provision timeout, got %v", err)
+	}
+	if len(provider.deleted) != 3 || provider.deleted[2] != provider.created[2] {
+		t.Fatalf("expect nic attached after timeout deleted, got %v", provider.deleted)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	var lock sync.Mutex
+	metadata := `{"Nics": [
+		{"HardwareAddr": "52:54:0E:FD:00:01", "Subnet": "vxnet-a", "CIDR": "10.13.0.0/16", "PrivateIP": "10.13.0.5", "Gateway": "10.13.0.1"},
+		{"HardwareAddr": "52:54:0e:fd:00:02", "Subnet": "vxnet-a", "CIDR": "10.13.0.0/16", "PrivateIP": "10.13.0.6", "Gateway": "10.13.0.1"},
+		{"HardwareAddr": "52:54:0e:fd:00:03", "Subnet": "vxnet-b", "CIDR": "10.14.0.0/16", "PrivateIP": "10.14.0.5"}
+	]}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		w.Write([]byte(metadata))
+	}))
+	defer server.Close()
+
+	d := &HostNicDriver{
+		networks: Networks{},
+		nics:     NewNicTable(),
+		done:     make(chan struct{}),
+	}
+	defer close(d.done)
+	for i := 1; i <= 3; i++ {
+		d.nics.update(&netlink.Device{LinkAttrs: netlink.LinkAttrs{
+			Name:         fmt.Sprintf("meta%d", i),
+			Index:        100300 + i,
+			HardwareAddr: net.HardwareAddr{0x52, 0x54, 0x0e, 0xfd, 0x00, byte(i)},
+		}}, "")
+	}
+	if err := d.SetMetadata(server.URL, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if cloud := d.FindNicByName("meta1").Cloud; cloud == nil || cloud.Subnet != "vxnet-a" || cloud.PrivateIP != "10.13.0.5" {
+		t.Fatalf("expect nic labeled by metadata, got %+v", cloud)
+	}
+	err := d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: "meta",
+		IPv4Data:  []*network.IPAMData{{Gateway: "10.13.0.1/16", Pool: "10.13.0.0/16"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the address assigned by docker ipam is not a private ip, the error tells the private ips of free nics
+	_, err = d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  "meta",
+		EndpointID: "ep0",
+		Interface:  &network.EndpointInterface{Address: "10.13.0.2/16"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "[10.13.0.5, 10.13.0.6]") {
+		t.Fatalf("expect error with private ips of free nics, got %v", err)
+	}
+	// nic is matched by the private ip
+	resp, err := d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  "meta",
+		EndpointID: "ep1",
+		Interface:  &network.EndpointInterface{Address: "10.13.0.6/16"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Interface.MacAddress != "52:54:0e:fd:00:02" {
+		t.Fatalf("expect nic of private ip bound, got %+v", resp.Interface)
+	}
+	// nic and address are matched by the subnet
+	resp, err = d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  "meta",
+		EndpointID: "ep2",
+		Interface:  &network.EndpointInterface{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Interface.MacAddress != "52:54:0e:fd:00:01" || resp.Interface.Address != "10.13.0.5/16" {
+		t.Fatalf("expect free nic of subnet bound with its private ip, got %+v", resp.Interface)
+	}
+	// no free nic on the subnet
+	_, err = d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  "meta",
+		EndpointID: "ep3",
+		Interface:  &network.EndpointInterface{Address: "10.13.0.7/16"},
+	})
+	if err == nil {
+		t.Fatal("expect error of no matched nic")
+	}
+
+	// labels are refreshed
+	lock.Lock()
+	metadata = `{"Nics": [{"HardwareAddr": "52:54:0e:fd:00:03", "Subnet": "vxnet-c", "CIDR": "10.15.0.0/16"}]}`
+	lock.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.lock.RLock()
+		cloud1, cloud3 := d.nics.ByName("meta1").Cloud, d.nics.ByName("meta3").Cloud
+		d.lock.RUnlock()
+		if cloud1 == nil && cloud3 != nil && cloud3.Subnet == "vxnet-c" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect labels refreshed, got %+v, %+v", cloud1, cloud3)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// local file for offline use
+	f, err := ioutil.TempFile("", "hostnic-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"Nics": [{"HardwareAddr": "52:54:0e:fd:00:01", "CIDR": "10.13.0.0/16", "PrivateIP": "10.13.0.5"}]}`)
+	f.Close()
+	if m, err := LoadMetadata(f.Name()); err != nil || len(m.Nics) != 1 {
+		t.Fatalf("expect metadata of file, got %+v, %v", m, err)
+	}
+	ioutil.WriteFile(f.Name(), []byte(`{"Nics": [{"HardwareAddr": "52:54:0e:fd:00:01", "CIDR": "10.13.0.0/16", "PrivateIP": "10.14.0.5"}]}`), 0644)
+	if _, err := LoadMetadata(f.Name()); err == nil {
+		t.Fatal("expect error of private ip not in cidr")
+	}
+
+	m, err := LoadMetadata(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := MetadataNetworkCommands(m, "hostnic")
+	if len(commands) != 1 || commands[0] != "docker network create -d hostnic --subnet=10.15.0.0/16 -o vxnet=vxnet-c vxnet-c" {
+		t.Fatalf("unexpected commands %v", commands)
+	}
+}
+
+// newTestSandbox create a network namespace with an ifb link in it, the link is removed with the namespace when it is closed.
+func newTestSandbox(t *testing.T, name string) (string, *netlink.Handle, netlink.Link, func()) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origin.Close()
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("Create network namespace error: %s", err.Error())
+	}
+	if err := netns.Set(origin); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkAdd(&netlink.Ifb{LinkAttrs: netlink.LinkAttrs{Name: name}}); err != nil {
+		ns.Close()
+		t.Skipf("Add ifb link error: %s", err.Error())
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetNsFd(link, int(ns)); err != nil {
+		netlink.LinkDel(link)
+		t.Fatal(err)
+	}
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link, err = handle.LinkByName(name); err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("/proc/self/fd/%d", int(ns)), handle, link, func() {
+		handle.Delete()
+		ns.Close()
+	}
+}
+
+func TestWatchSandbox(t *testing.T) {
+	sandboxKey, handle, _, closeSandbox := newTestSandbox(t, "sbtest5")
+	defer closeSandbox()
+	watch, err := watchSandbox(sandboxKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watch.Close()
+	if err := netlink.LinkAdd(&netlink.Ifb{LinkAttrs: netlink.LinkAttrs{Name: "sbtest6"}}); err != nil {
+		t.Skipf("Add ifb link error: %s", err.Error())
+	}
+	link, err := netlink.LinkByName("sbtest6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, err := netns.GetFromPath(sandboxKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	if err := netlink.LinkSetNsFd(link, int(ns)); err != nil {
+		netlink.LinkDel(link)
+		t.Fatal(err)
+	}
+	// the nic moved into the sandbox after watching is received
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case update := <-watch.updates:
+			if update.Attrs().Name != "sbtest6" {
+				continue
+			}
+			if _, err := handle.LinkByName("sbtest6"); err != nil {
+				t.Fatal(err)
+			}
+			return
+		case <-timeout:
+			t.Fatal("expect link update of the nic moved into sandbox")
+		}
+	}
+}
+
+func TestSandboxFilters(t *testing.T) {
+	sandboxKey, handle, link, closeSandbox := newTestSandbox(t, "sbtest0")
+	defer closeSandbox()
+	sb, err := openSandbox(sandboxKey, link.Attrs().HardwareAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sb.Close()
+	// the kernel returns ENOENT if it can not load the police or gact action module.
+	if err := setupBandwidth(sb, &Bandwidth{EgressRate: 100000000, IngressRate: 200000000}); err != nil {
+		if strings.Contains(err.Error(), syscall.ENOENT.Error()) {
+			t.Skipf("Tc actions are not supported by kernel: %s", err.Error())
+		}
+		t.Fatal(err)
+	}
+	if err := setupAntiSpoof(sb, &Endpoint{hostNic: &HostNic{HardwareAddr: link.Attrs().HardwareAddr.String()}, addresses: []string{"10.16.0.5/24"}}); err != nil {
+		t.Fatal(err)
+	}
+	ingress, err := handle.FilterList(link, netlink.HANDLE_MIN_INGRESS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ingress) == 0 || ingress[0].Type() != "u32" {
+		t.Errorf("expect ingress police by u32 filter, got %v", ingress)
+	}
+	egress, err := handle.FilterList(link, netlink.HANDLE_MIN_EGRESS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(egress) == 0 {
+		t.Error("expect anti spoof filters on egress")
+	}
+	if err := sb.cleanupQdiscs(); err != nil {
+		t.Fatal(err)
+	}
+	if qdiscs, _ := handle.QdiscList(link); len(qdiscs) > 1 {
+		t.Errorf("expect qdiscs removed, got %v", qdiscs)
+	}
+}
+
+func TestAntiSpoofFailClosed(t *testing.T) {
+	sandboxKey, handle, link, closeSandbox := newTestSandbox(t, "astest0")
+	defer closeSandbox()
+	// docker brings the link up after it is moved into sandbox.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		handle.LinkSetUp(link)
+	}()
+	d := &HostNicDriver{networks: Networks{}, nics: NewNicTable(), done: make(chan struct{})}
+	endpoint := &Endpoint{
+		id:         "ep",
+		hostNic:    &HostNic{HardwareAddr: link.Attrs().HardwareAddr.String()},
+		addresses:  []string{"10.16.0.5/24"},
+		antiSpoof:  true,
+		sandboxKey: sandboxKey,
+	}
+	d.setupSandbox(log.WithFields(nil), endpoint, sandboxKey, net.ParseIP("10.16.0.1"), nil)
+	if endpoint.setupError == "" {
+		t.Skip("Anti spoof filters are installed, kernel supports tc actions")
+	}
+	link, err := handle.LinkByIndex(link.Attrs().Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Attrs().Flags&net.FlagUp != 0 {
+		t.Errorf("expect link set down when anti spoof filters are not installed")
+	}
+}
+
+func TestSetupSandboxUnlocked(t *testing.T) {
+	defer func(origin time.Duration) { sandboxLinkTimeout = origin }(sandboxLinkTimeout)
+	sandboxLinkTimeout = time.Second
+	d := &HostNicDriver{networks: Networks{}, nics: NewNicTable(), done: make(chan struct{})}
+	sandboxKey := "/var/run/docker/netns/not-exist"
+	endpoint := &Endpoint{id: "ep", hostNic: &HostNic{HardwareAddr: "52:54:0e:ff:06:01"}, antiSpoof: true, sandboxKey: sandboxKey}
+	done := make(chan struct{})
+	go func() {
+		d.setupSandbox(log.WithFields(nil), endpoint, sandboxKey, nil, nil)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	// status and leave are not blocked while waiting the sandbox
+	status := make(chan EndpointStatus)
+	go func() { status <- endpoint.status() }()
+	select {
+	case <-status:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("expect the lock of nic is not held while waiting the sandbox")
+	}
+	endpoint.hostNic.lock.Lock()
+	endpoint.sandboxKey = ""
+	endpoint.hostNic.lock.Unlock()
+	<-done
+	if endpoint.setupError != "" {
+		t.Errorf("expect endpoint left before setup is not degraded, got %s", endpoint.setupError)
+	}
+}
+
+func TestPolicyRouting(t *testing.T) {
+	if enabled, err := parsePolicyRouting(map[string]string{}, true); err != nil || !enabled {
+		t.Fatalf("expect default policy routing, got %v, %v", enabled, err)
+	}
+	if enabled, err := parsePolicyRouting(map[string]string{policyRoutingOption: "false"}, true); err != nil || enabled {
+		t.Fatalf("expect endpoint override policy routing, got %v, %v", enabled, err)
+	}
+	if _, err := parsePolicyRouting(map[string]string{policyRoutingOption: "yes"}, false); err == nil {
+		t.Fatal("expect invalid policy routing error")
+	}
+
+	sandboxKey, handle, link, closeSandbox := newTestSandbox(t, "prtest0")
+	defer closeSandbox()
+	// docker configures the address and brings the link up after it is moved into sandbox.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		addr, _ := netlink.ParseAddr("10.16.0.5/24")
+		handle.AddrAdd(link, addr)
+		handle.LinkSetUp(link)
+	}()
+
+	endpoint := &Endpoint{
+		id:            "ep",
+		hostNic:       &HostNic{HardwareAddr: link.Attrs().HardwareAddr.String()},
+		addresses:     []string{"10.16.0.5/24"},
+		policyRouting: true,
+		sandboxKey:    sandboxKey,
+	}
+	d := &HostNicDriver{networks: Networks{}, nics: NewNicTable(), done: make(chan struct{})}
+	logger := log.WithFields(nil)
+	d.setupSandbox(logger, endpoint, sandboxKey, net.ParseIP("10.16.0.1"), nil)
+	if endpoint.setupError != "" {
+		t.Fatalf("unexpected setup error: %s", endpoint.setupError)
+	}
+
+	table := policyRoutingTableBase + link.Attrs().Index
+	rules, err := handle.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, rule := range rules {
+		if rule.Priority == policyRoutingPriority && rule.Table == table && rule.Src != nil && rule.Src.String() == "10.16.0.5/32" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expect rule from endpoint ip lookup table %d, got %v", table, rules)
+	}
+	routes, err := handle.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 {
+		t.Fatalf("expect subnet and gateway routes in table %d, got %v", table, routes)
+	}
+	for _, route := range routes {
+		if route.Dst == nil && !route.Gw.Equal(net.ParseIP("10.16.0.1")) || route.Dst != nil && route.Dst.String() != "10.16.0.0/24" {
+			t.Fatalf("unexpected route %v", route)
+		}
+	}
+
+	cleanupSandbox(logger, endpoint, sandboxKey)
+	rules, err = handle.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range rules {
+		if rule.Priority == policyRoutingPriority {
+			t.Fatalf("expect rule removed, got %v", rule)
+		}
+	}
+	routes, err = handle.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+	if err != nil || len(routes) != 0 {
+		t.Fatalf("expect routes removed, got %v, %v", routes, err)
+	}
+	// nothing is left if the sandbox is gone
+	if err := cleanupPolicyRouting("/var/run/docker/netns/not-exist", endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	// the endpoint is degraded if policy routing can not be setup
+	events := d.Subscribe()
+	defer d.Unsubscribe(events)
+	noAddress := &Endpoint{id: "ep-noaddr", hostNic: endpoint.hostNic, policyRouting: true, sandboxKey: sandboxKey}
+	d.setupSandbox(logger, noAddress, sandboxKey, net.ParseIP("10.16.0.1"), nil)
+	if status := noAddress.status(); status.SetupError == "" {
+		t.Errorf("expect setup error of endpoint, got %+v", status)
+	}
+	select {
+	case e := <-events:
+		if e.Type != EndpointDegraded || e.Endpoint != "ep-noaddr" {
+			t.Errorf("expect endpoint degraded event, got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("expect endpoint degraded event")
+	}
 }
@@ -0,0 +1,134 @@
+package driver
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	siocEthtool      = 0x8946
+	ethtoolGSet      = 0x00000001
+	ethtoolGDrvInfo  = 0x00000003
+	ethtoolGPermAddr = 0x00000020
+	maxAddrLen       = 32
+	ethtoolBusLen    = 32
+	ifNameSize       = 16
+)
+
+// ethtoolDrvInfo is struct ethtool_drvinfo
+type ethtoolDrvInfo struct {
+	cmd         uint32
+	driver      [32]byte
+	version     [32]byte
+	fwVersion   [32]byte
+	busInfo     [ethtoolBusLen]byte
+	eromVersion [32]byte
+	reserved2   [12]byte
+	nPrivFlags  uint32
+	nStats      uint32
+	testinfoLen uint32
+	eedumpLen   uint32
+	regdumpLen  uint32
+}
+
+// ethtoolCmd is struct ethtool_cmd
+type ethtoolCmd struct {
+	cmd           uint32
+	supported     uint32
+	advertising   uint32
+	speed         uint16
+	duplex        uint8
+	port          uint8
+	phyAddress    uint8
+	transceiver   uint8
+	autoneg       uint8
+	mdioSupport   uint8
+	maxtxpkt      uint32
+	maxrxpkt      uint32
+	speedHi       uint16
+	ethTpMdix     uint8
+	ethTpMdixCtrl uint8
+	lpAdvertising uint32
+	reserved      [2]uint32
+}
+
+// ethtoolPermAddr is struct ethtool_perm_addr with data of MAX_ADDR_LEN
+type ethtoolPermAddr struct {
+	cmd  uint32
+	size uint32
+	data [maxAddrLen]byte
+}
+
+type ifreq struct {
+	name [ifNameSize]byte
+	data uintptr
+}
+
+// ethtoolInfo is the driver and link settings read by ethtool ioctl.
+type ethtoolInfo struct {
+	Driver  string
+	BusInfo string // pci address for pci device
+	Speed   uint32 // Mb/s, 0 if unknown
+	Duplex  string
+}
+
+func ethtool(fd int, name string, data unsafe.Pointer) error {
+	req := ifreq{data: uintptr(data)}
+	copy(req.name[:ifNameSize-1], name)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), siocEthtool, uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// readEthtool read driver info and link settings of the interface name by socket fd,
+// the interface must be in the namespace of the socket.
+func readEthtool(fd int, name string) (*ethtoolInfo, error) {
+	drvInfo := ethtoolDrvInfo{cmd: ethtoolGDrvInfo}
+	if err := ethtool(fd, name, unsafe.Pointer(&drvInfo)); err != nil {
+		return nil, err
+	}
+	info := &ethtoolInfo{
+		Driver:  cString(drvInfo.driver[:]),
+		BusInfo: cString(drvInfo.busInfo[:]),
+	}
+	cmd := ethtoolCmd{cmd: ethtoolGSet}
+	// virtual device may not support get settings, ignore the error.
+	if err := ethtool(fd, name, unsafe.Pointer(&cmd)); err == nil {
+		speed := uint32(cmd.speedHi)<<16 | uint32(cmd.speed)
+		if speed != 0xffff && speed != 0xffffffff {
+			info.Speed = speed
+		}
+		switch cmd.duplex {
+		case 0:
+			info.Duplex = "half"
+		case 1:
+			info.Duplex = "full"
+		default:
+			info.Duplex = "unknown"
+		}
+	}
+	return info, nil
+}
+
+// readPermAddr read the permanent hardware addr of the interface name by socket fd, it is empty if the driver does not report it.
+func readPermAddr(fd int, name string) (string, error) {
+	permAddr := ethtoolPermAddr{cmd: ethtoolGPermAddr, size: maxAddrLen}
+	if err := ethtool(fd, name, unsafe.Pointer(&permAddr)); err != nil {
+		return "", err
+	}
+	if permAddr.size == 0 || permAddr.size > maxAddrLen || bytes.Count(permAddr.data[:permAddr.size], []byte{0}) == int(permAddr.size) {
+		return "", nil
+	}
+	return net.HardwareAddr(permAddr.data[:permAddr.size]).String(), nil
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,204 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/yunify/docker-plugin-hostnic/log"
+)
+
+// EventType is the type of lifecycle event.
+type EventType string
+
+const (
+	NetworkCreated  EventType = "network.created"
+	NetworkDeleted  EventType = "network.deleted"
+	EndpointCreated EventType = "endpoint.created"
+	EndpointJoined  EventType = "endpoint.joined"
+	EndpointLeft    EventType = "endpoint.left"
+	EndpointDeleted EventType = "endpoint.deleted"
+	// settings (anti spoof, bandwidth, policy routing) failed to apply in sandbox
+	EndpointDegraded EventType = "endpoint.degraded"
+	NicAppeared      EventType = "nic.appeared"    // nic is added to nic table
+	NicDisappeared   EventType = "nic.disappeared" // free nic left host, or bound nic disappeared (not moved into sandbox)
+	NicRestored      EventType = "nic.restored"    // disappeared bound nic is back to host
+)
+
+// eventBufferSize is the number of events buffered for a subscriber, events are dropped if the subscriber is slow.
+const eventBufferSize = 64
+
+// Event is the lifecycle event of network, endpoint and nic.
+type Event struct {
+	Time         time.Time
+	Type         EventType
+	Network      string `json:",omitempty"`
+	Endpoint     string `json:",omitempty"`
+	HardwareAddr string `json:",omitempty"`
+	Nic          string `json:",omitempty"`
+	Address      string `json:",omitempty"`
+	Sandbox      string `json:",omitempty"`
+	Reason       string `json:",omitempty"`
+}
+
+// eventBus append events to audit file, and deliver them to subscribers. Zero value is usable without audit file.
+// Events are emitted under the lock of driver, so they are queued for the audit writer, the file is written without it.
+type eventBus struct {
+	lock        sync.Mutex
+	audit       io.WriteCloser
+	subscribers map[chan Event]bool
+	queue       []Event       // events to append to audit file
+	wake        chan struct{} // signal the audit writer there are queued events
+	writer      sync.WaitGroup
+}
+
+func (b *eventBus) publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.audit != nil {
+		b.queue = append(b.queue, e)
+		select {
+		case b.wake <- struct{}{}:
+		default:
+		}
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+			httpLog.Warning("Event subscriber is slow, drop event [%s]", e.Type)
+		}
+	}
+}
+
+// openAudit start the writer of audit file, the current audit file is closed first.
+func (b *eventBus) openAudit(audit io.WriteCloser) {
+	b.closeAudit()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.audit = audit
+	b.wake = make(chan struct{}, 1)
+	b.writer.Add(1)
+	go b.writeAudit(audit, b.wake)
+}
+
+// closeAudit stop appending events to audit file, and wait the queued events are written and the file is closed.
+func (b *eventBus) closeAudit() {
+	b.lock.Lock()
+	if b.audit != nil {
+		close(b.wake)
+		b.audit, b.wake = nil, nil
+	}
+	b.lock.Unlock()
+	b.writer.Wait()
+}
+
+// writeAudit append queued events to the audit file until wake is closed.
+func (b *eventBus) writeAudit(audit io.WriteCloser, wake <-chan struct{}) {
+	defer b.writer.Done()
+	defer audit.Close()
+	for range wake {
+		b.writeQueued(audit)
+	}
+	b.writeQueued(audit)
+}
+
+func (b *eventBus) writeQueued(audit io.Writer) {
+	b.lock.Lock()
+	events := b.queue
+	b.queue = nil
+	b.lock.Unlock()
+	for _, e := range events {
+		data, _ := json.Marshal(e)
+		if _, err := audit.Write(append(data, '\n')); err != nil {
+			driverLog.WithError(err).Error("Write audit event [%s] error", e.Type)
+		}
+	}
+}
+
+func (b *eventBus) subscribe() chan Event {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan Event]bool)
+	}
+	ch := make(chan Event, eventBufferSize)
+	b.subscribers[ch] = true
+	return ch
+}
+
+func (b *eventBus) unsubscribe(ch chan Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.subscribers, ch)
+}
+
+// SetAuditFile append lifecycle events to the file as json lines, the file is rotated by size.
+func (d *HostNicDriver) SetAuditFile(path string, maxSize int64, maxFiles int) error {
+	f, err := log.OpenRotateFile(path, maxSize, maxFiles)
+	if err != nil {
+		return err
+	}
+	d.events.openAudit(f)
+	return nil
+}
+
+// Subscribe return the channel of lifecycle events, it must be unsubscribed after use.
+func (d *HostNicDriver) Subscribe() chan Event {
+	return d.events.subscribe()
+}
+
+func (d *HostNicDriver) Unsubscribe(ch chan Event) {
+	d.events.unsubscribe(ch)
+}
+
+func (d *HostNicDriver) emit(e Event) {
+	d.events.publish(e)
+}
+
+// serveEvents stream events as newline delimited json, or server-sent events if the client accepts text/event-stream.
+func serveEvents(d *HostNicDriver, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	sse := r.Header.Get("Accept") == "text/event-stream" || r.URL.Query().Get("format") == "sse"
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	// subscribe before reply, so the client get all events after the response is received.
+	ch := d.Subscribe()
+	defer d.Unsubscribe(ch)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	httpLog.Debug("Event subscriber [%s] connected", r.RemoteAddr)
+	for {
+		select {
+		case <-r.Context().Done():
+			httpLog.Debug("Event subscriber [%s] disconnected", r.RemoteAddr)
+			return
+		case e := <-ch:
+			data, _ := json.Marshal(e)
+			var err error
+			if sse {
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			} else {
+				_, err = fmt.Fprintf(w, "%s\n", data)
+			}
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"github.com/yunify/docker-plugin-hostnic/log"
+)
+
+// gcGracePeriod is the time after an endpoint is created or joined that gc leaves it alone,
+// docker creates and joins the sandbox before the first process of container starts.
+var gcGracePeriod = time.Minute
+
+// procDir is the proc filesystem, network namespaces of processes are in it.
+var procDir = "/proc"
+
+// gc actions, in the order they are applied to a nic.
+const (
+	gcMove    = "move"    // move the nic from dead sandbox back to host
+	gcRename  = "rename"  // rename the nic on host back to the name before join
+	gcRelease = "release" // clear the binding of the nic and delete the endpoint
+)
+
+// GCRequest is the body of POST /gc of admin api.
+type GCRequest struct {
+	DockerEndpoints []string // ids of endpoints known by docker, required
+}
+
+// GCAction is a step to recover an orphaned nic, Error is set if the step failed.
+type GCAction struct {
+	Action       string
+	HardwareAddr string
+	Nic          string
+	Endpoint     string `json:",omitempty"`
+	Network      string `json:",omitempty"`
+	Sandbox      string `json:",omitempty"`
+	Reason       string
+	Error        string `json:",omitempty"`
+}
+
+// GC recover nics held by endpoints docker no longer knows, whose sandbox is dead or which are not registered in network.
+// dockerEndpoints are the ids of endpoints known by docker, read from the docker api by the caller,
+// nics bound to them or in their grace period are never touched.
+// Nics in dead sandboxes are moved back to host and renamed to the name before join, then their stale bindings are cleared.
+// Nothing is changed if dryRun, the plan is returned.
+// It refuses to run if the plugin is not in the pid namespace of host, all sandboxes look dead then.
+func (d *HostNicDriver) GC(dryRun bool, dockerEndpoints map[string]bool) ([]GCAction, error) {
+	if dockerEndpoints == nil {
+		return nil, fmt.Errorf("Endpoints known by docker are required to find orphaned nics")
+	}
+	if err := checkHostPidNamespace(); err != nil {
+		return nil, err
+	}
+	live := liveNetns()
+	d.lock.RLock()
+	var nics []*HostNic
+	for _, nic := range d.nics.Nics() {
+		if nic.endpoint != nil {
+			nics = append(nics, nic)
+		}
+	}
+	d.lock.RUnlock()
+	sort.Sort(hostNicByName(nics))
+
+	actions := []GCAction{}
+	for _, nic := range nics {
+		actions = append(actions, d.gcNic(nic, live, dockerEndpoints, dryRun)...)
+	}
+	driverLog.WithField("dry_run", dryRun).Info("GC finished, %d actions", len(actions))
+	return actions, nil
+}
+
+// gcNic recover the bound nic if docker does not know its endpoint, and the endpoint is lost or the sandbox of endpoint is dead.
+func (d *HostNicDriver) gcNic(nic *HostNic, live map[uint64]bool, dockerEndpoints map[string]bool, dryRun bool) []GCAction {
+	nic.lock.Lock()
+	defer nic.lock.Unlock()
+	d.lock.RLock()
+	endpoint := nic.endpoint
+	var nw *Network
+	if endpoint != nil {
+		nw = d.networks[endpoint.networkID]
+	}
+	d.lock.RUnlock()
+	if endpoint == nil || dockerEndpoints[endpoint.id] || time.Since(endpoint.updated) < gcGracePeriod {
+		return nil
+	}
+	registered := false
+	if nw != nil {
+		nw.lock.RLock()
+		registered = nw.endpoints[endpoint.id] == endpoint
+		nw.lock.RUnlock()
+	}
+	var reason string
+	switch {
+	case !registered:
+		reason = "endpoint is not registered in network"
+	case endpoint.sandboxKey == "":
+		// created but not joined, docker joins it later.
+		return nil
+	case !isLiveSandbox(endpoint.sandboxKey, live):
+		reason = "sandbox of endpoint is dead"
+	default:
+		return nil
+	}
+	reason += ", docker does not know the endpoint"
+
+	logger := driverLog.WithFields(log.Fields{"mac": nic.HardwareAddr, "endpoint_id": endpoint.id, "network_id": endpoint.networkID, "sandbox": endpoint.sandboxKey})
+	action := func(name string) GCAction {
+		return GCAction{Action: name, HardwareAddr: nic.HardwareAddr, Nic: endpoint.srcName, Endpoint: endpoint.id, Network: endpoint.networkID, Sandbox: endpoint.sandboxKey, Reason: reason}
+	}
+	var actions []GCAction
+	if endpoint.sandboxKey != "" {
+		if sb, err := openSandbox(endpoint.sandboxKey, nic.HardwareAddr); err == nil {
+			move := action(gcMove)
+			if !dryRun {
+				if err := moveToHost(sb); err != nil {
+					move.Error = err.Error()
+				}
+			}
+			sb.Close()
+			actions = append(actions, move)
+		}
+	}
+	// the nic moved back by kernel is renamed by its name in sandbox.
+	if link, err := findLink(&netlink.Handle{}, nic.HardwareAddr); err == nil && endpoint.srcName != "" && link.Attrs().Name != endpoint.srcName {
+		rename := action(gcRename)
+		if !dryRun {
+			if err := renameLink(link, endpoint.srcName); err != nil {
+				rename.Error = err.Error()
+			}
+		}
+		actions = append(actions, rename)
+	} else if err != nil && dryRun && len(actions) > 0 {
+		// the nic is renamed after it is moved back.
+		actions = append(actions, action(gcRename))
+	}
+	release := action(gcRelease)
+	if !dryRun {
+		if endpoint.sandboxKey != "" {
+			cleanupSandbox(logger, endpoint, endpoint.sandboxKey)
+			endpoint.setSandboxKey("")
+		}
+		d.releaseBoundNic(logger, nic, endpoint, nw, "garbage collected: "+reason)
+	}
+	return append(actions, release)
+}
+
+// releaseBoundNic unbind the nic from endpoint and delete the endpoint, caller must hold the lock of nic.
+func (d *HostNicDriver) releaseBoundNic(logger *log.Entry, nic *HostNic, endpoint *Endpoint, nw *Network, reason string) {
+	if nw != nil {
+		nw.lock.Lock()
+		if nw.endpoints[endpoint.id] == endpoint {
+			delete(nw.endpoints, endpoint.id)
+		}
+		nw.lock.Unlock()
+	}
+	d.lock.Lock()
+	d.nics.release(nic)
+	d.lock.Unlock()
+	logger.WithField("reason", reason).Warning("Release host nic from endpoint")
+	d.emit(Event{Type: EndpointDeleted, Network: endpoint.networkID, Endpoint: endpoint.id, HardwareAddr: nic.HardwareAddr, Nic: endpoint.srcName, Reason: reason})
+}
+
+// moveToHost move the link of sandbox back to host network namespace, the namespace of current process.
+func moveToHost(sb *sandbox) error {
+	host, err := netns.GetFromPid(os.Getpid())
+	if err != nil {
+		return err
+	}
+	defer host.Close()
+	if err := sb.handle.LinkSetDown(sb.link); err != nil {
+		return err
+	}
+	return sb.handle.LinkSetNsFd(sb.link, int(host))
+}
+
+// renameLink rename the link on host, the link must be down to be renamed.
+func renameLink(link netlink.Link, name string) error {
+	if err := netlink.LinkSetDown(link); err != nil {
+		return err
+	}
+	if err := netlink.LinkSetName(link, name); err != nil {
+		return fmt.Errorf("Rename [%s] to [%s] error: %s", link.Attrs().Name, name, err.Error())
+	}
+	return nil
+}
+
+// checkHostPidNamespace return error if the plugin is not in the pid namespace of host,
+// processes of containers are not visible in proc then. The NSpid of a process has one pid only in the root pid namespace.
+func checkHostPidNamespace() error {
+	data, err := ioutil.ReadFile(procStatus)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "NSpid:") {
+			continue
+		}
+		if len(strings.Fields(line)) != 2 {
+			return fmt.Errorf("Plugin is not in the pid namespace of host, run it with --pid host to check sandboxes of containers")
+		}
+		return nil
+	}
+	return fmt.Errorf("Can not check the pid namespace of plugin, NSpid is not in %s (kernel 4.1 or later)", procStatus)
+}
+
+// liveNetns return the inodes of network namespaces used by processes.
+func liveNetns() map[uint64]bool {
+	live := make(map[uint64]bool)
+	nsFiles, _ := filepath.Glob(filepath.Join(procDir, "[0-9]*", "ns", "net"))
+	for _, nsFile := range nsFiles {
+		var stat syscall.Stat_t
+		if err := syscall.Stat(nsFile, &stat); err == nil {
+			live[stat.Ino] = true
+		}
+	}
+	return live
+}
+
+// isLiveSandbox return whether the sandbox exists and is used by any process.
+func isLiveSandbox(sandboxKey string, live map[uint64]bool) bool {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(sandboxKey, &stat); err != nil {
+		return false
+	}
+	return live[stat.Ino]
+}
+
+type hostNicByName []*HostNic
+
+func (s hostNicByName) Len() int           { return len(s) }
+func (s hostNicByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s hostNicByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
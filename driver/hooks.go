@@ -0,0 +1,198 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/yunify/docker-plugin-hostnic/log"
+)
+
+// Hooks run before and after endpoint operations. Executables in hooks dir named as the hook,
+// or with a suffix after dot (e.g., pre-join.10-acl), are run in name order.
+// A failing pre hook fails the docker request, a failing post hook is only logged.
+const (
+	PreCreateEndpoint  = "pre-create-endpoint"
+	PostCreateEndpoint = "post-create-endpoint"
+	PreJoin            = "pre-join"
+	PostJoin           = "post-join" // the nic is moved into sandbox by docker after the join response
+	PreLeave           = "pre-leave"
+	PostLeave          = "post-leave"
+	PreDeleteEndpoint  = "pre-delete-endpoint"
+	PostDeleteEndpoint = "post-delete-endpoint"
+)
+
+// DefaultHookTimeout is the default max time a hook executable can run before it is killed.
+const DefaultHookTimeout = 10 * time.Second
+
+// hookOutputLimit is the max length of hook output in the error of failing hook.
+const hookOutputLimit = 256
+
+// HookPayload is the json passed to hook executables on stdin.
+type HookPayload struct {
+	Hook     string
+	Time     time.Time
+	Network  HookNetwork
+	Endpoint HookEndpoint
+	Nic      HookNic
+	Sandbox  string `json:",omitempty"`
+}
+
+// HookNetwork is the network of hook payload.
+type HookNetwork struct {
+	ID      string
+	Pool    string
+	Gateway string
+}
+
+// HookEndpoint is the endpoint of hook payload.
+type HookEndpoint struct {
+	ID        string
+	Addresses []string
+	Bandwidth *Bandwidth `json:",omitempty"`
+	AntiSpoof bool
+}
+
+// HookNic is the host nic of hook payload.
+type HookNic struct {
+	Name         string
+	HardwareAddr string
+	Address      string `json:",omitempty"`
+	Index        int
+}
+
+// hookRunner runs hook executables, zero value runs nothing.
+type hookRunner struct {
+	dir     string
+	timeout time.Duration
+}
+
+// SetHooks run the executables in dir on endpoint operations, it must be called before serving plugin api.
+func (d *HostNicDriver) SetHooks(dir string, timeout time.Duration) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("Hooks dir [%s] is not a dir", dir)
+	}
+	if timeout <= 0 {
+		timeout = DefaultHookTimeout
+	}
+	d.hooks = hookRunner{dir: dir, timeout: timeout}
+	return nil
+}
+
+// executables return the executables of hook in name order.
+func (h hookRunner) executables(hook string) ([]string, error) {
+	if h.dir == "" {
+		return nil, nil
+	}
+	files, err := ioutil.ReadDir(h.dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, f := range files {
+		if f.Name() != hook && !strings.HasPrefix(f.Name(), hook+".") {
+			continue
+		}
+		if !f.Mode().IsRegular() || f.Mode()&0111 == 0 {
+			continue
+		}
+		paths = append(paths, filepath.Join(h.dir, f.Name()))
+	}
+	return paths, nil
+}
+
+// run run the executables of hook one by one, and stop at the first failing one.
+func (h hookRunner) run(logger *log.Entry, payload *HookPayload) error {
+	paths, err := h.executables(payload.Hook)
+	if err != nil || len(paths) == 0 {
+		return err
+	}
+	payload.Time = time.Now()
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	env := append(os.Environ(),
+		"HOSTNIC_HOOK="+payload.Hook,
+		"HOSTNIC_NETWORK_ID="+payload.Network.ID,
+		"HOSTNIC_ENDPOINT_ID="+payload.Endpoint.ID,
+		"HOSTNIC_NIC="+payload.Nic.Name,
+		"HOSTNIC_MAC="+payload.Nic.HardwareAddr,
+		"HOSTNIC_SANDBOX="+payload.Sandbox,
+	)
+	for _, path := range paths {
+		start := time.Now()
+		output, err := h.exec(path, data, env)
+		logger.WithFields(log.Fields{"hook": path, "duration": time.Since(start).String()}).Debug("Run hook, output: %s", output)
+		if err != nil {
+			if len(output) > hookOutputLimit {
+				output = output[:hookOutputLimit] + "..."
+			}
+			if output != "" {
+				return fmt.Errorf("Hook [%s] error: %s, output: %s", path, err.Error(), output)
+			}
+			return fmt.Errorf("Hook [%s] error: %s", path, err.Error())
+		}
+	}
+	return nil
+}
+
+// exec run the executable with payload on stdin, the process group of it is killed on timeout.
+func (h hookRunner) exec(path string, payload []byte, env []string) (string, error) {
+	cmd := exec.Command(path)
+	cmd.Dir = h.dir
+	cmd.Env = env
+	cmd.Stdin = bytes.NewReader(payload)
+	output := &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = output, output
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	timer := time.AfterFunc(h.timeout, func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	err := cmd.Wait()
+	if !timer.Stop() {
+		err = fmt.Errorf("timeout after %s", h.timeout)
+	}
+	return strings.TrimSpace(output.String()), err
+}
+
+// hookPayload return the payload of hook on the endpoint, the caller should hold the lock of the nic.
+func (d *HostNicDriver) hookPayload(hook string, nw *Network, endpoint *Endpoint, sandboxKey string) *HookPayload {
+	payload := &HookPayload{
+		Hook:     hook,
+		Network:  HookNetwork{ID: nw.ID},
+		Endpoint: HookEndpoint{ID: endpoint.id, Addresses: endpoint.addresses, Bandwidth: endpoint.bandwidth, AntiSpoof: endpoint.antiSpoof},
+		Sandbox:  sandboxKey,
+	}
+	if nw.IPv4Data != nil {
+		payload.Network.Pool, payload.Network.Gateway = nw.IPv4Data.Pool, nw.IPv4Data.Gateway
+	}
+	d.lock.RLock()
+	payload.Nic = HookNic{Name: endpoint.hostNic.Name, HardwareAddr: endpoint.hostNic.HardwareAddr, Address: endpoint.hostNic.Address, Index: endpoint.hostNic.Index}
+	d.lock.RUnlock()
+	return payload
+}
+
+// runHook run the pre hook and return its error, or run the post hook and log its error.
+func (d *HostNicDriver) runHook(logger *log.Entry, payload *HookPayload) error {
+	err := d.hooks.run(logger, payload)
+	if err != nil && strings.HasPrefix(payload.Hook, "post-") {
+		logger.WithError(err).Warning("Post hook [%s] failed", payload.Hook)
+		return nil
+	}
+	return err
+}
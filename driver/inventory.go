@@ -0,0 +1,364 @@
+package driver
+
+import (
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+	"github.com/yunify/docker-plugin-hostnic/log"
+)
+
+const (
+	// resubscribeInterval is the delay before subscribe link updates again when subscription is broken.
+	resubscribeInterval = time.Second
+	// linkReceiveTimeout bounds a receive of link updates, so the subscription checks done at least this often.
+	linkReceiveTimeout = 200 * time.Millisecond
+)
+
+// NicTable is the inventory of host nics, indexed by hardware addr, name and ifindex.
+// Bound nics stay in the table after they leave host (e.g., moved into sandbox), so they can not be bound twice.
+type NicTable struct {
+	byAddr   map[string]*HostNic
+	byName   map[string]*HostNic
+	byIndex  map[int]*HostNic
+	metadata map[string]*NicMetadata // cloud subnets of nics by hardware addr, may be nil
+	emit     func(Event)             // emit nic events, may be nil
+}
+
+func NewNicTable() *NicTable {
+	return &NicTable{
+		byAddr:  make(map[string]*HostNic),
+		byName:  make(map[string]*HostNic),
+		byIndex: make(map[int]*HostNic),
+	}
+}
+
+func (t *NicTable) ByHardwareAddr(hardwareAddr string) *HostNic {
+	return t.byAddr[hardwareAddr]
+}
+
+func (t *NicTable) ByName(name string) *HostNic {
+	return t.byName[name]
+}
+
+func (t *NicTable) ByIndex(index int) *HostNic {
+	return t.byIndex[index]
+}
+
+// Nics return all nics in table.
+func (t *NicTable) Nics() []*HostNic {
+	nics := make([]*HostNic, 0, len(t.byAddr))
+	for _, nic := range t.byAddr {
+		nics = append(nics, nic)
+	}
+	return nics
+}
+
+// isNic return whether the link can be added to nic table, links without hardware addr (e.g., lo) are ignored.
+func isNic(link netlink.Link) bool {
+	return len(link.Attrs().HardwareAddr) != 0
+}
+
+// update add the link to table, or update name, index and ip address of the nic with same hardware addr.
+func (t *NicTable) update(link netlink.Link, address string) *HostNic {
+	if !isNic(link) {
+		return nil
+	}
+	attrs := link.Attrs()
+	nic := t.byAddr[attrs.HardwareAddr.String()]
+	if nic == nil {
+		nic = &HostNic{HardwareAddr: attrs.HardwareAddr.String()}
+		nic.Cloud = t.metadata[nic.HardwareAddr]
+		t.byAddr[nic.HardwareAddr] = nic
+		inventoryLog.WithFields(log.Fields{"nic": attrs.Name, "mac": nic.HardwareAddr}).Info("Add nic to nic table")
+		t.event(Event{Type: NicAppeared, HardwareAddr: nic.HardwareAddr, Nic: attrs.Name})
+	} else {
+		t.unindex(nic)
+	}
+	nic.Name = attrs.Name
+	nic.Index = attrs.Index
+	if nic.endpoint == nil {
+		nic.Address = address
+	}
+	t.byName[nic.Name] = nic
+	t.byIndex[nic.Index] = nic
+	return nic
+}
+
+// remove the nic of link from host, bound nic is kept in table by hardware addr.
+func (t *NicTable) remove(link netlink.Link) *HostNic {
+	nic := t.byIndex[link.Attrs().Index]
+	if nic == nil {
+		return nil
+	}
+	t.unindex(nic)
+	nic.Index = 0
+	if nic.endpoint == nil {
+		delete(t.byAddr, nic.HardwareAddr)
+		inventoryLog.WithFields(log.Fields{"nic": nic.Name, "mac": nic.HardwareAddr}).Info("Delete nic from nic table")
+		t.event(Event{Type: NicDisappeared, HardwareAddr: nic.HardwareAddr, Nic: nic.Name, Reason: "nic left host"})
+	}
+	return nic
+}
+
+// sync make the table same as links with their ip addresses by index, return the nics removed from host.
+func (t *NicTable) sync(links []netlink.Link, addresses map[int]string) []*HostNic {
+	exists := make(map[int]bool)
+	for _, link := range links {
+		if nic := t.update(link, addresses[link.Attrs().Index]); nic != nil {
+			exists[nic.Index] = true
+		}
+	}
+	var removed []*HostNic
+	for index, nic := range t.byIndex {
+		if !exists[index] {
+			removed = append(removed, t.remove(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Index: nic.Index}}))
+		}
+	}
+	return removed
+}
+
+// release unbind the nic from endpoint, delete it if it is not on host.
+func (t *NicTable) release(nic *HostNic) {
+	nic.endpoint = nil
+	if nic.Index == 0 && t.byAddr[nic.HardwareAddr] == nic {
+		delete(t.byAddr, nic.HardwareAddr)
+		inventoryLog.WithFields(log.Fields{"nic": nic.Name, "mac": nic.HardwareAddr}).Info("Delete nic from nic table")
+		t.event(Event{Type: NicDisappeared, HardwareAddr: nic.HardwareAddr, Nic: nic.Name, Reason: "nic is not on host after released"})
+	}
+}
+
+func (t *NicTable) event(e Event) {
+	if t.emit != nil {
+		t.emit(e)
+	}
+}
+
+func (t *NicTable) unindex(nic *HostNic) {
+	if t.byName[nic.Name] == nic {
+		delete(t.byName, nic.Name)
+	}
+	if t.byIndex[nic.Index] == nic {
+		delete(t.byIndex, nic.Index)
+	}
+}
+
+// SetProtectedNics set the nics never bound to endpoints by name or hardware addr, e.g., the nic of host default route.
+func (d *HostNicDriver) SetProtectedNics(nics []string) {
+	protected := make(map[string]bool, len(nics))
+	for _, nic := range nics {
+		nic = strings.TrimSpace(nic)
+		if nic == "" {
+			continue
+		}
+		if hw, err := net.ParseMAC(nic); err == nil {
+			nic = hw.String()
+		}
+		protected[nic] = true
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.protected = protected
+	inventoryLog.WithField("nics", strings.Join(nics, ",")).Info("Set protected nics")
+}
+
+// isProtected return whether the nic is protected, caller must hold d.lock.
+func (d *HostNicDriver) isProtected(nic *HostNic) bool {
+	return d.protected[nic.Name] || d.protected[nic.HardwareAddr]
+}
+
+// linkIPAddr return the first ipv4 address of link, it is read before taking the lock of driver.
+func linkIPAddr(link netlink.Link) string {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil || len(addrs) == 0 {
+		return ""
+	}
+	return addrs[0].IPNet.String()
+}
+
+// watchNics sync nic table with host links, and keep it up to date by link updates until done is closed.
+func (d *HostNicDriver) watchNics() error {
+	updates := make(chan netlink.LinkUpdate)
+	if err := subscribeLinks(netns.None(), updates, d.done); err != nil {
+		return err
+	}
+	d.syncNics()
+	d.watchers.Add(1)
+	go func() {
+		defer d.watchers.Done()
+		for {
+			for update := range updates {
+				d.handleLinkUpdate(update)
+			}
+			select {
+			case <-d.done:
+				return
+			case <-time.After(resubscribeInterval):
+			}
+			inventoryLog.Warning("Link subscription is broken, subscribe again")
+			updates = make(chan netlink.LinkUpdate)
+			if err := subscribeLinks(netns.None(), updates, d.done); err != nil {
+				inventoryLog.WithError(err).Error("Subscribe link updates error")
+				close(updates)
+				continue
+			}
+			d.syncNics()
+		}
+	}()
+	return nil
+}
+
+// subscribeLinks send link updates of the namespace (netns.None() for host) to updates until done is closed, then close updates.
+// It replaces netlink.LinkSubscribe, which closes the socket under a blocked receive on done and never returns
+// if no link changes. The receive here has a timeout, and the socket is closed by the receiving goroutine.
+func subscribeLinks(ns netns.NsHandle, updates chan<- netlink.LinkUpdate, done <-chan struct{}) error {
+	s, err := nl.SubscribeAt(ns, netns.None(), syscall.NETLINK_ROUTE, syscall.RTNLGRP_LINK)
+	if err != nil {
+		return err
+	}
+	tv := syscall.NsecToTimeval(linkReceiveTimeout.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(s.GetFd(), syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		s.Close()
+		return err
+	}
+	go func() {
+		defer close(updates)
+		defer s.Close()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			msgs, err := s.Receive()
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			}
+			if err != nil {
+				inventoryLog.WithError(err).Error("Receive link updates error")
+				return
+			}
+			for _, m := range msgs {
+				link, err := netlink.LinkDeserialize(m.Data)
+				if err != nil {
+					inventoryLog.WithError(err).Error("Parse link update error")
+					return
+				}
+				update := netlink.LinkUpdate{IfInfomsg: *nl.DeserializeIfInfomsg(m.Data), Header: m.Header, Link: link}
+				select {
+				case updates <- update:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// hostLinks list the links of host nics, which nic table holds and the driver could bind.
+func hostLinks() ([]netlink.Link, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	var nics []netlink.Link
+	for _, link := range links {
+		if isNic(link) {
+			nics = append(nics, link)
+		}
+	}
+	return nics, nil
+}
+
+// syncNics sync nic table with host links in case link updates are missed.
+func (d *HostNicDriver) syncNics() {
+	links, err := hostLinks()
+	if err != nil {
+		inventoryLog.WithError(err).Error("Get LinkList error")
+		return
+	}
+	addresses := make(map[int]string)
+	for _, link := range links {
+		addresses[link.Attrs().Index] = linkIPAddr(link)
+	}
+	d.lock.Lock()
+	removed := d.nics.sync(links, addresses)
+	var endpoints []*Endpoint
+	for _, nic := range removed {
+		endpoints = append(endpoints, nic.endpoint)
+	}
+	d.lock.Unlock()
+	for i, nic := range removed {
+		if endpoints[i] != nil {
+			go d.checkBoundNic(nic, endpoints[i])
+		}
+	}
+}
+
+func (d *HostNicDriver) handleLinkUpdate(update netlink.LinkUpdate) {
+	var nic *HostNic
+	address := ""
+	if update.Header.Type == syscall.RTM_NEWLINK && isNic(update.Link) {
+		address = linkIPAddr(update.Link)
+	}
+	d.lock.Lock()
+	switch update.Header.Type {
+	case syscall.RTM_NEWLINK:
+		nic = d.nics.update(update.Link, address)
+	case syscall.RTM_DELLINK:
+		nic = d.nics.remove(update.Link)
+	}
+	var endpoint *Endpoint
+	if nic != nil {
+		endpoint = nic.endpoint
+	}
+	d.lock.Unlock()
+	if endpoint == nil {
+		return
+	}
+	// the lock of nic may be held by slow operations, do not block link updates.
+	if update.Header.Type == syscall.RTM_DELLINK {
+		go d.checkBoundNic(nic, endpoint)
+	} else {
+		go d.recoverBoundNic(nic, endpoint)
+	}
+}
+
+// checkBoundNic mark the endpoint degraded if the bound nic left host but not in the sandbox of endpoint.
+func (d *HostNicDriver) checkBoundNic(nic *HostNic, endpoint *Endpoint) {
+	nic.lock.Lock()
+	defer nic.lock.Unlock()
+	d.lock.RLock()
+	back := nic.Index != 0 || nic.endpoint != endpoint
+	name := nic.Name
+	d.lock.RUnlock()
+	if back {
+		return
+	}
+	if endpoint.sandboxKey != "" {
+		if sb, err := openSandbox(endpoint.sandboxKey, nic.HardwareAddr); err == nil {
+			sb.Close()
+			return
+		}
+	}
+	inventoryLog.WithFields(log.Fields{"nic": name, "mac": nic.HardwareAddr, "endpoint_id": endpoint.id}).Warning("Host nic of endpoint disappeared, mark endpoint degraded")
+	endpoint.degraded = true
+	errorsTotal.inc(nicDisappearedError)
+	d.emit(Event{Type: NicDisappeared, Network: endpoint.networkID, Endpoint: endpoint.id, HardwareAddr: nic.HardwareAddr, Nic: name, Reason: "bound nic disappeared"})
+}
+
+// recoverBoundNic clear the degraded mark of endpoint when the bound nic is back to host.
+func (d *HostNicDriver) recoverBoundNic(nic *HostNic, endpoint *Endpoint) {
+	nic.lock.Lock()
+	defer nic.lock.Unlock()
+	if endpoint.degraded {
+		inventoryLog.WithFields(log.Fields{"mac": nic.HardwareAddr, "endpoint_id": endpoint.id}).Info("Host nic of endpoint is back")
+		endpoint.degraded = false
+		d.emit(Event{Type: NicRestored, Network: endpoint.networkID, Endpoint: endpoint.id, HardwareAddr: nic.HardwareAddr})
+	}
+}
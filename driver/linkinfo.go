@@ -0,0 +1,128 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"syscall"
+
+	"github.com/vishvananda/netlink/nl"
+	"github.com/yunify/docker-plugin-hostnic/log"
+)
+
+// iffLowerUp is IFF_LOWER_UP, the driver signals L1 up (carrier).
+const iffLowerUp = 0x10000
+
+// linkStatistics is the head of rtnl_link_stats64, the 32 bits netlink.LinkStatistics wraps every 4GiB.
+type linkStatistics struct {
+	RxPackets uint64
+	TxPackets uint64
+	RxBytes   uint64
+	TxBytes   uint64
+	RxErrors  uint64
+	TxErrors  uint64
+	RxDropped uint64
+	TxDropped uint64
+}
+
+// statistics read the 64 bits counters (IFLA_STATS64) of the link in sandbox.
+func (sb *sandbox) statistics() (*linkStatistics, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETLINK, syscall.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(sb.link.Attrs().Index)
+	req.AddData(msg)
+	msgs, err := sb.query(req, syscall.RTM_NEWLINK)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, fmt.Errorf("Unexpect %d replies of link [%s]", len(msgs), sb.link.Attrs().Name)
+	}
+	attrs, err := nl.ParseRouteAttr(msgs[0][syscall.SizeofIfInfomsg:])
+	if err != nil {
+		return nil, err
+	}
+	for _, attr := range attrs {
+		if attr.Attr.Type != nl.IFLA_STATS64 {
+			continue
+		}
+		stats := &linkStatistics{}
+		if err := binary.Read(bytes.NewReader(attr.Value), nl.NativeEndian(), stats); err != nil {
+			return nil, err
+		}
+		return stats, nil
+	}
+	return nil, fmt.Errorf("No 64 bits statistics of link [%s]", sb.link.Attrs().Name)
+}
+
+// linkInfo add live details and counters of the link in sandbox to endpoint info.
+func linkInfo(logger *log.Entry, sb *sandbox, value map[string]string) {
+	attrs := sb.link.Attrs()
+	value["link.Name"] = attrs.Name
+	value["link.MTU"] = strconv.Itoa(attrs.MTU)
+	if attrs.RawFlags&iffLowerUp != 0 {
+		value["link.Carrier"] = "up"
+	} else {
+		value["link.Carrier"] = "down"
+	}
+	if stats, err := sb.statistics(); err != nil {
+		logger.WithFields(log.Fields{"nic": attrs.Name, "error": err}).Debug("Read statistics of link error")
+	} else {
+		value["link.RxBytes"] = strconv.FormatUint(stats.RxBytes, 10)
+		value["link.RxPackets"] = strconv.FormatUint(stats.RxPackets, 10)
+		value["link.RxErrors"] = strconv.FormatUint(stats.RxErrors, 10)
+		value["link.RxDropped"] = strconv.FormatUint(stats.RxDropped, 10)
+		value["link.TxBytes"] = strconv.FormatUint(stats.TxBytes, 10)
+		value["link.TxPackets"] = strconv.FormatUint(stats.TxPackets, 10)
+		value["link.TxErrors"] = strconv.FormatUint(stats.TxErrors, 10)
+		value["link.TxDropped"] = strconv.FormatUint(stats.TxDropped, 10)
+	}
+
+	fd, err := sb.socket()
+	if err != nil {
+		logger.WithError(err).Error("Create socket in sandbox error")
+		return
+	}
+	defer syscall.Close(fd)
+	info, err := readEthtool(fd, attrs.Name)
+	if err != nil {
+		logger.WithFields(log.Fields{"nic": attrs.Name, "error": err}).Debug("Read ethtool info of link error")
+		return
+	}
+	value["link.Driver"] = info.Driver
+	value["link.BusInfo"] = info.BusInfo
+	if info.Speed != 0 {
+		value["link.Speed"] = strconv.FormatUint(uint64(info.Speed), 10)
+	}
+	if info.Duplex != "" {
+		value["link.Duplex"] = info.Duplex
+	}
+}
+
+// endpointStatistics return the counters of the endpoint nic, in sandbox if joined or in host.
+// It does not take hostNic.lock, so scrapes are not blocked by join or sandbox setup of the nic,
+// a sandbox left meanwhile only fails the lookup of link.
+func endpointStatistics(endpoint *Endpoint) *linkStatistics {
+	sandboxKey, _ := endpoint.joined.Load().(string)
+	var (
+		sb  *sandbox
+		err error
+	)
+	if sandboxKey != "" {
+		sb, err = openSandbox(sandboxKey, endpoint.hostNic.HardwareAddr)
+	} else {
+		sb, err = hostSandbox(endpoint.hostNic.HardwareAddr)
+	}
+	if err != nil {
+		driverLog.WithFields(log.Fields{"endpoint_id": endpoint.id, "mac": endpoint.hostNic.HardwareAddr, "error": err}).Debug("Get link of endpoint error")
+		return nil
+	}
+	defer sb.Close()
+	stats, err := sb.statistics()
+	if err != nil {
+		driverLog.WithFields(log.Fields{"endpoint_id": endpoint.id, "mac": endpoint.hostNic.HardwareAddr, "error": err}).Debug("Read statistics of endpoint error")
+		return nil
+	}
+	return stats
+}
@@ -0,0 +1,237 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yunify/docker-plugin-hostnic/log"
+)
+
+// metadataTimeout is the timeout of requests to metadata service.
+const metadataTimeout = 10 * time.Second
+
+// Metadata is the document of metadata service, which lists the cloud subnets of nics attached to the host.
+type Metadata struct {
+	Nics []NicMetadata
+}
+
+// NicMetadata is the cloud subnet and private ip of a nic.
+type NicMetadata struct {
+	HardwareAddr string
+	Subnet       string `json:",omitempty"` // cloud subnet id, e.g., vxnet-abc123
+	CIDR         string // e.g., 192.168.1.0/24
+	PrivateIP    string `json:",omitempty"`
+	Gateway      string `json:",omitempty"` // e.g., 192.168.1.1
+}
+
+// LoadMetadata read metadata from the url of metadata service, or the local json file for offline use.
+func LoadMetadata(source string) (*Metadata, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		data, err = fetchMetadata(source)
+	} else {
+		data, err = ioutil.ReadFile(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &Metadata{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("Parse metadata of [%s] error: %s", source, err.Error())
+	}
+	for i := range m.Nics {
+		if err := m.Nics[i].normalize(); err != nil {
+			return nil, fmt.Errorf("Invalid metadata of [%s]: %s", source, err.Error())
+		}
+	}
+	return m, nil
+}
+
+func fetchMetadata(url string) ([]byte, error) {
+	client := &http.Client{Timeout: metadataTimeout}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Get metadata [%s] error: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// normalize the hardware addr and cidr, so they can be compared with nics and pools.
+func (m *NicMetadata) normalize() error {
+	mac, err := net.ParseMAC(m.HardwareAddr)
+	if err != nil {
+		return fmt.Errorf("invalid hardware addr [%s] of nic", m.HardwareAddr)
+	}
+	m.HardwareAddr = mac.String()
+	_, subnet, err := net.ParseCIDR(m.CIDR)
+	if err != nil {
+		return fmt.Errorf("invalid cidr [%s] of nic [%s]", m.CIDR, m.HardwareAddr)
+	}
+	m.CIDR = subnet.String()
+	if m.PrivateIP != "" && !subnet.Contains(net.ParseIP(m.PrivateIP)) {
+		return fmt.Errorf("private ip [%s] of nic [%s] is not in cidr [%s]", m.PrivateIP, m.HardwareAddr, m.CIDR)
+	}
+	return nil
+}
+
+// address return the private ip with prefix length of cidr, e.g., 192.168.1.5/24
+func (m *NicMetadata) address() string {
+	_, subnet, _ := net.ParseCIDR(m.CIDR)
+	ones, _ := subnet.Mask.Size()
+	return fmt.Sprintf("%s/%d", m.PrivateIP, ones)
+}
+
+// matchNetwork return whether the nic is on the cloud subnet of network, by vxnet option or pool.
+func (m *NicMetadata) matchNetwork(nw *Network) bool {
+	if nw.VxNet != "" && m.Subnet != "" {
+		return nw.VxNet == m.Subnet
+	}
+	if nw.IPv4Data == nil {
+		return false
+	}
+	_, pool, err := net.ParseCIDR(nw.IPv4Data.Pool)
+	return err == nil && pool.String() == m.CIDR
+}
+
+// setMetadata label nics in table with their cloud subnets, nics added later are labeled when they appear.
+func (t *NicTable) setMetadata(m *Metadata) {
+	t.metadata = make(map[string]*NicMetadata, len(m.Nics))
+	for i := range m.Nics {
+		t.metadata[m.Nics[i].HardwareAddr] = &m.Nics[i]
+	}
+	for _, nic := range t.byAddr {
+		nic.Cloud = t.metadata[nic.HardwareAddr]
+	}
+}
+
+// SetMetadata label nics by the metadata source, and read it again every interval (0 to disable) until shutdown.
+// The source is the url of metadata service or a local json file, it must be readable at start.
+func (d *HostNicDriver) SetMetadata(source string, interval time.Duration) error {
+	m, err := LoadMetadata(source)
+	if err != nil {
+		return err
+	}
+	d.lock.Lock()
+	d.nics.setMetadata(m)
+	d.lock.Unlock()
+	inventoryLog.WithFields(log.Fields{"source": source}).Info("Label %d nics by metadata", len(m.Nics))
+	if interval > 0 {
+		d.watchers.Add(1)
+		go d.refreshMetadata(source, interval)
+	}
+	return nil
+}
+
+func (d *HostNicDriver) refreshMetadata(source string, interval time.Duration) {
+	defer d.watchers.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	logger := inventoryLog.WithFields(log.Fields{"source": source})
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+		m, err := LoadMetadata(source)
+		if err != nil {
+			logger.WithError(err).Warning("Refresh metadata error, keep the labels of nics")
+			continue
+		}
+		d.lock.Lock()
+		d.nics.setMetadata(m)
+		d.lock.Unlock()
+		logger.Debug("Label %d nics by metadata", len(m.Nics))
+	}
+}
+
+// findNicByMetadata return a free nic on the cloud subnet of network with the private ip of address,
+// or the first free nic on the subnet and its private address if address is empty. Return nil if no nic matches.
+// Default ipam of docker always assigns an address, the error lists the private ips of free nics on the subnet
+// if none of them is the address, so the user can pass one by --ip.
+func (d *HostNicDriver) findNicByMetadata(nw *Network, address string) (*HostNic, string, error) {
+	ip := ""
+	if address != "" {
+		ip = addressIP(address)
+	}
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	var matches, free []*HostNic
+	for _, nic := range d.nics.Nics() {
+		if nic.Cloud == nil || nic.endpoint != nil || nic.Index == 0 || d.isProtected(nic) || !nic.Cloud.matchNetwork(nw) {
+			continue
+		}
+		if nic.Cloud.PrivateIP == "" {
+			continue
+		}
+		free = append(free, nic)
+		if ip != "" && nic.Cloud.PrivateIP != ip {
+			continue
+		}
+		matches = append(matches, nic)
+	}
+	if len(matches) == 0 {
+		if len(free) == 0 {
+			return nil, "", nil
+		}
+		sort.Sort(hostNicByName(free))
+		var ips []string
+		for _, nic := range free {
+			ips = append(ips, nic.Cloud.PrivateIP)
+		}
+		return nil, "", fmt.Errorf("Address [%s] is not the private ip of any free nic on the cloud subnet, run the container with --ip of a free nic [%s]", ip, strings.Join(ips, ", "))
+	}
+	sort.Sort(hostNicByName(matches))
+	if address == "" {
+		address = matches[0].Cloud.address()
+	}
+	return matches[0], address, nil
+}
+
+// MetadataNetworkCommands return docker network create commands of the cloud subnets in metadata.
+func MetadataNetworkCommands(m *Metadata, driverName string) []string {
+	subnets := make(map[string]NicMetadata)
+	var names []string
+	for _, nic := range m.Nics {
+		name := nic.Subnet
+		if name == "" {
+			name = nic.CIDR
+		}
+		if _, ok := subnets[name]; !ok {
+			names = append(names, name)
+		}
+		if exist, ok := subnets[name]; !ok || exist.Gateway == "" {
+			subnets[name] = nic
+		}
+	}
+	sort.Strings(names)
+	var commands []string
+	for _, name := range names {
+		nic := subnets[name]
+		args := []string{"docker network create -d", driverName, "--subnet=" + nic.CIDR}
+		if nic.Gateway != "" {
+			args = append(args, "--gateway="+nic.Gateway)
+		}
+		if nic.Subnet != "" {
+			args = append(args, "-o", vxnetOption+"="+nic.Subnet)
+		}
+		commands = append(commands, strings.Join(append(args, strings.Replace(name, "/", "_", -1)), " "))
+	}
+	return commands
+}
@@ -0,0 +1,350 @@
+package driver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/network"
+)
+
+// error types of hostnic_errors_total.
+const (
+	findNicError        = "find_nic"
+	saveConfigError     = "save_config"
+	nicDisappearedError = "nic_disappeared"
+	sandboxSetupError   = "sandbox_setup"
+)
+
+// requestBuckets are the upper bounds (in seconds) of request latency histogram.
+var requestBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	requestsTotal   = newCounterVec("hostnic_requests_total", "Plugin requests by method and outcome.", "method", "outcome")
+	requestDuration = newHistogramVec("hostnic_request_duration_seconds", "Latency of plugin requests by method and outcome.", requestBuckets, "method", "outcome")
+	errorsTotal     = newCounterVec("hostnic_errors_total", "Driver errors by type.", "type")
+)
+
+// counterVec is a counter partitioned by label values, exposed in prometheus text format.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	lock   sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	value  float64
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]*counterValue)}
+}
+
+func (c *counterVec) inc(labels ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := strings.Join(labels, "\xff")
+	v := c.values[key]
+	if v == nil {
+		v = &counterValue{labels: labels}
+		c.values[key] = v
+	}
+	v.value++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := c.values[key]
+		writeSample(w, c.name, c.labels, v.labels, v.value)
+	}
+}
+
+// histogramVec is a histogram partitioned by label values, exposed in prometheus text format.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64 // not cumulative, the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogramValue)}
+}
+
+func (h *histogramVec) observe(value float64, labels ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	key := strings.Join(labels, "\xff")
+	v := h.values[key]
+	if v == nil {
+		v = &histogramValue{labels: labels, counts: make([]uint64, len(h.buckets)+1)}
+		h.values[key] = v
+	}
+	v.counts[sort.SearchFloat64s(h.buckets, value)]++
+	v.sum += value
+	v.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	labels := append(append([]string{}, h.labels...), "le")
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := h.values[key]
+		var cumulative uint64
+		for i, count := range v.counts {
+			cumulative += count
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			writeSample(w, h.name+"_bucket", labels, append(append([]string{}, v.labels...), formatFloat(le)), float64(cumulative))
+		}
+		writeSample(w, h.name+"_sum", h.labels, v.labels, v.sum)
+		writeSample(w, h.name+"_count", h.labels, v.labels, float64(v.count))
+	}
+}
+
+func writeHeader(w io.Writer, name string, help string, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func writeSample(w io.Writer, name string, labels []string, values []string, value float64) {
+	io.WriteString(w, name)
+	if len(labels) > 0 {
+		pairs := make([]string, len(labels))
+		for i, label := range labels {
+			pairs[i] = fmt.Sprintf(`%s="%s"`, label, escapeLabel(values[i]))
+		}
+		fmt.Fprintf(w, "{%s}", strings.Join(pairs, ","))
+	}
+	fmt.Fprintf(w, " %s\n", formatFloat(value))
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// observeRequest count the request of driver method, and its latency.
+func observeRequest(method string, start time.Time, err *error) {
+	outcome := "success"
+	if *err != nil {
+		outcome = "error"
+	}
+	requestsTotal.inc(method, outcome)
+	requestDuration.observe(time.Since(start).Seconds(), method, outcome)
+}
+
+// MetricsDriver wrap the driver to count requests and latency of every network.Driver method.
+type MetricsDriver struct {
+	*HostNicDriver
+}
+
+func NewMetricsDriver(d *HostNicDriver) *MetricsDriver {
+	return &MetricsDriver{HostNicDriver: d}
+}
+
+func (d *MetricsDriver) GetCapabilities() (resp *network.CapabilitiesResponse, err error) {
+	defer observeRequest("GetCapabilities", time.Now(), &err)
+	return d.HostNicDriver.GetCapabilities()
+}
+
+func (d *MetricsDriver) CreateNetwork(r *network.CreateNetworkRequest) (err error) {
+	defer observeRequest("CreateNetwork", time.Now(), &err)
+	return d.HostNicDriver.CreateNetwork(r)
+}
+
+func (d *MetricsDriver) AllocateNetwork(r *network.AllocateNetworkRequest) (resp *network.AllocateNetworkResponse, err error) {
+	defer observeRequest("AllocateNetwork", time.Now(), &err)
+	return d.HostNicDriver.AllocateNetwork(r)
+}
+
+func (d *MetricsDriver) DeleteNetwork(r *network.DeleteNetworkRequest) (err error) {
+	defer observeRequest("DeleteNetwork", time.Now(), &err)
+	return d.HostNicDriver.DeleteNetwork(r)
+}
+
+func (d *MetricsDriver) FreeNetwork(r *network.FreeNetworkRequest) (err error) {
+	defer observeRequest("FreeNetwork", time.Now(), &err)
+	return d.HostNicDriver.FreeNetwork(r)
+}
+
+func (d *MetricsDriver) CreateEndpoint(r *network.CreateEndpointRequest) (resp *network.CreateEndpointResponse, err error) {
+	defer observeRequest("CreateEndpoint", time.Now(), &err)
+	return d.HostNicDriver.CreateEndpoint(r)
+}
+
+func (d *MetricsDriver) DeleteEndpoint(r *network.DeleteEndpointRequest) (err error) {
+	defer observeRequest("DeleteEndpoint", time.Now(), &err)
+	return d.HostNicDriver.DeleteEndpoint(r)
+}
+
+func (d *MetricsDriver) EndpointInfo(r *network.InfoRequest) (resp *network.InfoResponse, err error) {
+	defer observeRequest("EndpointInfo", time.Now(), &err)
+	return d.HostNicDriver.EndpointInfo(r)
+}
+
+func (d *MetricsDriver) Join(r *network.JoinRequest) (resp *network.JoinResponse, err error) {
+	defer observeRequest("Join", time.Now(), &err)
+	return d.HostNicDriver.Join(r)
+}
+
+func (d *MetricsDriver) Leave(r *network.LeaveRequest) (err error) {
+	defer observeRequest("Leave", time.Now(), &err)
+	return d.HostNicDriver.Leave(r)
+}
+
+func (d *MetricsDriver) DiscoverNew(r *network.DiscoveryNotification) (err error) {
+	defer observeRequest("DiscoverNew", time.Now(), &err)
+	return d.HostNicDriver.DiscoverNew(r)
+}
+
+func (d *MetricsDriver) DiscoverDelete(r *network.DiscoveryNotification) (err error) {
+	defer observeRequest("DiscoverDelete", time.Now(), &err)
+	return d.HostNicDriver.DiscoverDelete(r)
+}
+
+func (d *MetricsDriver) ProgramExternalConnectivity(r *network.ProgramExternalConnectivityRequest) (err error) {
+	defer observeRequest("ProgramExternalConnectivity", time.Now(), &err)
+	return d.HostNicDriver.ProgramExternalConnectivity(r)
+}
+
+func (d *MetricsDriver) RevokeExternalConnectivity(r *network.RevokeExternalConnectivityRequest) (err error) {
+	defer observeRequest("RevokeExternalConnectivity", time.Now(), &err)
+	return d.HostNicDriver.RevokeExternalConnectivity(r)
+}
+
+// NewMetricsHandler return the handler expose metrics in prometheus text format on /metrics.
+func NewMetricsHandler(d *HostNicDriver) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(rw http.ResponseWriter, r *http.Request) {
+		httpLog.Debug("Metrics request from [%s]", r.RemoteAddr)
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w := bufio.NewWriter(rw)
+		defer w.Flush()
+		requestsTotal.write(w)
+		requestDuration.write(w)
+		errorsTotal.write(w)
+		d.writeMetrics(w)
+	})
+	return mux
+}
+
+// writeMetrics write gauges of networks and nics, and traffic counters of endpoint nics.
+func (d *HostNicDriver) writeMetrics(w io.Writer) {
+	networks := d.networkList()
+	writeHeader(w, "hostnic_networks", "Networks of driver.", "gauge")
+	writeSample(w, "hostnic_networks", nil, nil, float64(len(networks)))
+
+	writeHeader(w, "hostnic_endpoints", "Endpoints by network.", "gauge")
+	endpoints := make(map[string][]*Endpoint)
+	for _, nw := range networks {
+		endpoints[nw.ID] = nw.endpointList()
+		writeSample(w, "hostnic_endpoints", []string{"network"}, []string{nw.ID}, float64(len(endpoints[nw.ID])))
+	}
+
+	d.lock.RLock()
+	var free, bound int
+	for _, nic := range d.nics.Nics() {
+		if nic.endpoint != nil {
+			bound++
+		} else if nic.Index != 0 {
+			free++
+		}
+	}
+	// nics of network are the nics bound to its endpoints, and the free nics mapped by its ip map.
+	networkFree := make(map[string]int)
+	for _, nw := range networks {
+		for _, mapped := range nw.IPMap {
+			var nic *HostNic
+			if _, err := net.ParseMAC(mapped); err == nil {
+				nic = d.nics.ByHardwareAddr(mapped)
+			} else {
+				nic = d.nics.ByName(mapped)
+			}
+			if nic != nil && nic.endpoint == nil && nic.Index != 0 {
+				networkFree[nw.ID]++
+			}
+		}
+	}
+	d.lock.RUnlock()
+	writeHeader(w, "hostnic_nics", "Host nics in nic table by state.", "gauge")
+	writeSample(w, "hostnic_nics", []string{"state"}, []string{"free"}, float64(free))
+	writeSample(w, "hostnic_nics", []string{"state"}, []string{"bound"}, float64(bound))
+	writeHeader(w, "hostnic_network_nics", "Host nics of network by state, free nics are the ones mapped by ip map.", "gauge")
+	for _, nw := range networks {
+		writeSample(w, "hostnic_network_nics", []string{"network", "state"}, []string{nw.ID, "free"}, float64(networkFree[nw.ID]))
+		writeSample(w, "hostnic_network_nics", []string{"network", "state"}, []string{nw.ID, "bound"}, float64(len(endpoints[nw.ID])))
+	}
+
+	type traffic struct {
+		labels []string
+		stats  [8]uint64
+	}
+	var samples []traffic
+	for _, nw := range networks {
+		for _, endpoint := range endpoints[nw.ID] {
+			if stats := endpointStatistics(endpoint); stats != nil {
+				samples = append(samples, traffic{
+					labels: []string{nw.ID, endpoint.id, endpoint.hostNic.HardwareAddr},
+					stats: [8]uint64{
+						stats.RxBytes, stats.RxPackets, stats.RxErrors, stats.RxDropped,
+						stats.TxBytes, stats.TxPackets, stats.TxErrors, stats.TxDropped,
+					},
+				})
+			}
+		}
+	}
+	names := []string{
+		"receive_bytes", "receive_packets", "receive_errors", "receive_dropped",
+		"transmit_bytes", "transmit_packets", "transmit_errors", "transmit_dropped",
+	}
+	for i, name := range names {
+		metric := "hostnic_endpoint_" + name + "_total"
+		writeHeader(w, metric, "Nic "+strings.Replace(name, "_", " ", -1)+" of endpoint.", "counter")
+		for _, sample := range samples {
+			writeSample(w, metric, []string{"network", "endpoint", "nic"}, sample.labels, float64(sample.stats[i]))
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/yunify/docker-plugin-hostnic/log"
+)
+
+// sysClassNet is the sysfs dir of network interfaces.
+var sysClassNet = "/sys/class/net"
+
+// NicInfo is the hardware details of a host nic which can be bound, read from netlink, ethtool and sysfs.
+type NicInfo struct {
+	Name             string
+	HardwareAddr     string
+	PermHardwareAddr string `json:",omitempty"`
+	Driver           string `json:",omitempty"`
+	BusInfo          string `json:",omitempty"` // pci address for pci device
+	Speed            uint32 `json:",omitempty"` // Mb/s
+	Carrier          string
+	NumaNode         int          // -1 if unknown
+	PhysicalFunction string       `json:",omitempty"` // pf name if the nic is a SR-IOV VF
+	VirtualFunctions []string     `json:",omitempty"` // vf names if the nic is a SR-IOV PF
+	Addresses        []string     `json:",omitempty"`
+	Protected        bool         `json:",omitempty"`
+	Endpoint         string       `json:",omitempty"`
+	Network          string       `json:",omitempty"`
+	Sandbox          string       `json:",omitempty"` // sandbox of the endpoint the nic is moved into
+	Cloud            *NicMetadata `json:",omitempty"` // cloud subnet from metadata of running plugin
+}
+
+// ListNics return details of all host nics in the nic table, that is nics the driver could bind, sorted by name.
+func ListNics() ([]NicInfo, error) {
+	links, err := hostLinks()
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	var result []NicInfo
+	for _, link := range links {
+		result = append(result, nicInfo(fd, link))
+	}
+	sort.Sort(nicInfoByName(result))
+	return result, nil
+}
+
+func nicInfo(fd int, link netlink.Link) NicInfo {
+	attrs := link.Attrs()
+	info := NicInfo{Name: attrs.Name, HardwareAddr: attrs.HardwareAddr.String(), Carrier: "down", NumaNode: numaNode(attrs.Name)}
+	if attrs.RawFlags&iffLowerUp != 0 {
+		info.Carrier = "up"
+	}
+	logger := inventoryLog.WithFields(log.Fields{"nic": attrs.Name})
+	if ethtoolInfo, err := readEthtool(fd, attrs.Name); err == nil {
+		info.Driver = ethtoolInfo.Driver
+		info.BusInfo = ethtoolInfo.BusInfo
+		info.Speed = ethtoolInfo.Speed
+	} else {
+		logger.WithError(err).Debug("Read ethtool info of link error")
+	}
+	if permAddr, err := readPermAddr(fd, attrs.Name); err == nil {
+		info.PermHardwareAddr = permAddr
+	} else {
+		logger.WithError(err).Debug("Read permanent addr of link error")
+	}
+	info.PhysicalFunction, info.VirtualFunctions = sriovFunctions(attrs.Name)
+	if addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL); err == nil {
+		for _, addr := range addrs {
+			info.Addresses = append(info.Addresses, addr.IPNet.String())
+		}
+	} else {
+		logger.WithError(err).Debug("List addrs of link error")
+	}
+	return info
+}
+
+// numaNode return numa node of the nic device, -1 if unknown.
+func numaNode(name string) int {
+	data, err := ioutil.ReadFile(filepath.Join(sysClassNet, name, "device", "numa_node"))
+	if err != nil {
+		return -1
+	}
+	node, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1
+	}
+	return node
+}
+
+// sriovFunctions return the pf name if the nic is a SR-IOV VF, and vf names if it is a PF.
+// A function without net device (e.g., bound to vfio) is named by its pci address.
+func sriovFunctions(name string) (pf string, vfs []string) {
+	device := filepath.Join(sysClassNet, name, "device")
+	if _, err := os.Stat(filepath.Join(device, "physfn")); err == nil {
+		pf = functionName(filepath.Join(device, "physfn"))
+	}
+	virtfns, _ := filepath.Glob(filepath.Join(device, "virtfn*"))
+	sort.Sort(virtfnByIndex(virtfns))
+	for _, virtfn := range virtfns {
+		vfs = append(vfs, functionName(virtfn))
+	}
+	return pf, vfs
+}
+
+// functionName return the net device name of the pci function, or its pci address.
+func functionName(function string) string {
+	names, err := ioutil.ReadDir(filepath.Join(function, "net"))
+	if err == nil && len(names) > 0 {
+		return names[0].Name()
+	}
+	if target, err := filepath.EvalSymlinks(function); err == nil {
+		return filepath.Base(target)
+	}
+	return filepath.Base(function)
+}
+
+type nicInfoByName []NicInfo
+
+func (s nicInfoByName) Len() int           { return len(s) }
+func (s nicInfoByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s nicInfoByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// virtfnByIndex sort virtfn links by index, e.g., virtfn2 before virtfn10.
+type virtfnByIndex []string
+
+func (s virtfnByIndex) Len() int      { return len(s) }
+func (s virtfnByIndex) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s virtfnByIndex) Less(i, j int) bool {
+	return virtfnIndex(s[i]) < virtfnIndex(s[j])
+}
+
+func virtfnIndex(path string) int {
+	index, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(path), "virtfn"))
+	return index
+}
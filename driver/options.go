@@ -0,0 +1,81 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// genericOptionKey is the key docker uses to pass the driver options (-o) of network create.
+	genericOptionKey = "com.docker.network.generic"
+
+	// ipMapOption maps container ip to host nic, e.g., -o ipmap=192.168.1.5=52:54:0e:e5:00:f7,192.168.1.6=eth2
+	ipMapOption = "ipmap"
+)
+
+// genericOptions returns the driver options passed by docker network create -o.
+func genericOptions(options map[string]interface{}) map[string]string {
+	result := make(map[string]string)
+	if options == nil {
+		return result
+	}
+	generic, ok := options[genericOptionKey].(map[string]interface{})
+	if !ok {
+		return result
+	}
+	for k, v := range generic {
+		result[k] = fmt.Sprintf("%v", v)
+	}
+	return result
+}
+
+// endpointOptions returns the driver options of endpoint, e.g., docker network connect --driver-opt.
+// docker put them at the top level of options, generic options are merged too.
+func endpointOptions(options map[string]interface{}) map[string]string {
+	result := genericOptions(options)
+	for k, v := range options {
+		if s, ok := v.(string); ok {
+			result[k] = s
+		}
+	}
+	return result
+}
+
+// parseIPMap parse ip map option, the value of every entry is the hardware addr or name of the host nic.
+func parseIPMap(value string) (map[string]string, error) {
+	ipMap := make(map[string]string)
+	if strings.TrimSpace(value) == "" {
+		return ipMap, nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("Invalid %s entry [%s], expect ip=mac or ip=name", ipMapOption, entry)
+		}
+		ip := net.ParseIP(kv[0])
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid ip [%s] in %s entry [%s]", kv[0], ipMapOption, entry)
+		}
+		nic := kv[1]
+		if hwAddr, err := net.ParseMAC(nic); err == nil {
+			nic = hwAddr.String()
+		}
+		if exist, ok := ipMap[ip.String()]; ok {
+			return nil, fmt.Errorf("Duplicate ip [%s] in %s, mapped to [%s] and [%s]", ip.String(), ipMapOption, exist, nic)
+		}
+		ipMap[ip.String()] = nic
+	}
+	return ipMap, nil
+}
+
+// addressIP return the ip of address, address may be a cidr, e.g., 192.168.1.5/24
+func addressIP(address string) string {
+	if ip, _, err := net.ParseCIDR(address); err == nil {
+		return ip.String()
+	}
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.String()
+	}
+	return address
+}
@@ -0,0 +1,106 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/yunify/docker-plugin-hostnic/log"
+)
+
+const (
+	// vxnetOption is the cloud network nics are provisioned on when no host nic matches the endpoint, e.g., -o vxnet=vxnet-abc123
+	vxnetOption = "vxnet"
+
+	// DefaultProvisionTimeout is the default max time from a create endpoint request to the provisioned nic appears on host.
+	// It must be well inside the timeout of docker plugin calls (30s), docker fails the request after it.
+	DefaultProvisionTimeout = 20 * time.Second
+
+	// dockerPluginTimeout is the timeout of docker plugin calls.
+	dockerPluginTimeout = 30 * time.Second
+
+	// provisionSyncInterval is the interval to sync nic table while waiting a provisioned nic,
+	// events of the nic may be dropped by a slow subscriber channel.
+	provisionSyncInterval = time.Second
+)
+
+// NicProvider creates nics on cloud networks and attaches them to this host.
+type NicProvider interface {
+	// CreateNic create a nic on the vxnet with the ip (empty to allocate by cloud), attach it to this host,
+	// and return its hardware addr. The nic should be deleted if it can not be attached.
+	CreateNic(vxnet string, ip string, name string) (string, error)
+	// DeleteNic detach the nic from this host and delete it.
+	DeleteNic(hardwareAddr string) error
+}
+
+// SetNicProvider provision nics by the provider for endpoints of networks with vxnet option,
+// it must be called before serving plugin api.
+func (d *HostNicDriver) SetNicProvider(provider NicProvider, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultProvisionTimeout
+	}
+	if timeout >= dockerPluginTimeout {
+		log.Warning("Provision timeout [%s] is not less than docker plugin timeout [%s], docker may fail requests of nics provisioned at last", timeout, dockerPluginTimeout)
+	}
+	d.provider = provider
+	d.provisionTimeout = timeout
+}
+
+// provisionNic create a nic on the vxnet of network, and wait it appears in nic table.
+// The nic is deleted if it does not appear before provision timeout from the request, so docker never misses a nic
+// the plugin provisioned after its request timeout.
+func (d *HostNicDriver) provisionNic(logger *log.Entry, nw *Network, endpointID string, address string) (*HostNic, error) {
+	deadline := time.Now().Add(d.provisionTimeout)
+	// subscribe before create, so the event of the nic is not missed.
+	ch := d.Subscribe()
+	defer d.Unsubscribe(ch)
+	ip := ""
+	if address != "" {
+		ip = addressIP(address)
+	}
+	hardwareAddr, err := d.provider.CreateNic(nw.VxNet, ip, provisionedNicName(endpointID))
+	if err != nil {
+		return nil, fmt.Errorf("Provision nic on vxnet [%s] error: %s", nw.VxNet, err.Error())
+	}
+	if mac, err := net.ParseMAC(hardwareAddr); err == nil {
+		hardwareAddr = mac.String()
+	}
+	logger = logger.WithFields(log.Fields{"mac": hardwareAddr, "vxnet": nw.VxNet})
+	logger.Info("Nic is provisioned, wait it appears on host")
+	timer := time.NewTimer(deadline.Sub(time.Now()))
+	defer timer.Stop()
+	ticker := time.NewTicker(provisionSyncInterval)
+	defer ticker.Stop()
+	for {
+		if !time.Now().Before(deadline) {
+			d.deprovisionNic(logger, hardwareAddr)
+			return nil, fmt.Errorf("Provisioned nic [%s] does not appear on host in %s", hardwareAddr, d.provisionTimeout)
+		}
+		if hostNic := d.FindNicByHardwareAddr(hardwareAddr); hostNic != nil {
+			return hostNic, nil
+		}
+		select {
+		case <-ch:
+		case <-ticker.C:
+			d.syncNics()
+		case <-timer.C:
+		}
+	}
+}
+
+// deprovisionNic detach and delete the provisioned nic, errors are logged.
+func (d *HostNicDriver) deprovisionNic(logger *log.Entry, hardwareAddr string) {
+	if err := d.provider.DeleteNic(hardwareAddr); err != nil {
+		logger.WithError(err).Error("Delete provisioned nic [%s] error, please delete it by cloud console", hardwareAddr)
+		return
+	}
+	logger.Info("Provisioned nic [%s] is deleted", hardwareAddr)
+}
+
+// provisionedNicName return the cloud name of nic provisioned for the endpoint.
+func provisionedNicName(endpointID string) string {
+	if len(endpointID) > 12 {
+		endpointID = endpointID[:12]
+	}
+	return "hostnic-" + endpointID
+}
@@ -0,0 +1,39 @@
+package driver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+
+	"github.com/yunify/docker-plugin-hostnic/log"
+)
+
+// newRequestID return a random id to correlate the log lines of a plugin request.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startRequest return the logger of plugin request with request id and fields, and the func to log the result.
+//
+//	logger, finish := d.startRequest("Join", log.Fields{"network_id": r.NetworkID})
+//	defer finish(&err)
+//
+// The request is in flight until the result is logged.
+func (d *HostNicDriver) startRequest(method string, fields log.Fields) (*log.Entry, func(err *error)) {
+	atomic.AddInt64(&d.requests, 1)
+	start := time.Now()
+	logger := driverLog.WithFields(fields).WithFields(log.Fields{"request_id": newRequestID(), "method": method})
+	logger.Debug("%s called", method)
+	return logger, func(err *error) {
+		defer atomic.AddInt64(&d.requests, -1)
+		logger := logger.WithField("duration", time.Since(start).Seconds())
+		if *err != nil {
+			logger.WithError(*err).Error("%s failed", method)
+		} else {
+			logger.Debug("%s finished", method)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+)
+
+const (
+	// policyRoutingOption install source based routing in sandbox, so replies leave by the nic they arrived on,
+	// e.g., -o policy_routing=true, endpoints can override it by --driver-opt.
+	policyRoutingOption = "policy_routing"
+
+	// policyRoutingPriority is the priority of rules, before the rule of main table (32766).
+	policyRoutingPriority = 1000
+	// policyRoutingTableBase is added to the ifindex of nic in sandbox as the routing table of nic.
+	policyRoutingTableBase = 1000
+)
+
+// parsePolicyRouting parse policy routing option, return defaultValue if the option is not set.
+func parsePolicyRouting(options map[string]string, defaultValue bool) (bool, error) {
+	v, ok := options[policyRoutingOption]
+	if !ok {
+		return defaultValue, nil
+	}
+	enabled, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("Invalid %s [%s]: %s", policyRoutingOption, v, err.Error())
+	}
+	return enabled, nil
+}
+
+// endpointIPv4 return the ipv4 address of endpoint with its subnet, nil if the endpoint has no ipv4 address.
+func endpointIPv4(endpoint *Endpoint) (net.IP, *net.IPNet) {
+	for _, address := range endpoint.addresses {
+		ip, subnet, err := net.ParseCIDR(address)
+		if err == nil && ip.To4() != nil {
+			return ip, subnet
+		}
+	}
+	return nil, nil
+}
+
+// waitLinkAddress wait docker configure the ip on the link and bring it up, routes via the link need both.
+// Only wait the link is up if ip is nil.
+func (sb *sandbox) waitLinkAddress(ip net.IP) error {
+	deadline := time.Now().Add(sandboxLinkTimeout)
+	for {
+		link, err := sb.handle.LinkByIndex(sb.link.Attrs().Index)
+		if err != nil {
+			return err
+		}
+		if link.Attrs().Flags&net.FlagUp != 0 {
+			if ip == nil {
+				sb.link = link
+				return nil
+			}
+			addrs, err := sb.handle.AddrList(link, netlink.FAMILY_V4)
+			if err != nil {
+				return err
+			}
+			for _, addr := range addrs {
+				if addr.IP.Equal(ip) {
+					sb.link = link
+					return nil
+				}
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Link [%s] is not up with ip [%s] after %s", link.Attrs().Name, ip, sandboxLinkTimeout)
+		}
+		time.Sleep(sandboxLinkInterval)
+	}
+}
+
+// setupPolicyRouting add the routing table of the nic with subnet and gateway routes,
+// and the rule lookup the table for packets from the endpoint ip. The link must be up with the ip.
+func setupPolicyRouting(sb *sandbox, endpoint *Endpoint, gateway net.IP) error {
+	ip, subnet := endpointIPv4(endpoint)
+	if ip == nil {
+		return fmt.Errorf("Endpoint has no ipv4 address")
+	}
+	index := sb.link.Attrs().Index
+	table := policyRoutingTableBase + index
+	routes := []*netlink.Route{
+		{LinkIndex: index, Dst: subnet, Src: ip, Scope: netlink.SCOPE_LINK, Table: table},
+		{LinkIndex: index, Gw: gateway, Table: table},
+	}
+	for _, route := range routes {
+		if err := sb.handle.RouteAdd(route); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("Add route [%s] error: %s", route, err.Error())
+		}
+	}
+	rule := policyRoutingRule(ip, table)
+	if err := sb.handle.RuleAdd(rule); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Add rule [%s] error: %s", rule, err.Error())
+	}
+	return nil
+}
+
+// policyRoutingRule return the rule lookup the table for packets from ip.
+func policyRoutingRule(ip net.IP, table int) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Priority = policyRoutingPriority
+	rule.Src = &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+	rule.Table = table
+	return rule
+}
+
+// cleanupPolicyRouting remove the rules from the endpoint ip and routes of their tables in sandbox.
+// Routes are removed by kernel if the nic has left sandbox, and nothing is left if the sandbox is gone.
+func cleanupPolicyRouting(sandboxKey string, endpoint *Endpoint) error {
+	ip, _ := endpointIPv4(endpoint)
+	if ip == nil {
+		return nil
+	}
+	ns, err := netns.GetFromPath(sandboxKey)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		ns.Close()
+		return err
+	}
+	sb := &sandbox{ns: ns, handle: handle}
+	defer sb.Close()
+	rules, err := handle.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for _, listed := range rules {
+		if listed.Priority != policyRoutingPriority || listed.Src == nil || !listed.Src.IP.Equal(ip) {
+			continue
+		}
+		routes, err := handle.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: listed.Table}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return err
+		}
+		for i := range routes {
+			if err := handle.RouteDel(&routes[i]); err != nil {
+				return fmt.Errorf("Delete route [%s] error: %s", routes[i], err.Error())
+			}
+		}
+		if err := delRule(sb, policyRoutingRule(ip, listed.Table)); err != nil {
+			return fmt.Errorf("Delete rule [%s] error: %s", &listed, err.Error())
+		}
+	}
+	return nil
+}
+
+// delRule delete the rule with source, priority and table like `ip rule del`,
+// netlink.RuleDel sends NLM_F_CREATE|NLM_F_EXCL which recent kernels refuse, so build the request by hand.
+func delRule(sb *sandbox, rule *netlink.Rule) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_DELRULE, syscall.NLM_F_ACK)
+	msg := nl.NewRtMsg()
+	msg.Family = syscall.AF_INET
+	msg.Table = syscall.RT_TABLE_UNSPEC
+	srcLen, _ := rule.Src.Mask.Size()
+	msg.Src_len = uint8(srcLen)
+	req.AddData(msg)
+	req.AddData(nl.NewRtAttr(nl.FRA_SRC, rule.Src.IP.To4()))
+	native := nl.NativeEndian()
+	b := make([]byte, 4)
+	native.PutUint32(b, uint32(rule.Priority))
+	req.AddData(nl.NewRtAttr(nl.FRA_PRIORITY, b))
+	b = make([]byte, 4)
+	native.PutUint32(b, uint32(rule.Table))
+	req.AddData(nl.NewRtAttr(nl.FRA_TABLE, b))
+	return sb.execute(req)
+}
@@ -0,0 +1,332 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+	"github.com/yunify/docker-plugin-hostnic/log"
+)
+
+const sandboxLinkInterval = 100 * time.Millisecond
+
+// sandboxLinkTimeout is the max time to wait docker moves the nic into sandbox and configures it.
+var sandboxLinkTimeout = 10 * time.Second
+
+// sandbox is the network namespace which the nic of endpoint is in.
+type sandbox struct {
+	ns     netns.NsHandle // netns.None() for host
+	handle *netlink.Handle
+	link   netlink.Link
+}
+
+// openSandbox return the sandbox with the link of hardwareAddr in it.
+func openSandbox(sandboxKey string, hardwareAddr string) (*sandbox, error) {
+	ns, err := netns.GetFromPath(sandboxKey)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		ns.Close()
+		return nil, err
+	}
+	sb := &sandbox{ns: ns, handle: handle}
+	if sb.link, err = findLink(handle, hardwareAddr); err != nil {
+		sb.Close()
+		return nil, fmt.Errorf("%s in sandbox [%s]", err.Error(), sandboxKey)
+	}
+	return sb, nil
+}
+
+// waitSandbox wait docker move the host nic into sandbox after join.
+// The sandbox is checked on every link update of watch (may be nil), and polled in case updates are missed.
+func waitSandbox(sandboxKey string, hardwareAddr string, watch *linkWatch) (*sandbox, error) {
+	deadline := time.Now().Add(sandboxLinkTimeout)
+	var updates <-chan netlink.LinkUpdate
+	if watch != nil {
+		updates = watch.updates
+	}
+	for {
+		sb, err := openSandbox(sandboxKey, hardwareAddr)
+		if err == nil || time.Now().After(deadline) {
+			return sb, err
+		}
+		select {
+		case _, ok := <-updates:
+			if !ok {
+				updates = nil
+			}
+		case <-time.After(sandboxLinkInterval):
+		}
+	}
+}
+
+// linkWatch receive link updates of a sandbox. It is subscribed at join, before docker moves the nic into the sandbox,
+// so settings are applied as soon as the nic arrives, while docker still configures it down.
+// Settings can not be applied before join returns, qdiscs and filters of the nic are dropped when it is moved.
+type linkWatch struct {
+	updates chan netlink.LinkUpdate
+	done    chan struct{}
+}
+
+// watchSandbox subscribe link updates in the sandbox.
+func watchSandbox(sandboxKey string) (*linkWatch, error) {
+	ns, err := netns.GetFromPath(sandboxKey)
+	if err != nil {
+		return nil, err
+	}
+	defer ns.Close()
+	watch := &linkWatch{updates: make(chan netlink.LinkUpdate, 16), done: make(chan struct{})}
+	if err := subscribeLinks(ns, watch.updates, watch.done); err != nil {
+		return nil, err
+	}
+	return watch, nil
+}
+
+// Close stop receiving link updates, watch may be nil.
+func (watch *linkWatch) Close() {
+	if watch != nil {
+		close(watch.done)
+	}
+}
+
+// hostSandbox return the host namespace as sandbox with the link of hardwareAddr.
+func hostSandbox(hardwareAddr string) (*sandbox, error) {
+	handle := &netlink.Handle{}
+	link, err := findLink(handle, hardwareAddr)
+	if err != nil {
+		return nil, fmt.Errorf("%s in host", err.Error())
+	}
+	return &sandbox{ns: netns.None(), handle: handle, link: link}, nil
+}
+
+func findLink(handle *netlink.Handle, hardwareAddr string) (netlink.Link, error) {
+	links, err := handle.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		if link.Attrs().HardwareAddr.String() == hardwareAddr {
+			return link, nil
+		}
+	}
+	return nil, fmt.Errorf("Can not find link [%s]", hardwareAddr)
+}
+
+// Close release the netlink handle and namespace of sandbox.
+func (sb *sandbox) Close() {
+	if sb.ns.IsOpen() {
+		sb.handle.Delete()
+		sb.ns.Close()
+	}
+}
+
+// execute send netlink request in the namespace of sandbox, for requests netlink.Handle not support.
+func (sb *sandbox) execute(req *nl.NetlinkRequest) error {
+	_, err := sb.query(req, 0)
+	return err
+}
+
+// query send netlink request in the namespace of sandbox and return the replies of resType.
+func (sb *sandbox) query(req *nl.NetlinkRequest, resType uint16) ([][]byte, error) {
+	s, err := nl.GetNetlinkSocketAt(sb.ns, netns.None(), syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	req.Sockets = map[int]*nl.SocketHandle{syscall.NETLINK_ROUTE: {Socket: s}}
+	return req.Execute(syscall.NETLINK_ROUTE, resType)
+}
+
+// socket create a socket in the namespace of sandbox, for ioctl on the link.
+func (sb *sandbox) socket() (int, error) {
+	if sb.ns.IsOpen() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		origin, err := netns.Get()
+		if err != nil {
+			return -1, err
+		}
+		defer origin.Close()
+		if err := netns.Set(sb.ns); err != nil {
+			return -1, err
+		}
+		defer netns.Set(origin)
+	}
+	return syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+}
+
+// ensureClsact add clsact qdisc to the link if not exist, ingress and egress filters are attached to it.
+func (sb *sandbox) ensureClsact() error {
+	qdiscs, err := sb.handle.QdiscList(sb.link)
+	if err != nil {
+		return err
+	}
+	for _, qdisc := range qdiscs {
+		if qdisc.Type() == "clsact" {
+			return nil
+		}
+	}
+	return sb.handle.QdiscAdd(&netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: sb.link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	})
+}
+
+// cleanupQdiscs remove qdiscs installed by driver, filters are removed with the qdisc.
+func (sb *sandbox) cleanupQdiscs() error {
+	qdiscs, err := sb.handle.QdiscList(sb.link)
+	if err != nil {
+		return err
+	}
+	for _, qdisc := range qdiscs {
+		if _, ok := qdisc.(*netlink.Tbf); ok || qdisc.Type() == "clsact" {
+			if err := sb.handle.QdiscDel(qdisc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setupSandbox apply endpoint settings to the nic after it is moved into sandbox.
+// Docker moves and configures the nic after join, it is waited without the lock of nic,
+// so leave and status of the endpoint are not blocked. Settings are applied with the lock,
+// if the endpoint is still in the sandbox.
+// If any setting can not be applied, the endpoint is marked degraded with the error.
+// Anti spoof fails closed, the link is set down if its filters can not be installed.
+func (d *HostNicDriver) setupSandbox(logger *log.Entry, endpoint *Endpoint, sandboxKey string, gateway net.IP, watch *linkWatch) {
+	defer watch.Close()
+	// locked run f with the lock of nic, return false if the endpoint has left the sandbox.
+	locked := func(f func()) bool {
+		endpoint.hostNic.lock.Lock()
+		defer endpoint.hostNic.lock.Unlock()
+		if endpoint.sandboxKey != sandboxKey {
+			return false
+		}
+		f()
+		return true
+	}
+	var errs []string
+	failed := func() {
+		d.sandboxSetupFailed(logger, endpoint, fmt.Errorf("%s", strings.Join(errs, "; ")))
+	}
+	sb, err := waitSandbox(sandboxKey, endpoint.hostNic.HardwareAddr, watch)
+	if err != nil {
+		errs = append(errs, err.Error())
+		locked(failed)
+		return
+	}
+	defer sb.Close()
+
+	antiSpoofFailed := false
+	if !locked(func() {
+		if endpoint.antiSpoof {
+			if err := setupAntiSpoof(sb, endpoint); err != nil {
+				errs = append(errs, "anti spoof: "+err.Error())
+				antiSpoofFailed = true
+				return
+			}
+			logger.Info("Setup endpoint anti spoof")
+		}
+		if endpoint.bandwidth != nil {
+			if err := setupBandwidth(sb, endpoint.bandwidth); err != nil {
+				errs = append(errs, "bandwidth: "+err.Error())
+			} else {
+				logger.Info("Setup endpoint bandwidth [%+v]", *endpoint.bandwidth)
+			}
+		}
+	}) {
+		// left before setup
+		return
+	}
+	if antiSpoofFailed {
+		// set the link down after docker brings it up, so the container can not send packets by it.
+		if err := sb.waitLinkAddress(nil); err != nil {
+			logger.WithError(err).Debug("Wait link up before setting it down error")
+		}
+		locked(func() {
+			if err := sb.handle.LinkSetDown(sb.link); err != nil {
+				errs = append(errs, "set link down: "+err.Error())
+			} else {
+				logger.Warning("Set link down in sandbox, anti spoof filters are not installed")
+			}
+			failed()
+		})
+		return
+	}
+	if endpoint.policyRouting {
+		// routes via the link need docker configures the ip on the link and brings it up.
+		ip, _ := endpointIPv4(endpoint)
+		var err error
+		if ip != nil {
+			err = sb.waitLinkAddress(ip)
+		}
+		if !locked(func() {
+			if err == nil {
+				err = setupPolicyRouting(sb, endpoint, gateway)
+			}
+			if err != nil {
+				errs = append(errs, "policy routing: "+err.Error())
+			} else {
+				logger.Info("Setup endpoint policy routing via gateway [%s]", gateway)
+			}
+		}) {
+			return
+		}
+	}
+	if len(errs) > 0 {
+		locked(failed)
+	}
+}
+
+// sandboxSetupFailed mark the endpoint degraded by the error of sandbox setup, caller must hold the lock of nic.
+func (d *HostNicDriver) sandboxSetupFailed(logger *log.Entry, endpoint *Endpoint, err error) {
+	logger.WithError(err).Error("Setup endpoint in sandbox error, mark endpoint degraded")
+	endpoint.setupError = err.Error()
+	errorsTotal.inc(sandboxSetupError)
+	d.emit(Event{Type: EndpointDegraded, Network: endpoint.networkID, Endpoint: endpoint.id, HardwareAddr: endpoint.hostNic.HardwareAddr,
+		Nic: endpoint.srcName, Sandbox: endpoint.sandboxKey, Reason: err.Error()})
+}
+
+// cleanupSandbox remove endpoint settings from the nic, the nic may be in sandbox or moved back to host.
+// Caller must hold the lock of the nic.
+func cleanupSandbox(logger *log.Entry, endpoint *Endpoint, sandboxKey string) {
+	if endpoint.policyRouting && sandboxKey != "" {
+		if err := cleanupPolicyRouting(sandboxKey, endpoint); err != nil {
+			logger.WithError(err).Error("Cleanup endpoint policy routing error")
+		}
+	}
+	if endpoint.spoofCheck != nil {
+		if err := endpoint.spoofCheck.restore(); err != nil {
+			logger.WithError(err).Error("Restore spoof check of vf error")
+		}
+		endpoint.spoofCheck = nil
+	}
+	if endpoint.bandwidth == nil && !endpoint.antiSpoof {
+		return
+	}
+	sb, err := openSandbox(sandboxKey, endpoint.hostNic.HardwareAddr)
+	if err != nil {
+		sb, err = hostSandbox(endpoint.hostNic.HardwareAddr)
+		if err != nil {
+			logger.WithError(err).Error("Cleanup endpoint error")
+			return
+		}
+	}
+	defer sb.Close()
+	if err := sb.cleanupQdiscs(); err != nil {
+		logger.WithError(err).Error("Cleanup endpoint qdiscs error")
+	}
+}
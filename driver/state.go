@@ -0,0 +1,314 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/docker/go-plugins-helpers/network"
+)
+
+// stateVersion is the version of exported state document.
+const stateVersion = 1
+
+// State is the portable document of driver state, for host migration and disaster recovery.
+type State struct {
+	Version  int
+	Networks []NetworkState
+}
+
+// NetworkState is a network with its nic reservations, nics are keyed by stable identity instead of mac.
+type NetworkState struct {
+	ID            string
+	Name          string `json:",omitempty"` // name of docker network, default is the short id
+	Pool          string
+	Gateway       string
+	Bandwidth     *Bandwidth    `json:",omitempty"`
+	AntiSpoof     bool          `json:",omitempty"`
+	VxNet         string        `json:",omitempty"`
+	PolicyRouting bool          `json:",omitempty"`
+	Reservations  []Reservation `json:",omitempty"` // ip map of network
+	Assignments   []Reservation `json:",omitempty"` // ips of bound endpoints when exported, they are reserved on import
+}
+
+// Reservation maps a container ip to a host nic.
+type Reservation struct {
+	IP       string
+	Nic      NicIdentity
+	Endpoint string `json:",omitempty"`
+}
+
+// NicIdentity identify a nic across hosts, it is matched by pci address, permanent mac, mac and name in order.
+type NicIdentity struct {
+	PCI              string `json:",omitempty"`
+	PermHardwareAddr string `json:",omitempty"`
+	HardwareAddr     string `json:",omitempty"`
+	Name             string `json:",omitempty"`
+}
+
+// ReadConfigFile read networks from the config file in config dir, return empty networks if the file not exists.
+func ReadConfigFile(configDir string) (Networks, error) {
+	return (&HostNicDriver{configDir: configDir}).readConfig()
+}
+
+// WriteConfigFile write networks to the config file in config dir, the running plugin loads it on reload.
+func WriteConfigFile(configDir string, networks Networks) error {
+	if err := os.MkdirAll(configDir, os.FileMode(0755)); err != nil {
+		return err
+	}
+	return (&HostNicDriver{configDir: configDir, networks: networks}).saveConfig(configLog)
+}
+
+// ExportState export networks with reservations, and ips of bound endpoints as assignments.
+// Nics are identified by the local nic inventory, statuses are the networks of running plugin, may be nil.
+// Names are docker network names by id, may be nil.
+func ExportState(networks Networks, statuses []NetworkStatus, nics []NicInfo, names map[string]string) *State {
+	state := &State{Version: stateVersion, Networks: []NetworkState{}}
+	endpoints := make(map[string][]EndpointStatus)
+	for _, status := range statuses {
+		endpoints[status.ID] = status.Endpoints
+	}
+	for _, id := range networkIDs(networks) {
+		nw := networks[id]
+		ns := NetworkState{ID: nw.ID, Name: names[id], Bandwidth: nw.Bandwidth, AntiSpoof: nw.AntiSpoof, VxNet: nw.VxNet, PolicyRouting: nw.PolicyRouting}
+		if ns.Name == "" {
+			// imported but not created by docker yet
+			ns.Name = nw.Name
+		}
+		if nw.IPv4Data != nil {
+			ns.Pool, ns.Gateway = nw.IPv4Data.Pool, nw.IPv4Data.Gateway
+		}
+		for _, ip := range sortedIPs(nw.IPMap) {
+			ns.Reservations = append(ns.Reservations, Reservation{IP: ip, Nic: nicIdentity(nw.IPMap[ip], nics)})
+		}
+		for _, endpoint := range endpoints[id] {
+			for _, address := range endpoint.Addresses {
+				ip := addressIP(address)
+				if net.ParseIP(ip).To4() == nil || nw.IPMap[ip] != "" {
+					continue
+				}
+				ns.Assignments = append(ns.Assignments, Reservation{IP: ip, Nic: nicIdentity(endpoint.HardwareAddr, nics), Endpoint: endpoint.ID})
+			}
+		}
+		state.Networks = append(state.Networks, ns)
+	}
+	return state
+}
+
+// nicIdentity return the identity of nic referenced by mac or name.
+func nicIdentity(ref string, nics []NicInfo) NicIdentity {
+	for _, nic := range nics {
+		if nic.HardwareAddr == ref || nic.Name == ref {
+			return NicIdentity{PCI: nic.BusInfo, PermHardwareAddr: nic.PermHardwareAddr, HardwareAddr: nic.HardwareAddr, Name: nic.Name}
+		}
+	}
+	if _, err := net.ParseMAC(ref); err == nil {
+		return NicIdentity{HardwareAddr: ref}
+	}
+	return NicIdentity{Name: ref}
+}
+
+// resolve return the local mac of the identity, false if the nic is not on this host.
+func (id NicIdentity) resolve(nics []NicInfo) (string, bool) {
+	matches := []func(nic NicInfo) bool{
+		func(nic NicInfo) bool { return id.PCI != "" && nic.BusInfo == id.PCI },
+		func(nic NicInfo) bool {
+			return id.PermHardwareAddr != "" && nic.PermHardwareAddr == id.PermHardwareAddr
+		},
+		func(nic NicInfo) bool { return id.HardwareAddr != "" && nic.HardwareAddr == id.HardwareAddr },
+		func(nic NicInfo) bool { return id.Name != "" && nic.Name == id.Name },
+	}
+	for _, match := range matches {
+		for _, nic := range nics {
+			if match(nic) {
+				return nic.HardwareAddr, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (id NicIdentity) String() string {
+	var parts []string
+	for _, part := range [][2]string{{"pci", id.PCI}, {"perm", id.PermHardwareAddr}, {"mac", id.HardwareAddr}, {"name", id.Name}} {
+		if part[1] != "" {
+			parts = append(parts, part[0]+"="+part[1])
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// Resolve validate the state against the local nic inventory, and return the networks with ip maps of local macs.
+// Assignments are merged into ip maps. Nics not on this host are kept by their mac or name, and reported.
+// Networks are marked imported, docker network create of same gateway adopts them.
+func (s *State) Resolve(nics []NicInfo) (Networks, []Finding) {
+	var findings []Finding
+	networks := Networks{}
+	if s.Version != stateVersion {
+		return networks, []Finding{{Check: "import", Severity: SeverityError, Message: fmt.Sprintf("Unsupported state version [%d]", s.Version), Fix: "Export the state by the same version of plugin"}}
+	}
+	for _, ns := range s.Networks {
+		gateway, pool, err := net.ParseCIDR(ns.Gateway)
+		if err != nil || ns.ID == "" {
+			findings = append(findings, Finding{Check: "import", Severity: SeverityError, Message: fmt.Sprintf("Network [%s] has invalid gateway [%s], skipped", ns.ID, ns.Gateway), Fix: "Fix the network in the state document"})
+			continue
+		}
+		nw := &Network{
+			ID:            ns.ID,
+			IPv4Data:      &network.IPAMData{AddressSpace: "LocalDefault", Pool: ns.Pool, Gateway: ns.Gateway},
+			IPMap:         map[string]string{},
+			Bandwidth:     ns.Bandwidth,
+			AntiSpoof:     ns.AntiSpoof,
+			VxNet:         ns.VxNet,
+			PolicyRouting: ns.PolicyRouting,
+			Imported:      true,
+			Name:          ns.Name,
+		}
+		for i, reservation := range append(ns.Reservations, ns.Assignments...) {
+			ip := net.ParseIP(reservation.IP)
+			if ip == nil || !pool.Contains(ip) || ip.Equal(gateway) {
+				findings = append(findings, Finding{Check: "import", Severity: SeverityWarning, Message: fmt.Sprintf("Ip [%s] of network [%s] is not a host ip of subnet [%s], skipped", reservation.IP, ns.ID, pool), Fix: "Fix the reservation in the state document"})
+				continue
+			}
+			nic, ok := reservation.Nic.resolve(nics)
+			if !ok {
+				nic = reservation.Nic.HardwareAddr
+				if nic == "" {
+					nic = reservation.Nic.Name
+				}
+				findings = append(findings, Finding{Check: "import", Severity: SeverityWarning, Message: fmt.Sprintf("Nic [%s] of ip [%s] in network [%s] is not on this host", reservation.Nic, reservation.IP, ns.ID), Fix: "Attach the nic, or fix the reservation after import"})
+			}
+			if exist, ok := nw.IPMap[ip.String()]; ok {
+				if exist != nic {
+					findings = append(findings, Finding{Check: "import", Severity: SeverityWarning, Message: fmt.Sprintf("Ip [%s] of network [%s] is reserved for [%s], assignment to [%s] skipped", ip, ns.ID, exist, nic)})
+				}
+				continue
+			}
+			if i >= len(ns.Reservations) {
+				findings = append(findings, Finding{Check: "import", Severity: SeverityInfo, Message: fmt.Sprintf("Ip [%s] of endpoint [%s] in network [%s] is reserved for nic [%s]", ip, reservation.Endpoint, ns.ID, nic)})
+			}
+			nw.IPMap[ip.String()] = nic
+		}
+		networks[nw.ID] = nw
+	}
+	return networks, findings
+}
+
+// MergeNetworks merge imported networks into existing networks, or replace them.
+// Imported networks conflict with existing ones of same id but different settings, or of same gateway, are skipped.
+func MergeNetworks(existing, imported Networks, replace bool) (Networks, []Finding) {
+	var findings []Finding
+	result := Networks{}
+	if !replace {
+		for id, nw := range existing {
+			result[id] = nw
+		}
+	}
+	for _, id := range networkIDs(imported) {
+		nw := imported[id]
+		if exist := result[id]; exist != nil {
+			if !sameNetwork(exist, nw) {
+				findings = append(findings, Finding{Check: "import", Severity: SeverityError, Message: fmt.Sprintf("Network [%s] exists with different settings, kept the existing", id), Fix: "Import with --replace to overwrite existing networks"})
+			}
+			continue
+		}
+		conflict := false
+		for _, otherID := range networkIDs(result) {
+			if result[otherID].IPv4Data.Gateway == nw.IPv4Data.Gateway {
+				findings = append(findings, Finding{Check: "import", Severity: SeverityError, Message: fmt.Sprintf("Network [%s] has same gateway [%s] as network [%s], skipped", id, nw.IPv4Data.Gateway, otherID), Fix: "Remove the existing network, or import with --replace"})
+				conflict = true
+				break
+			}
+		}
+		if !conflict {
+			result[id] = nw
+		}
+	}
+	return result, findings
+}
+
+// NetworkCreateCommands return docker network create commands of the networks of state, with ip maps of local macs.
+func NetworkCreateCommands(s *State, networks Networks, driverName string) []string {
+	var commands []string
+	for _, ns := range s.Networks {
+		nw := networks[ns.ID]
+		if nw == nil {
+			continue
+		}
+		gateway, _, _ := net.ParseCIDR(nw.IPv4Data.Gateway)
+		args := []string{"docker network create -d", driverName, "--subnet=" + nw.IPv4Data.Pool, "--gateway=" + gateway.String()}
+		if len(nw.IPMap) > 0 {
+			var entries []string
+			for _, ip := range sortedIPs(nw.IPMap) {
+				entries = append(entries, ip+"="+nw.IPMap[ip])
+			}
+			args = append(args, "-o", ipMapOption+"="+strings.Join(entries, ","))
+		}
+		if b := nw.Bandwidth; b != nil {
+			for _, option := range []struct {
+				name  string
+				value uint64
+			}{{egressRateOption, b.EgressRate}, {egressBurstOption, b.EgressBurst}, {ingressRateOption, b.IngressRate}, {ingressBurstOption, b.IngressBurst}} {
+				if option.value != 0 {
+					args = append(args, "-o", fmt.Sprintf("%s=%d", option.name, option.value))
+				}
+			}
+		}
+		if nw.AntiSpoof {
+			args = append(args, "-o", antiSpoofOption+"=true")
+		}
+		if nw.VxNet != "" {
+			args = append(args, "-o", vxnetOption+"="+nw.VxNet)
+		}
+		if nw.PolicyRouting {
+			args = append(args, "-o", policyRoutingOption+"=true")
+		}
+		name := ns.Name
+		if name == "" {
+			name = shortID(ns.ID)
+		}
+		commands = append(commands, strings.Join(append(args, name), " "))
+	}
+	return commands
+}
+
+// shortID return the first 12 characters of docker id.
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func networkIDs(networks Networks) []string {
+	ids := make([]string, 0, len(networks))
+	for id := range networks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// sortedIPs return ips of ip map in numeric order.
+func sortedIPs(ipMap map[string]string) []string {
+	ips := make([]string, 0, len(ipMap))
+	for ip := range ipMap {
+		ips = append(ips, ip)
+	}
+	sort.Sort(ipByValue(ips))
+	return ips
+}
+
+type ipByValue []string
+
+func (s ipByValue) Len() int      { return len(s) }
+func (s ipByValue) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s ipByValue) Less(i, j int) bool {
+	a, b := net.ParseIP(s[i]).To16(), net.ParseIP(s[j]).To16()
+	if a == nil || b == nil {
+		return s[i] < s[j]
+	}
+	return string(a) < string(b)
+}
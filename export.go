@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli"
+	"github.com/yunify/docker-plugin-hostnic/driver"
+	"github.com/yunify/docker-plugin-hostnic/log"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// Export write the state in config dir, with ip assignments of running plugin if admin api is reachable.
+func Export(ctx *cli.Context) error {
+	if !ctx.GlobalBool("debug") {
+		log.SetOutput(ioutil.Discard)
+	}
+	networks, err := driver.ReadConfigFile(instancePath(ctx, "config-dir", driver.DefaultConfigDir))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Read config error: %s", err.Error()), 1)
+	}
+	var statuses []driver.NetworkStatus
+	if adminSocket := instancePath(ctx, "admin-socket", defaultAdminSocket); adminSocket != "" {
+		if err := newAdminClient(adminSocket).get("/networks", &statuses); err != nil {
+			fmt.Fprintf(os.Stderr, "Plugin is not reachable, ip assignments of endpoints are not exported: %s\n", err.Error())
+		}
+	}
+	names, err := dockerNetworkNames(ctx.String("docker-socket"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Docker is not reachable, networks are named by short ids: %s\n", err.Error())
+	}
+	nics, err := driver.ListNics()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("List nics error: %s", err.Error()), 1)
+	}
+	data, err := json.MarshalIndent(driver.ExportState(networks, statuses, nics, names), "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if output := ctx.String("output"); output != "" {
+		if err := ioutil.WriteFile(output, data, os.FileMode(0644)); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Write state error: %s", err.Error()), 1)
+		}
+		return nil
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// Import validate the exported state against local nics, then merge it into config dir and reload the running plugin.
+func Import(ctx *cli.Context) error {
+	if !ctx.GlobalBool("debug") {
+		log.SetOutput(ioutil.Discard)
+	}
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("Please set the exported state file", 1)
+	}
+	data, err := ioutil.ReadFile(ctx.Args().First())
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Read state error: %s", err.Error()), 1)
+	}
+	state := &driver.State{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Parse state error: %s", err.Error()), 1)
+	}
+	nics, err := driver.ListNics()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("List nics error: %s", err.Error()), 1)
+	}
+	imported, findings := state.Resolve(nics)
+	if ctx.Bool("commands") {
+		printFindings(os.Stderr, findings)
+		for _, command := range driver.NetworkCreateCommands(state, imported, ctx.GlobalString("name")) {
+			fmt.Println(command)
+		}
+		return exitOnError(findings)
+	}
+	configDir := instancePath(ctx, "config-dir", driver.DefaultConfigDir)
+	existing, err := driver.ReadConfigFile(configDir)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Read config error: %s", err.Error()), 1)
+	}
+	merged, conflicts := driver.MergeNetworks(existing, imported, ctx.Bool("replace"))
+	findings = append(findings, conflicts...)
+	printFindings(os.Stdout, findings)
+	if ctx.Bool("dry-run") {
+		fmt.Printf("Dry run, %d networks would be written to config\n", len(merged))
+		return exitOnError(findings)
+	}
+	if err := driver.WriteConfigFile(configDir, merged); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Write config error: %s", err.Error()), 1)
+	}
+	fmt.Printf("%d networks are written to config\n", len(merged))
+	if adminSocket := instancePath(ctx, "admin-socket", defaultAdminSocket); adminSocket != "" {
+		if err := newAdminClient(adminSocket).post("/reload", nil); err == nil {
+			fmt.Println("Plugin is reloaded")
+			return exitOnError(findings)
+		}
+	}
+	fmt.Println("Plugin is not reachable, send SIGHUP to the plugin or restart it to load the config")
+	return exitOnError(findings)
+}
+
+// dockerNetworkNames return names of docker networks by id, read from the api of docker daemon on unix socket.
+func dockerNetworkNames(socket string) (map[string]string, error) {
+	var networks []struct {
+		ID   string `json:"Id"`
+		Name string
+	}
+	if err := newAdminClient(socket).get("/networks", &networks); err != nil {
+		return nil, err
+	}
+	names := make(map[string]string, len(networks))
+	for _, nw := range networks {
+		names[nw.ID] = nw.Name
+	}
+	return names, nil
+}
+
+func printFindings(f *os.File, findings []driver.Finding) {
+	if len(findings) == 0 {
+		return
+	}
+	w := tabwriter.NewWriter(f, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SEVERITY\tMESSAGE")
+	for _, finding := range findings {
+		fmt.Fprintf(w, "%s\t%s\n", strings.ToUpper(string(finding.Severity)), finding.Message)
+		if finding.Fix != "" {
+			fmt.Fprintf(w, "\tfix: %s\n", finding.Fix)
+		}
+	}
+	w.Flush()
+}
+
+// exitOnError exit with 1 if any finding is error.
+func exitOnError(findings []driver.Finding) error {
+	for _, finding := range findings {
+		if finding.Severity == driver.SeverityError {
+			return cli.NewExitError("", 1)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli"
+	"github.com/yunify/docker-plugin-hostnic/driver"
+	"os"
+	"text/tabwriter"
+)
+
+// GC recover orphaned nics by the admin api of running plugin, which holds the bindings of nics.
+func GC(ctx *cli.Context) error {
+	adminSocket := instancePath(ctx, "admin-socket", defaultAdminSocket)
+	if adminSocket == "" {
+		return cli.NewExitError("Admin socket is disabled, gc needs the admin api of running plugin", 1)
+	}
+	path := "/gc"
+	if ctx.Bool("dry-run") {
+		path += "?dry_run=true"
+	}
+	client := newAdminClient(adminSocket)
+	var networks []driver.NetworkStatus
+	if err := client.get("/networks", &networks); err != nil {
+		return cli.NewExitError(fmt.Sprintf("GC error: %s", err.Error()), 1)
+	}
+	endpoints, err := dockerEndpoints(ctx.String("docker-socket"), networks)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Docker is not reachable, gc needs the endpoints docker knows: %s", err.Error()), 1)
+	}
+	var actions []driver.GCAction
+	if err := client.postJSON(path, driver.GCRequest{DockerEndpoints: endpoints}, &actions); err != nil {
+		return cli.NewExitError(fmt.Sprintf("GC error: %s", err.Error()), 1)
+	}
+	if ctx.Bool("json") {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(actions)
+	}
+	if len(actions) == 0 {
+		fmt.Println("No orphaned nics")
+		return nil
+	}
+	if ctx.Bool("dry-run") {
+		fmt.Println("Plan (dry run, nothing is changed):")
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ACTION\tMAC\tNIC\tNETWORK\tENDPOINT\tSANDBOX\tREASON\tERROR")
+	failed := false
+	for _, action := range actions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", action.Action, action.HardwareAddr, orNone(action.Nic), orNone(action.Network),
+			orNone(action.Endpoint), orNone(action.Sandbox), action.Reason, orNone(action.Error))
+		failed = failed || action.Error != ""
+	}
+	w.Flush()
+	if failed {
+		return cli.NewExitError("", 1)
+	}
+	return nil
+}
+
+// dockerEndpoints return the ids of endpoints docker knows in networks of the driver, read from the api of docker daemon.
+func dockerEndpoints(socket string, networks []driver.NetworkStatus) ([]string, error) {
+	names, err := dockerNetworkNames(socket)
+	if err != nil {
+		return nil, err
+	}
+	client := newAdminClient(socket)
+	endpoints := []string{}
+	for _, nw := range networks {
+		if _, ok := names[nw.ID]; !ok {
+			continue
+		}
+		var inspect struct {
+			Containers map[string]struct {
+				EndpointID string
+			}
+		}
+		if err := client.get("/networks/"+nw.ID, &inspect); err != nil {
+			return nil, err
+		}
+		for _, container := range inspect.Containers {
+			endpoints = append(endpoints, container.EndpointID)
+		}
+	}
+	return endpoints, nil
+}
@@ -0,0 +1,106 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// rotateFile is a log file rotated by size, rotated files are path.1 (newest) to path.N (oldest).
+type rotateFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	lock     sync.Mutex
+}
+
+// UseFile write log entries to the file instead of stderr, the file is rotated when its size exceed maxSize,
+// and at most maxFiles rotated files are kept.
+func UseFile(path string, maxSize int64, maxFiles int) error {
+	f, err := openRotateFile(path, maxSize, maxFiles)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(f)
+	return nil
+}
+
+// OpenRotateFile open the file for append, it is rotated like the log file, e.g., for audit log.
+func OpenRotateFile(path string, maxSize int64, maxFiles int) (io.WriteCloser, error) {
+	f, err := openRotateFile(path, maxSize, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func openRotateFile(path string, maxSize int64, maxFiles int) (*rotateFile, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("Invalid max size [%d] of log file", maxSize)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0755)); err != nil {
+		return nil, err
+	}
+	f := &rotateFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotateFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotateFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate shift path.N-1 to path.N, path to path.1, and open a new file.
+func (f *rotateFile) rotate() error {
+	f.file.Close()
+	if f.maxFiles <= 0 {
+		os.Remove(f.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxFiles))
+		for i := f.maxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	}
+	return f.open()
+}
+
+func (f *rotateFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.file.Close()
+}
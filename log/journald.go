@@ -0,0 +1,151 @@
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-systemd/util"
+)
+
+// journalSocket is the socket of journald native protocol.
+const journalSocket = "/run/systemd/journal/socket"
+
+// journaldHook send entries to journald by native protocol, fields are sent as journal fields.
+type journaldHook struct {
+	conn *net.UnixConn
+	addr *net.UnixAddr
+}
+
+// UseJournald send log entries to journald instead of stderr.
+func UseJournald() error {
+	if !util.IsRunningSystemd() {
+		return fmt.Errorf("Systemd is not running, can not log to journald")
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	log.AddHook(&journaldHook{conn: conn, addr: &net.UnixAddr{Name: journalSocket, Net: "unixgram"}})
+	log.SetOutput(ioutil.Discard)
+	return nil
+}
+
+// StderrIsJournal return whether stderr is connected to journal, e.g., running as a systemd service.
+func StderrIsJournal() bool {
+	stream := os.Getenv("JOURNAL_STREAM")
+	if stream == "" {
+		return false
+	}
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(int(os.Stderr.Fd()), &stat); err != nil {
+		return false
+	}
+	return stream == fmt.Sprintf("%d:%d", stat.Dev, stat.Ino)
+}
+
+func (h *journaldHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *journaldHook) Fire(entry *log.Entry) error {
+	data := journalMessage(entry)
+	_, err := h.conn.WriteToUnix(data, h.addr)
+	if err == nil {
+		return nil
+	}
+	if opErr, ok := err.(*net.OpError); !ok || !isMsgSize(opErr.Err) {
+		return err
+	}
+	// message is too large for datagram, pass it by a file descriptor.
+	file, err := ioutil.TempFile("/dev/shm", "hostnic-journal-")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	_, _, err = h.conn.WriteMsgUnix(nil, syscall.UnixRights(int(file.Fd())), h.addr)
+	return err
+}
+
+func isMsgSize(err error) bool {
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	return err == syscall.EMSGSIZE || err == syscall.ENOBUFS
+}
+
+// journalMessage encode entry in journald native protocol.
+func journalMessage(entry *log.Entry) []byte {
+	b := &bytes.Buffer{}
+	journalField(b, "MESSAGE", entry.Message)
+	journalField(b, "PRIORITY", strconv.Itoa(journalPriority(entry.Level)))
+	journalField(b, "SYSLOG_IDENTIFIER", filepath.Base(tag))
+	for _, key := range sortedKeys(entry.Data) {
+		journalField(b, journalFieldName(key), fmt.Sprint(fieldValue(entry.Data[key])))
+	}
+	return b.Bytes()
+}
+
+// journalField write field as KEY=VALUE, or in binary safe format if value has newline.
+func journalField(b *bytes.Buffer, name string, value string) {
+	b.WriteString(name)
+	if strings.Contains(value, "\n") {
+		b.WriteByte('\n')
+		binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	} else {
+		b.WriteByte('=')
+	}
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// journalFieldName convert key to journal field name, which only has upper letters, digits and underscores,
+// and must not start with underscore or digit.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, key)
+	name = strings.TrimLeft(name, "_0123456789")
+	if name == "" {
+		name = "FIELD"
+	}
+	return name
+}
+
+// journalPriority map logrus level to syslog priority.
+func journalPriority(level log.Level) int {
+	switch level {
+	case log.PanicLevel:
+		return 0 // emerg
+	case log.FatalLevel:
+		return 2 // crit
+	case log.ErrorLevel:
+		return 3 // err
+	case log.WarnLevel:
+		return 4 // warning
+	case log.InfoLevel:
+		return 6 // info
+	default:
+		return 7 // debug
+	}
+}
@@ -0,0 +1,176 @@
+package log
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Subsystems which log levels can be set separately.
+const (
+	Driver    = "driver"    // driver lifecycle, e.g., plugin requests and sandbox setup
+	Inventory = "inventory" // nic inventory
+	Config    = "config"    // persistence of networks
+	HTTP      = "http"      // admin and metrics http handler
+)
+
+// Subsystems are all subsystems, entries without subsystem are logged at the default level.
+var Subsystems = []string{Driver, Inventory, Config, HTTP}
+
+var (
+	levelLock    sync.RWMutex
+	defaultLevel = log.InfoLevel
+	levels       = make(map[string]log.Level)
+	// toggled is the levels before ToggleDebug, restored by the next ToggleDebug, nil if not toggled.
+	toggled *savedLevels
+)
+
+type savedLevels struct {
+	defaultLevel log.Level
+	levels       map[string]log.Level
+}
+
+// levelOf return the level of subsystem, caller must hold levelLock.
+func levelOf(subsystem string) log.Level {
+	if level, ok := levels[subsystem]; ok {
+		return level
+	}
+	return defaultLevel
+}
+
+// maxLevel return the most verbose level of all subsystems, caller must hold levelLock.
+func maxLevel() log.Level {
+	max := defaultLevel
+	for _, level := range levels {
+		if level > max {
+			max = level
+		}
+	}
+	return max
+}
+
+// minLevel return the least verbose level of all subsystems, caller must hold levelLock.
+func minLevel() log.Level {
+	min := defaultLevel
+	for _, level := range levels {
+		if level < min {
+			min = level
+		}
+	}
+	return min
+}
+
+func enabled(subsystem string, level log.Level) bool {
+	levelLock.RLock()
+	defer levelLock.RUnlock()
+	return level <= levelOf(subsystem)
+}
+
+// SetAllLevels sets the default level, and clear the levels of subsystems.
+func SetAllLevels(level string) error {
+	lvl, err := log.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("Invalid log level [%s]", level)
+	}
+	setAllLevels(lvl)
+	return nil
+}
+
+func setAllLevels(level log.Level) {
+	levelLock.Lock()
+	previous := defaultLevel
+	defaultLevel = level
+	levels = make(map[string]log.Level)
+	toggled = nil
+	// logrus filter entries before subsystem, so it must allow the most verbose subsystem.
+	log.SetLevel(level)
+	levelLock.Unlock()
+	if previous != level {
+		logLevelChange("all", previous, level)
+	}
+}
+
+// ToggleDebug sets debug level of all subsystems (or info if all are debug already),
+// and the next call restores the levels of subsystems before it, unless levels are set meanwhile.
+func ToggleDebug() {
+	levelLock.Lock()
+	previous := defaultLevel
+	if toggled != nil {
+		defaultLevel, levels, toggled = toggled.defaultLevel, toggled.levels, nil
+		log.SetLevel(maxLevel())
+		levelLock.Unlock()
+		logLevelChange("all", previous, defaultLevel)
+		return
+	}
+	level := log.DebugLevel
+	if minLevel() >= log.DebugLevel {
+		level = log.InfoLevel
+	}
+	toggled = &savedLevels{defaultLevel: defaultLevel, levels: levels}
+	defaultLevel = level
+	levels = make(map[string]log.Level)
+	log.SetLevel(level)
+	levelLock.Unlock()
+	logLevelChange("all", previous, level)
+}
+
+// SetSubsystemLevel sets the log level of the subsystem.
+func SetSubsystemLevel(subsystem string, level string) error {
+	lvl, err := log.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("Invalid log level [%s]", level)
+	}
+	known := false
+	for _, s := range Subsystems {
+		known = known || s == subsystem
+	}
+	if !known {
+		return fmt.Errorf("Invalid log subsystem [%s], valid subsystems are %v", subsystem, Subsystems)
+	}
+	levelLock.Lock()
+	previous := levelOf(subsystem)
+	levels[subsystem] = lvl
+	toggled = nil
+	log.SetLevel(maxLevel())
+	levelLock.Unlock()
+	if previous != lvl {
+		logLevelChange(subsystem, previous, lvl)
+	}
+	return nil
+}
+
+// SetLevels sets the log levels of subsystems by spec, e.g., inventory=debug,config=warn
+func SetLevels(spec string) error {
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Invalid log level spec [%s], should be subsystem=level", item)
+		}
+		if err := SetSubsystemLevel(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Levels return the log levels of all subsystems.
+func Levels() map[string]string {
+	levelLock.RLock()
+	defer levelLock.RUnlock()
+	result := make(map[string]string)
+	for _, subsystem := range Subsystems {
+		result[subsystem] = levelOf(subsystem).String()
+	}
+	return result
+}
+
+// logLevelChange log the change at warning level, so it is visible at default level.
+func logLevelChange(subsystem string, previous log.Level, level log.Level) {
+	log.WithFields(log.Fields{"subsystem": subsystem, "level": level.String(), "previous": previous.String()}).Warning("Log level changed")
+}
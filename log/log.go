@@ -3,26 +3,91 @@ Package log provides support for logging to stdout and stderr.
 
 Log entries will be logged in the following format:
 
-    timestamp hostname tag[pid]: SEVERITY Message
+    timestamp hostname tag[pid]: SEVERITY Message key=value ...
+
+or one JSON object per line when the format is set to json.
 */
 package log
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
 
+// Fields are the structured fields of log entry, e.g., network_id, endpoint_id, mac, nic, sandbox, duration, error.
+type Fields map[string]interface{}
+
 type LogFormatter struct {
 }
 
 func (c *LogFormatter) Format(entry *log.Entry) ([]byte, error) {
 	timestamp := time.Now().Format(time.RFC3339)
 	hostname, _ := os.Hostname()
-	return []byte(fmt.Sprintf("%s %s %s[%d]: %s %s\n", timestamp, hostname, tag, os.Getpid(), strings.ToUpper(entry.Level.String()), entry.Message)), nil
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "%s %s %s[%d]: %s ", timestamp, hostname, tag, os.Getpid(), strings.ToUpper(entry.Level.String()))
+	writeMessage(b, entry)
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+// JSONFormatter formats entry as one JSON object per line, fields are at top level.
+type JSONFormatter struct {
+}
+
+func (c *JSONFormatter) Format(entry *log.Entry) ([]byte, error) {
+	hostname, _ := os.Hostname()
+	data := make(map[string]interface{}, len(entry.Data)+6)
+	for key, value := range entry.Data {
+		data[key] = fieldValue(value)
+	}
+	data["time"] = time.Now().Format(time.RFC3339Nano)
+	data["host"] = hostname
+	data["tag"] = tag
+	data["pid"] = os.Getpid()
+	data["level"] = entry.Level.String()
+	data["msg"] = entry.Message
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("Marshal log entry error: %s", err.Error())
+	}
+	return append(b, '\n'), nil
+}
+
+// fieldValue convert values can not be marshaled well, e.g., error.
+func fieldValue(value interface{}) interface{} {
+	if err, ok := value.(error); ok {
+		return err.Error()
+	}
+	return value
+}
+
+// writeMessage write the message of entry followed by its fields as key=value.
+func writeMessage(b *bytes.Buffer, entry *log.Entry) {
+	b.WriteString(entry.Message)
+	for _, key := range sortedKeys(entry.Data) {
+		value := fmt.Sprint(fieldValue(entry.Data[key]))
+		if strings.ContainsAny(value, " \"=") || value == "" {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(b, " %s=%s", key, value)
+	}
+}
+
+func sortedKeys(data log.Fields) []string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 // tag represents the application name generating the log message. The tag
@@ -39,27 +104,45 @@ func SetTag(t string) {
 	tag = t
 }
 
-// SetLevel sets the log level. Valid levels are panic, fatal, error, warn, info and debug.
+// SetLevel sets the log level of all subsystems. Valid levels are panic, fatal, error, warn, info and debug.
 func SetLevel(level string) {
-	lvl, err := log.ParseLevel(level)
-	if err != nil {
-		Fatal(fmt.Sprintf(`not a valid level: "%s"`, level))
+	if err := SetAllLevels(level); err != nil {
+		Fatal(`not a valid level: "%s"`, level)
+	}
+}
+
+// SetOutput sets the writer of log entries, default is stderr.
+func SetOutput(w io.Writer) {
+	log.SetOutput(w)
+}
+
+// SetFormat sets the log format. Valid formats are text and json.
+func SetFormat(format string) {
+	switch format {
+	case "text":
+		log.SetFormatter(&LogFormatter{})
+	case "json":
+		log.SetFormatter(&JSONFormatter{})
+	default:
+		Fatal(`not a valid format: "%s"`, format)
 	}
-	log.SetLevel(lvl)
 }
 
+// IsDebugEnable return whether debug is enabled for any subsystem.
 func IsDebugEnable() bool {
-	return log.GetLevel() >= log.DebugLevel
+	levelLock.RLock()
+	defer levelLock.RUnlock()
+	return maxLevel() >= log.DebugLevel
 }
 
 // Debug logs a message with severity DEBUG.
 func Debug(format string, v ...interface{}) {
-	log.Debug(fmt.Sprintf(format, v...))
+	std.Debug(format, v...)
 }
 
 // Error logs a message with severity ERROR.
 func Error(format string, v ...interface{}) {
-	log.Error(fmt.Sprintf(format, v...))
+	std.Error(format, v...)
 }
 
 // Fatal logs a message with severity ERROR followed by a call to os.Exit().
@@ -69,10 +152,77 @@ func Fatal(format string, v ...interface{}) {
 
 // Info logs a message with severity INFO.
 func Info(format string, v ...interface{}) {
-	log.Info(fmt.Sprintf(format, v...))
+	std.Info(format, v...)
 }
 
 // Warning logs a message with severity WARNING.
 func Warning(format string, v ...interface{}) {
-	log.Warning(fmt.Sprintf(format, v...))
+	std.Warning(format, v...)
+}
+
+// Entry is a log entry with structured fields, it is logged at the level of its subsystem.
+type Entry struct {
+	entry     *log.Entry
+	subsystem string
+}
+
+// std is the entry without subsystem, it is logged at the default level.
+var std = &Entry{entry: log.NewEntry(log.StandardLogger())}
+
+// WithFields creates an entry with the fields.
+func WithFields(fields Fields) *Entry {
+	return std.WithFields(fields)
+}
+
+// Subsystem creates an entry of the subsystem.
+func Subsystem(subsystem string) *Entry {
+	return std.Subsystem(subsystem)
+}
+
+// Subsystem creates an entry with the fields of entry, and logged at the level of subsystem.
+func (e *Entry) Subsystem(subsystem string) *Entry {
+	return &Entry{entry: e.entry.WithField("subsystem", subsystem), subsystem: subsystem}
+}
+
+// WithFields creates an entry with the fields of entry and the fields.
+func (e *Entry) WithFields(fields Fields) *Entry {
+	return &Entry{entry: e.entry.WithFields(log.Fields(fields)), subsystem: e.subsystem}
+}
+
+// WithField creates an entry with the fields of entry and the field.
+func (e *Entry) WithField(key string, value interface{}) *Entry {
+	return &Entry{entry: e.entry.WithField(key, value), subsystem: e.subsystem}
+}
+
+// WithError creates an entry with the fields of entry and the error field.
+func (e *Entry) WithError(err error) *Entry {
+	return e.WithField("error", err)
+}
+
+// Debug logs a message with severity DEBUG.
+func (e *Entry) Debug(format string, v ...interface{}) {
+	if enabled(e.subsystem, log.DebugLevel) {
+		e.entry.Debug(fmt.Sprintf(format, v...))
+	}
+}
+
+// Error logs a message with severity ERROR.
+func (e *Entry) Error(format string, v ...interface{}) {
+	if enabled(e.subsystem, log.ErrorLevel) {
+		e.entry.Error(fmt.Sprintf(format, v...))
+	}
+}
+
+// Info logs a message with severity INFO.
+func (e *Entry) Info(format string, v ...interface{}) {
+	if enabled(e.subsystem, log.InfoLevel) {
+		e.entry.Info(fmt.Sprintf(format, v...))
+	}
+}
+
+// Warning logs a message with severity WARNING.
+func (e *Entry) Warning(format string, v ...interface{}) {
+	if enabled(e.subsystem, log.WarnLevel) {
+		e.entry.Warning(fmt.Sprintf(format, v...))
+	}
 }
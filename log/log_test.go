@@ -0,0 +1,139 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestJournalMessage(t *testing.T) {
+	entry := log.WithFields(log.Fields{"endpoint_id": "ep1", "error": errors.New("line1\nline2"), "_hidden": 1})
+	entry.Level = log.WarnLevel
+	entry.Message = "Host nic disappeared"
+	data := string(journalMessage(entry))
+	for _, field := range []string{
+		"MESSAGE=Host nic disappeared\n",
+		"PRIORITY=4\n",
+		"ENDPOINT_ID=ep1\n",
+		"HIDDEN=1\n",
+		"ERROR\n\x0b\x00\x00\x00\x00\x00\x00\x00line1\nline2\n",
+	} {
+		if !strings.Contains(data, field) {
+			t.Errorf("journal message miss field %q: %q", field, data)
+		}
+	}
+}
+
+func TestSyslogMessage(t *testing.T) {
+	entry := log.WithFields(log.Fields{"nic": "eth1"})
+	entry.Level = log.ErrorLevel
+	entry.Message = "Setup endpoint error"
+	data := string(syslogMessage(entry))
+	pattern := fmt.Sprintf(`^<27>1 \S+ \S+ %s %d - - Setup endpoint error nic=eth1\n$`, regexp.QuoteMeta(filepath.Base(tag)), os.Getpid())
+	if !regexp.MustCompile(pattern).MatchString(data) {
+		t.Errorf("syslog message %q not match %s", data, pattern)
+	}
+}
+
+func TestRotateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostnic-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hostnic.log")
+	f, err := openRotateFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, line := range []string{"line1\n", "line2\n", "line3\n", "line4\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for file, expect := range map[string]string{path: "line4\n", path + ".1": "line3\n", path + ".2": "line2\n"} {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expect {
+			t.Errorf("expect %q in %s, got %q", expect, file, data)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expect at most 2 rotated files")
+	}
+}
+
+func TestSubsystemLevels(t *testing.T) {
+	buf := &bytes.Buffer{}
+	SetOutput(buf)
+	defer SetOutput(os.Stderr)
+	defer SetLevel("info")
+	SetLevel("info")
+
+	if err := SetLevels("inventory=debug, http=error"); err != nil {
+		t.Fatal(err)
+	}
+	if !IsDebugEnable() {
+		t.Error("expect debug enabled by inventory")
+	}
+	Subsystem(Inventory).Debug("inventory debug")
+	Subsystem(Driver).Debug("driver debug")
+	Subsystem(HTTP).Warning("http warning")
+	Debug("default debug")
+	output := buf.String()
+	if !strings.Contains(output, "inventory debug") {
+		t.Errorf("expect inventory debug logged: %s", output)
+	}
+	for _, msg := range []string{"driver debug", "http warning", "default debug"} {
+		if strings.Contains(output, msg) {
+			t.Errorf("expect %s filtered: %s", msg, output)
+		}
+	}
+	if !strings.Contains(output, "Log level changed") {
+		t.Errorf("expect level change logged: %s", output)
+	}
+	levels := Levels()
+	if levels[Inventory] != "debug" || levels[HTTP] != "error" || levels[Driver] != "info" {
+		t.Errorf("unexpected levels %v", levels)
+	}
+
+	for _, spec := range []string{"inventory", "unknown=debug", "driver=verbose"} {
+		if err := SetLevels(spec); err == nil {
+			t.Errorf("expect error of spec [%s]", spec)
+		}
+	}
+	// toggle debug and restore the levels of subsystems
+	ToggleDebug()
+	if levels := Levels(); levels[HTTP] != "debug" || levels[Driver] != "debug" {
+		t.Errorf("expect debug of all subsystems after toggle %v", levels)
+	}
+	ToggleDebug()
+	if levels := Levels(); levels[Inventory] != "debug" || levels[HTTP] != "error" || levels[Driver] != "info" {
+		t.Errorf("expect levels restored after toggle twice %v", levels)
+	}
+
+	SetLevel("info")
+	if IsDebugEnable() {
+		t.Error("expect debug disabled after set level of all subsystems")
+	}
+	SetLevel("debug")
+	ToggleDebug()
+	if IsDebugEnable() {
+		t.Error("expect debug disabled by toggle when all subsystems are debug")
+	}
+	ToggleDebug()
+	if levels := Levels(); levels[Driver] != "debug" {
+		t.Errorf("expect debug restored after toggle twice %v", levels)
+	}
+}
@@ -0,0 +1,94 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// syslogFacility is the daemon facility.
+	syslogFacility = 3
+	// syslogMaxAppName is the max length of APP-NAME in RFC 5424.
+	syslogMaxAppName = 48
+)
+
+// syslogSockets are the local syslog sockets, the first can be connected is used.
+var syslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// syslogHook send entries to local syslog socket in RFC 5424 format.
+type syslogHook struct {
+	conn net.Conn
+	lock sync.Mutex
+}
+
+// UseSyslog send log entries to local syslog instead of stderr.
+func UseSyslog() error {
+	conn, err := dialSyslog()
+	if err != nil {
+		return err
+	}
+	log.AddHook(&syslogHook{conn: conn})
+	log.SetOutput(ioutil.Discard)
+	return nil
+}
+
+func dialSyslog() (net.Conn, error) {
+	for _, path := range syslogSockets {
+		for _, network := range []string{"unixgram", "unix"} {
+			if conn, err := net.Dial(network, path); err == nil {
+				return conn, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("Can not connect to local syslog socket %v", syslogSockets)
+}
+
+func (h *syslogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *syslogHook) Fire(entry *log.Entry) error {
+	data := syslogMessage(entry)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, err := h.conn.Write(data); err == nil {
+		return nil
+	}
+	// syslog daemon may be restarted, connect again.
+	conn, err := dialSyslog()
+	if err != nil {
+		return err
+	}
+	h.conn.Close()
+	h.conn = conn
+	_, err = h.conn.Write(data)
+	return err
+}
+
+// syslogMessage format entry in RFC 5424, fields are appended to message as key=value.
+//
+//	<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+func syslogMessage(entry *log.Entry) []byte {
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	appName := filepath.Base(tag)
+	if len(appName) > syslogMaxAppName {
+		appName = appName[:syslogMaxAppName]
+	}
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "<%d>1 %s %s %s %d - - ", syslogFacility*8+journalPriority(entry.Level),
+		time.Now().Format("2006-01-02T15:04:05.000000Z07:00"), hostname, appName, os.Getpid())
+	writeMessage(b, entry)
+	b.WriteByte('\n')
+	return b.Bytes()
+}
@@ -1,22 +1,229 @@
 package main
 
 import (
+	"fmt"
+	"github.com/docker/go-connections/sockets"
 	"github.com/docker/go-plugins-helpers/network"
 	"github.com/urfave/cli"
 	"github.com/yunify/docker-plugin-hostnic/driver"
 	"github.com/yunify/docker-plugin-hostnic/log"
+	"github.com/yunify/docker-plugin-hostnic/qingcloud"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const (
 	version = "0.1"
+
+	// default paths of the default instance, paths of other instances are named by the driver name.
+	defaultPluginSocket = "/run/docker/plugins/hostnic.sock"
+	defaultAdminSocket  = "/run/docker/hostnic-admin.sock"
+	defaultLogFile      = "/var/log/hostnic/hostnic.log"
+	defaultAuditFile    = "/var/log/hostnic/audit.log"
+
+	// managedStateDir is the propagated mount of managed plugin, see plugin/config.json.
+	managedStateDir = "/var/lib/hostnic"
+)
+
+// managedPaths are the default paths of managed plugin, the plugin socket is fixed by interface.socket of plugin/config.json.
+var managedPaths = map[string]string{
+	"socket":       defaultPluginSocket,
+	"config-dir":   managedStateDir,
+	"admin-socket": managedStateDir + "/admin.sock",
+	"audit-file":   managedStateDir + "/audit.log",
+	"log-file":     managedStateDir + "/hostnic.log",
+}
+
+// exit codes
+const (
+	exitOK            = 0
+	exitServeError    = 1
+	exitShutdownError = 2
 )
 
 func main() {
 
 	var flagDebug = cli.BoolFlag{
-		Name:  "debug, d",
-		Usage: "enable debugging",
+		Name:   "debug, d",
+		Usage:  "enable debugging",
+		EnvVar: "HOSTNIC_DEBUG",
+	}
+	var flagManaged = cli.BoolFlag{
+		Name:   "managed",
+		Usage:  "run as docker managed plugin, config dir, audit file and admin socket are under " + managedStateDir,
+		EnvVar: "HOSTNIC_MANAGED",
+	}
+	var flagProtectedNics = cli.StringFlag{
+		Name:   "protected-nics",
+		Usage:  "nics never bound to containers by name or mac address, e.g., eth0,52:54:0e:e5:00:f7",
+		EnvVar: "HOSTNIC_PROTECTED_NICS",
+	}
+	var flagName = cli.StringFlag{
+		Name:   "name",
+		Value:  driver.DefaultName,
+		Usage:  "driver name used by docker network create -d, run instances of different names for independent networks",
+		EnvVar: "HOSTNIC_NAME",
+	}
+	var flagSocket = cli.StringFlag{
+		Name:   "socket",
+		Value:  defaultPluginSocket,
+		Usage:  "unix socket of plugin api, default is /run/docker/plugins/<name>.sock",
+		EnvVar: "HOSTNIC_SOCKET",
+	}
+	var flagListen = cli.StringFlag{
+		Name:   "listen",
+		Usage:  "listen on tcp://host:port with mutual tls instead of the unix socket, and write the spec file /etc/docker/plugins/<name>.json",
+		EnvVar: "HOSTNIC_LISTEN",
+	}
+	var flagTLSCA = cli.StringFlag{
+		Name:  "tls-ca",
+		Usage: "CA to verify the client cert of docker, and written to the spec file for docker to verify the plugin",
+	}
+	var flagTLSCert = cli.StringFlag{
+		Name:  "tls-cert",
+		Usage: "server cert of tcp listener",
+	}
+	var flagTLSKey = cli.StringFlag{
+		Name:  "tls-key",
+		Usage: "server key of tcp listener",
+	}
+	var flagTLSClientCert = cli.StringFlag{
+		Name:  "tls-client-cert",
+		Usage: "client cert written to the spec file, docker presents it to the plugin",
+	}
+	var flagTLSClientKey = cli.StringFlag{
+		Name:  "tls-client-key",
+		Usage: "client key written to the spec file",
+	}
+	var flagConfigDir = cli.StringFlag{
+		Name:   "config-dir",
+		Value:  driver.DefaultConfigDir,
+		Usage:  "dir of config file, default is /etc/docker/<name>",
+		EnvVar: "HOSTNIC_CONFIG_DIR",
+	}
+	var flagLogFormat = cli.StringFlag{
+		Name:  "log-format",
+		Value: "text",
+		Usage: "log format, text or json",
+	}
+	var flagLogLevels = cli.StringFlag{
+		Name:  "log-levels",
+		Usage: "log levels of subsystems (driver, inventory, config, http), e.g., inventory=debug,http=warn",
+	}
+	var flagLogTarget = cli.StringFlag{
+		Name:  "log-target",
+		Value: "auto",
+		Usage: "log target, stderr, journald, syslog or file, auto use journald when running as systemd service",
+	}
+	var flagLogFile = cli.StringFlag{
+		Name:  "log-file",
+		Value: defaultLogFile,
+		Usage: "log file of file log target",
+	}
+	var flagLogMaxSize = cli.IntFlag{
+		Name:  "log-max-size",
+		Value: 100,
+		Usage: "max size in megabytes of log file before it is rotated",
+	}
+	var flagLogMaxFiles = cli.IntFlag{
+		Name:  "log-max-files",
+		Value: 5,
+		Usage: "max number of rotated log files to keep",
+	}
+	var flagAuditFile = cli.StringFlag{
+		Name:  "audit-file",
+		Value: defaultAuditFile,
+		Usage: "file to append lifecycle events of networks, endpoints and nics, empty to disable",
+	}
+	var flagAuditMaxSize = cli.IntFlag{
+		Name:  "audit-max-size",
+		Value: 100,
+		Usage: "max size in megabytes of audit file before it is rotated",
+	}
+	var flagAuditMaxFiles = cli.IntFlag{
+		Name:  "audit-max-files",
+		Value: 10,
+		Usage: "max number of rotated audit files to keep",
+	}
+	var flagAdminSocket = cli.StringFlag{
+		Name:  "admin-socket",
+		Value: defaultAdminSocket,
+		Usage: "unix socket of admin api, empty to disable",
+	}
+	var flagShutdownTimeout = cli.DurationFlag{
+		Name:  "shutdown-timeout",
+		Value: 30 * time.Second,
+		Usage: "max time to wait in flight requests on shutdown",
+	}
+	var flagMetricsAddress = cli.StringFlag{
+		Name:  "metrics-address",
+		Usage: "tcp address to expose prometheus metrics on /metrics, e.g., 127.0.0.1:9476, empty to disable",
+	}
+	var flagHooksDir = cli.StringFlag{
+		Name:   "hooks-dir",
+		Usage:  "dir of executables run before and after endpoint operations, e.g., pre-join, post-delete-endpoint, empty to disable",
+		EnvVar: "HOSTNIC_HOOKS_DIR",
+	}
+	var flagHookTimeout = cli.DurationFlag{
+		Name:  "hook-timeout",
+		Value: driver.DefaultHookTimeout,
+		Usage: "max time a hook executable can run before it is killed",
+	}
+	var flagNicProvider = cli.StringFlag{
+		Name:   "nic-provider",
+		Usage:  "provision nics for endpoints of networks with vxnet option when no host nic matches, qingcloud or empty to disable",
+		EnvVar: "HOSTNIC_NIC_PROVIDER",
+	}
+	var flagProvisionTimeout = cli.DurationFlag{
+		Name:  "provision-timeout",
+		Value: driver.DefaultProvisionTimeout,
+		Usage: "max time from a request to the provisioned nic appears on host, must be less than the 30s timeout of docker plugin calls",
+	}
+	var flagQingCloudURL = cli.StringFlag{
+		Name:   "qingcloud-url",
+		Value:  qingcloud.DefaultURL,
+		Usage:  "url of QingCloud iaas api",
+		EnvVar: "QINGCLOUD_URL",
+	}
+	var flagQingCloudZone = cli.StringFlag{
+		Name:   "qingcloud-zone",
+		Usage:  "zone of the host, e.g., pek3a",
+		EnvVar: "QINGCLOUD_ZONE",
+	}
+	var flagQingCloudInstance = cli.StringFlag{
+		Name:   "qingcloud-instance",
+		Usage:  "instance id of the host, provisioned nics are attached to it",
+		EnvVar: "QINGCLOUD_INSTANCE",
+	}
+	var flagQingCloudAccessKeyID = cli.StringFlag{
+		Name:   "qingcloud-access-key-id",
+		Usage:  "access key id of QingCloud api",
+		EnvVar: "QINGCLOUD_ACCESS_KEY_ID",
+	}
+	var flagQingCloudSecretAccessKey = cli.StringFlag{
+		Name:   "qingcloud-secret-access-key",
+		Usage:  "secret access key of QingCloud api",
+		EnvVar: "QINGCLOUD_SECRET_ACCESS_KEY",
+	}
+	var flagMetadata = cli.StringFlag{
+		Name:   "metadata",
+		Usage:  "url of metadata service or local json file listing cloud subnets of nics, nics are matched to networks by subnet, empty to disable",
+		EnvVar: "HOSTNIC_METADATA",
+	}
+	var flagMetadataRefresh = cli.DurationFlag{
+		Name:  "metadata-refresh",
+		Value: time.Minute,
+		Usage: "interval to read metadata again, 0 to disable",
+	}
+	var flagJSON = cli.BoolFlag{
+		Name:  "json",
+		Usage: "print json instead of table",
 	}
 	app := cli.NewApp()
 	app.Name = "hostnic"
@@ -24,24 +231,343 @@ func main() {
 	app.Version = version
 	app.Flags = []cli.Flag{
 		flagDebug,
+		flagManaged,
+		flagProtectedNics,
+		flagName,
+		flagSocket,
+		flagListen,
+		flagTLSCA,
+		flagTLSCert,
+		flagTLSKey,
+		flagTLSClientCert,
+		flagTLSClientKey,
+		flagConfigDir,
+		flagLogFormat,
+		flagLogLevels,
+		flagLogTarget,
+		flagLogFile,
+		flagLogMaxSize,
+		flagLogMaxFiles,
+		flagAuditFile,
+		flagAuditMaxSize,
+		flagAuditMaxFiles,
+		flagAdminSocket,
+		flagMetricsAddress,
+		flagHooksDir,
+		flagHookTimeout,
+		flagMetadata,
+		flagMetadataRefresh,
+		flagNicProvider,
+		flagProvisionTimeout,
+		flagQingCloudURL,
+		flagQingCloudZone,
+		flagQingCloudInstance,
+		flagQingCloudAccessKeyID,
+		flagQingCloudSecretAccessKey,
+		flagShutdownTimeout,
 	}
 	app.Action = Run
+	app.Commands = []cli.Command{
+		{
+			Name:   "nics",
+			Usage:  "list host nics which can be bound, with the state read from admin api of running plugin",
+			Flags:  []cli.Flag{flagJSON},
+			Action: Nics,
+		},
+		{
+			Name:   "doctor",
+			Usage:  "check capabilities, plugin socket, config, netlink and netns access, gateway conflicts and bound nics",
+			Flags:  []cli.Flag{flagJSON},
+			Action: Doctor,
+		},
+		{
+			Name:  "gc",
+			Usage: "recover nics held by endpoints docker does not know, without a live sandbox",
+			Flags: []cli.Flag{
+				flagJSON,
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print the plan without changing anything",
+				},
+				cli.StringFlag{
+					Name:  "docker-socket",
+					Value: "/var/run/docker.sock",
+					Usage: "unix socket of docker daemon api, endpoints docker knows are read from it",
+				},
+			},
+			Action: GC,
+		},
+		{
+			Name:      "metadata",
+			Usage:     "list cloud subnets of nics from the metadata url or file, default is --metadata",
+			ArgsUsage: "[URL|FILE]",
+			Flags: []cli.Flag{
+				flagJSON,
+				cli.BoolFlag{
+					Name:  "commands",
+					Usage: "print docker network create commands of the subnets",
+				},
+			},
+			Action: Metadata,
+		},
+		{
+			Name:  "export",
+			Usage: "export networks, nic reservations and ip assignments as a portable document, nics are keyed by pci address",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "write the document to file instead of stdout",
+				},
+				cli.StringFlag{
+					Name:  "docker-socket",
+					Value: "/var/run/docker.sock",
+					Usage: "unix socket of docker daemon api, network names are read from it",
+				},
+			},
+			Action: Export,
+		},
+		{
+			Name:      "import",
+			Usage:     "validate the exported document against local nics, and merge it into config",
+			ArgsUsage: "FILE",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "replace",
+					Usage: "replace existing networks instead of merging",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "validate and report conflicts without writing config",
+				},
+				cli.BoolFlag{
+					Name:  "commands",
+					Usage: "print docker network create commands instead of writing config",
+				},
+			},
+			Action: Import,
+		},
+	}
 	app.Run(os.Args)
 }
 
-// Run initializes the driver
+// Run initializes the driver, serve until SIGTERM or SIGINT, then shutdown gracefully.
 func Run(ctx *cli.Context) {
 	if ctx.Bool("debug") {
 		log.SetLevel("debug")
 	}
-	log.Info("Run %s", ctx.App.Name)
-	d, err := driver.New()
-	if err == nil {
-		h := network.NewHandler(d)
-		err = h.ServeUnix("root", "hostnic")
+	log.SetFormat(ctx.String("log-format"))
+	err := setupLogTarget(ctx)
+	if err != nil {
+		log.Fatal("Setup log target error: %s", err.Error())
 	}
+	if err := log.SetLevels(ctx.String("log-levels")); err != nil {
+		log.Fatal("Set log levels error: %s", err.Error())
+	}
+	go toggleDebugOnSignal()
+	log.Info("Run %s", ctx.String("name"))
+	d, err := driver.New(instancePath(ctx, "config-dir", driver.DefaultConfigDir))
 	if err != nil {
 		log.Fatal("Run app error: %s", err.Error())
-		os.Exit(1)
 	}
+	if nics := ctx.String("protected-nics"); nics != "" {
+		d.SetProtectedNics(strings.Split(nics, ","))
+	}
+	if hooksDir := ctx.String("hooks-dir"); hooksDir != "" {
+		if err := d.SetHooks(hooksDir, ctx.Duration("hook-timeout")); err != nil {
+			log.Fatal("Set hooks error: %s", err.Error())
+		}
+	}
+	if metadata := ctx.String("metadata"); metadata != "" {
+		if err := d.SetMetadata(metadata, ctx.Duration("metadata-refresh")); err != nil {
+			log.Fatal("Load metadata error: %s", err.Error())
+		}
+	}
+	provider, err := nicProvider(ctx)
+	if err != nil {
+		log.Fatal("Setup nic provider error: %s", err.Error())
+	}
+	if provider != nil {
+		d.SetNicProvider(provider, ctx.Duration("provision-timeout"))
+	}
+	var listeners []net.Listener
+	if auditFile := instancePath(ctx, "audit-file", defaultAuditFile); auditFile != "" {
+		err = d.SetAuditFile(auditFile, int64(ctx.Int("audit-max-size"))<<20, ctx.Int("audit-max-files"))
+	}
+	if adminSocket := instancePath(ctx, "admin-socket", defaultAdminSocket); err == nil && adminSocket != "" {
+		var l net.Listener
+		if l, err = serveAdmin(d, adminSocket); err == nil {
+			listeners = append(listeners, l)
+		}
+	}
+	if err == nil && ctx.String("metrics-address") != "" {
+		var l net.Listener
+		if l, err = serveMetrics(d, ctx.String("metrics-address")); err == nil {
+			listeners = append(listeners, l)
+		}
+	}
+	var l net.Listener
+	if err == nil {
+		l, err = listenPlugin(ctx)
+	}
+	if err != nil {
+		log.Error("Run app error: %s", err.Error())
+		os.Exit(shutdown(d, listeners, ctx.Duration("shutdown-timeout"), exitServeError))
+	}
+	l = &drainListener{Listener: l}
+	listeners = append(listeners, l)
+	log.Info("Serve plugin api on [%s]", l.Addr())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- network.NewHandler(driver.NewMetricsDriver(d)).Serve(l)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	// config and nic inventory are loaded by driver.New, docker can use the plugin now.
+	if err := sdNotify("READY=1"); err != nil {
+		log.Warning("Notify systemd ready error: %s", err.Error())
+	}
+	if interval := watchdogInterval(); interval > 0 {
+		go watchdog(d, interval)
+	}
+	code := exitOK
+	for code == exitOK {
+		select {
+		case err := <-serveErr:
+			log.Error("Serve plugin api error: %s", err.Error())
+			code = exitServeError
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				log.Info("Receive signal [%s], reload config", sig)
+				sdNotify("RELOADING=1")
+				if err := d.Reload(); err != nil {
+					log.Error("Reload config error: %s", err.Error())
+				}
+				sdNotify("READY=1")
+				continue
+			}
+			log.Info("Receive signal [%s], shutdown", sig)
+			os.Exit(shutdown(d, listeners, ctx.Duration("shutdown-timeout"), exitOK))
+		}
+	}
+	os.Exit(shutdown(d, listeners, ctx.Duration("shutdown-timeout"), code))
+}
+
+// shutdown stop accepting requests, wait in flight requests, flush state and remove sockets, return the exit code.
+// The socket files are removed by closing listeners, except the socket of systemd socket activation.
+func shutdown(d *driver.HostNicDriver, listeners []net.Listener, timeout time.Duration, code int) int {
+	sdNotify("STOPPING=1")
+	deadline := time.Now().Add(timeout)
+	for _, l := range listeners {
+		l.Close()
+	}
+	for _, l := range listeners {
+		if drain, ok := l.(*drainListener); ok {
+			if err := drain.wait(timeout); err != nil {
+				log.Error("Wait plugin api requests error: %s", err.Error())
+				code = exitShutdownError
+			}
+		}
+	}
+	if err := d.Shutdown(deadline.Sub(time.Now())); err != nil {
+		log.Error("Shutdown driver error: %s", err.Error())
+		return exitShutdownError
+	}
+	return code
+}
+
+// instancePath return the path of flag, the default path is named by the driver name if it is not the default name,
+// e.g., /run/docker/plugins/hostnic-storage.sock, so instances of different names have separate sockets and state.
+// Default paths of managed plugin are under the propagated mount.
+func instancePath(ctx *cli.Context, flag, defaultPath string) string {
+	p := ctx.GlobalString(flag)
+	if managed, ok := managedPaths[flag]; ok && p == defaultPath && ctx.GlobalBool("managed") {
+		return managed
+	}
+	if name := ctx.GlobalString("name"); p == defaultPath && name != driver.DefaultName {
+		return strings.Replace(p, driver.DefaultName, name, -1)
+	}
+	return p
+}
+
+// toggleDebugOnSignal toggle debug level of all subsystems on SIGUSR1, the levels of subsystems are restored on the next one.
+func toggleDebugOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	for range signals {
+		log.ToggleDebug()
+	}
+}
+
+// setupLogTarget send logs to the target instead of stderr.
+func setupLogTarget(ctx *cli.Context) error {
+	switch target := ctx.String("log-target"); target {
+	case "auto":
+		if log.StderrIsJournal() {
+			return log.UseJournald()
+		}
+		return nil
+	case "stderr":
+		return nil
+	case "journald":
+		return log.UseJournald()
+	case "syslog":
+		return log.UseSyslog()
+	case "file":
+		return log.UseFile(instancePath(ctx, "log-file", defaultLogFile), int64(ctx.Int("log-max-size"))<<20, ctx.Int("log-max-files"))
+	default:
+		return fmt.Errorf("Invalid log target [%s]", target)
+	}
+}
+
+// listenPlugin listen on the unix socket of plugin api, docker discovers the plugin by the socket.
+// The socket passed by systemd socket activation is used if there is one, or listen on tcp if --listen is set.
+func listenPlugin(ctx *cli.Context) (net.Listener, error) {
+	l, err := activationListener()
+	if err != nil || l != nil {
+		return l, err
+	}
+	address, err := parseListen(ctx.String("listen"))
+	if err != nil {
+		return nil, err
+	}
+	if address != "" {
+		return listenTCP(ctx.String("name"), address, TLSOptions{
+			CAFile:         ctx.String("tls-ca"),
+			CertFile:       ctx.String("tls-cert"),
+			KeyFile:        ctx.String("tls-key"),
+			ClientCertFile: ctx.String("tls-client-cert"),
+			ClientKeyFile:  ctx.String("tls-client-key"),
+		})
+	}
+	path := instancePath(ctx, "socket", defaultPluginSocket)
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0755)); err != nil {
+		return nil, err
+	}
+	return sockets.NewUnixSocket(path, "root")
+}
+
+// serveAdmin serve admin api on the unix socket, which is only accessible by root.
+func serveAdmin(d *driver.HostNicDriver, path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0755)); err != nil {
+		return nil, err
+	}
+	l, err := sockets.NewUnixSocket(path, "root")
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Serve admin api on [%s]", path)
+	go http.Serve(l, driver.NewAdminHandler(d, version))
+	return l, nil
+}
+
+// serveMetrics serve prometheus metrics on the tcp address.
+func serveMetrics(d *driver.HostNicDriver, address string) (net.Listener, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Serve metrics on [%s]", address)
+	go http.Serve(l, driver.NewMetricsHandler(d))
+	return l, nil
 }
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/urfave/cli"
+	"github.com/yunify/docker-plugin-hostnic/driver"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDrainListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain := &drainListener{Listener: l}
+	release := make(chan struct{})
+	go http.Serve(drain, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("ok"))
+	}))
+	defer drain.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err == nil {
+			_, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	// the connection is busy from reading the request
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&drain.busy) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect 1 busy connection, got %d", atomic.LoadInt64(&drain.busy))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := drain.wait(50 * time.Millisecond); err == nil {
+		t.Fatal("expect drain timeout with request in flight")
+	}
+
+	// the kept alive connection is idle after the response is written
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := drain.wait(time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestActivationListener(t *testing.T) {
+	if os.Getenv("HOSTNIC_TEST_ACTIVATION") != "" {
+		// started by the test as systemd starts an activated service, the sockets are from fd 3
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		l, err := activationListener()
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+		} else {
+			fmt.Printf("listener: %s\n", l.Addr().String())
+		}
+		return
+	}
+	if l, err := activationListener(); l != nil || err != nil {
+		t.Fatalf("expect no listener if not activated, got %v, %v", l, err)
+	}
+	dir, err := ioutil.TempDir("", "hostnic-activation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "hostnic.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	activate := func(files ...*os.File) string {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestActivationListener$")
+		cmd.Env = append(os.Environ(), "HOSTNIC_TEST_ACTIVATION=1", fmt.Sprintf("LISTEN_FDS=%d", len(files)))
+		cmd.ExtraFiles = files
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("run activated test error: %s, %s", err.Error(), out)
+		}
+		return string(out)
+	}
+	if out := activate(f); !strings.Contains(out, "listener: "+socket) {
+		t.Fatalf("expect listener of the passed socket, got %s", out)
+	}
+	if out := activate(f, f); !strings.Contains(out, "error: Expect one unix socket") {
+		t.Fatalf("expect error of 2 sockets, got %s", out)
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("expect nothing sent without NOTIFY_SOCKET, got %v", err)
+	}
+	dir, err := ioutil.TempDir("", "hostnic-notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// path and abstract socket
+	for _, name := range []string{filepath.Join(dir, "notify"), fmt.Sprintf("@hostnic-notify-%d", os.Getpid())} {
+		addr := name
+		if addr[0] == '@' {
+			addr = "\x00" + addr[1:]
+		}
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Setenv("NOTIFY_SOCKET", name)
+		err = sdNotify("READY=1")
+		os.Unsetenv("NOTIFY_SOCKET")
+		if err != nil {
+			conn.Close()
+			t.Fatal(err)
+		}
+		buf := make([]byte, 64)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		conn.Close()
+		if err != nil || string(buf[:n]) != "READY=1" {
+			t.Fatalf("expect READY=1 on [%s], got %q, %v", name, buf[:n], err)
+		}
+	}
+}
+
+// pathContext return the context of path flags parsed from args.
+func pathContext(t *testing.T, args ...string) *cli.Context {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("name", driver.DefaultName, "")
+	set.String("socket", defaultPluginSocket, "")
+	set.String("config-dir", driver.DefaultConfigDir, "")
+	set.String("admin-socket", defaultAdminSocket, "")
+	set.Bool("managed", false, "")
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(nil, set, nil)
+}
+
+func TestInstancePath(t *testing.T) {
+	ctx := pathContext(t)
+	if p := instancePath(ctx, "socket", defaultPluginSocket); p != defaultPluginSocket {
+		t.Fatalf("expect default socket of default name, got %s", p)
+	}
+	// default paths are named by the driver name
+	ctx = pathContext(t, "--name", "hostnic-storage")
+	for _, c := range []struct{ flag, defaultPath, expect string }{
+		{"socket", defaultPluginSocket, "/run/docker/plugins/hostnic-storage.sock"},
+		{"config-dir", driver.DefaultConfigDir, "/etc/docker/hostnic-storage"},
+		{"admin-socket", defaultAdminSocket, "/run/docker/hostnic-storage-admin.sock"},
+	} {
+		if p := instancePath(ctx, c.flag, c.defaultPath); p != c.expect {
+			t.Errorf("expect %s [%s], got [%s]", c.flag, c.expect, p)
+		}
+	}
+	// paths set by flags are kept
+	ctx = pathContext(t, "--name", "hostnic-storage", "--socket", "/run/hostnic.sock")
+	if p := instancePath(ctx, "socket", defaultPluginSocket); p != "/run/hostnic.sock" {
+		t.Fatalf("expect socket set by flag, got %s", p)
+	}
+}
+
+func TestSpecAddress(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9477}
+	for address, expect := range map[string]string{
+		"127.0.0.1:0":    "tcp://127.0.0.1:9477",
+		"10.0.0.5:9477":  "tcp://10.0.0.5:9477",
+		"[fd00::5]:9477": "tcp://[fd00::5]:9477",
+		"plugin:9477":    "tcp://plugin:9477",
+	} {
+		if spec, err := specAddress(address, addr); err != nil || spec != expect {
+			t.Errorf("expect spec address [%s] of [%s], got [%s], %v", expect, address, spec, err)
+		}
+	}
+	// docker can not connect to an unspecified host
+	for _, address := range []string{":9477", "0.0.0.0:9477", "[::]:9477", "9477"} {
+		if spec, err := specAddress(address, addr); err == nil {
+			t.Errorf("expect error of listen address [%s], got [%s]", address, spec)
+		}
+	}
+}
+
+func TestManagedPath(t *testing.T) {
+	// default paths of managed plugin are under the propagated mount
+	ctx := pathContext(t, "--managed")
+	if p := instancePath(ctx, "config-dir", driver.DefaultConfigDir); p != managedStateDir {
+		t.Fatalf("expect config dir [%s] of managed plugin, got [%s]", managedStateDir, p)
+	}
+	if p := instancePath(ctx, "admin-socket", defaultAdminSocket); p != managedStateDir+"/admin.sock" {
+		t.Fatalf("expect admin socket under [%s], got [%s]", managedStateDir, p)
+	}
+	// the plugin socket is fixed by plugin config, it is not named by the driver name
+	ctx = pathContext(t, "--managed", "--name", "hostnic-storage")
+	if p := instancePath(ctx, "socket", defaultPluginSocket); p != defaultPluginSocket {
+		t.Fatalf("expect socket [%s] of managed plugin, got [%s]", defaultPluginSocket, p)
+	}
+	ctx = pathContext(t, "--managed", "--config-dir", "/etc/hostnic")
+	if p := instancePath(ctx, "config-dir", driver.DefaultConfigDir); p != "/etc/hostnic" {
+		t.Fatalf("expect config dir set by flag, got [%s]", p)
+	}
+}
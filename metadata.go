@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli"
+	"github.com/yunify/docker-plugin-hostnic/driver"
+	"os"
+	"text/tabwriter"
+)
+
+// Metadata list the cloud subnets of nics from the metadata source, or print docker network create commands of them.
+func Metadata(ctx *cli.Context) error {
+	source := ctx.Args().First()
+	if source == "" {
+		source = ctx.GlobalString("metadata")
+	}
+	if source == "" {
+		return cli.NewExitError("Please set the metadata url or file, by argument or --metadata", 1)
+	}
+	m, err := driver.LoadMetadata(source)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Load metadata error: %s", err.Error()), 1)
+	}
+	if ctx.Bool("commands") {
+		for _, command := range driver.MetadataNetworkCommands(m, ctx.GlobalString("name")) {
+			fmt.Println(command)
+		}
+		return nil
+	}
+	if ctx.Bool("json") {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(m)
+	}
+	names := make(map[string]string)
+	if nics, err := driver.ListNics(); err == nil {
+		for _, nic := range nics {
+			names[nic.HardwareAddr] = nic.Name
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MAC\tNIC\tSUBNET\tCIDR\tPRIVATE IP\tGATEWAY")
+	for _, nic := range m.Nics {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", nic.HardwareAddr, orNone(names[nic.HardwareAddr]), orNone(nic.Subnet), nic.CIDR,
+			orNone(nic.PrivateIP), orNone(nic.Gateway))
+	}
+	return w.Flush()
+}
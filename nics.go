@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli"
+	"github.com/yunify/docker-plugin-hostnic/driver"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Nics list host nics which can be bound, the state is unknown if the plugin is not running.
+func Nics(ctx *cli.Context) error {
+	nics, err := driver.ListNics()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("List nics error: %s", err.Error()), 1)
+	}
+	var statuses []driver.NicStatus
+	adminSocket := instancePath(ctx, "admin-socket", defaultAdminSocket)
+	if adminSocket != "" {
+		if err := newAdminClient(adminSocket).get("/nics", &statuses); err != nil {
+			fmt.Fprintf(os.Stderr, "Can not read nic state from plugin [%s]: %s\n", adminSocket, err.Error())
+			statuses = nil
+		}
+	}
+	nics = mergeNicStatus(nics, statuses)
+	if ctx.Bool("json") {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(nics)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tMAC\tPERM MAC\tDRIVER\tPCI\tSPEED\tCARRIER\tNUMA\tSRIOV\tADDRESSES\tSUBNET\tSTATE")
+	for _, nic := range nics {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", nic.Name, nic.HardwareAddr, orNone(nic.PermHardwareAddr),
+			orNone(nic.Driver), orNone(nic.BusInfo), speed(nic.Speed), nic.Carrier, numa(nic.NumaNode), sriov(nic),
+			orNone(strings.Join(nic.Addresses, ",")), subnet(nic.Cloud), nicState(nic, statuses != nil))
+	}
+	return w.Flush()
+}
+
+// mergeNicStatus set protected and bound endpoint of nics by the status from admin api,
+// and append the bound nics which are not on host, e.g., moved into containers.
+func mergeNicStatus(nics []driver.NicInfo, statuses []driver.NicStatus) []driver.NicInfo {
+	byAddr := make(map[string]driver.NicStatus, len(statuses))
+	for _, status := range statuses {
+		byAddr[status.HardwareAddr] = status
+	}
+	for i := range nics {
+		if status, ok := byAddr[nics[i].HardwareAddr]; ok {
+			nics[i].Protected = status.Protected
+			nics[i].Endpoint = status.Endpoint
+			nics[i].Network = status.Network
+			nics[i].Sandbox = status.Sandbox
+			nics[i].Cloud = status.Cloud
+			delete(byAddr, nics[i].HardwareAddr)
+		}
+	}
+	for _, status := range statuses {
+		if _, ok := byAddr[status.HardwareAddr]; !ok || status.Endpoint == "" {
+			continue
+		}
+		nics = append(nics, driver.NicInfo{Name: status.Name, HardwareAddr: status.HardwareAddr, Carrier: "-", NumaNode: -1,
+			Protected: status.Protected, Endpoint: status.Endpoint, Network: status.Network, Sandbox: status.Sandbox, Cloud: status.Cloud})
+	}
+	return nics
+}
+
+func nicState(nic driver.NicInfo, known bool) string {
+	switch {
+	case !known:
+		return "unknown"
+	case nic.Endpoint != "" && nic.Sandbox != "":
+		return fmt.Sprintf("bound %s/%s in %s", nic.Network, nic.Endpoint, nic.Sandbox)
+	case nic.Endpoint != "":
+		return fmt.Sprintf("bound %s/%s", nic.Network, nic.Endpoint)
+	case nic.Protected:
+		return "protected"
+	default:
+		return "free"
+	}
+}
+
+// subnet return the cloud subnet and private ip of nic, e.g., vxnet-abc123 192.168.1.5
+func subnet(cloud *driver.NicMetadata) string {
+	if cloud == nil {
+		return "-"
+	}
+	name := cloud.Subnet
+	if name == "" {
+		name = cloud.CIDR
+	}
+	if cloud.PrivateIP != "" {
+		return name + " " + cloud.PrivateIP
+	}
+	return name
+}
+
+func sriov(nic driver.NicInfo) string {
+	if nic.PhysicalFunction != "" {
+		return "vf of " + nic.PhysicalFunction
+	}
+	if len(nic.VirtualFunctions) > 0 {
+		return fmt.Sprintf("pf (%d vfs)", len(nic.VirtualFunctions))
+	}
+	return "-"
+}
+
+func speed(mbps uint32) string {
+	if mbps == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%dMb/s", mbps)
+}
+
+func numa(node int) string {
+	if node < 0 {
+		return "-"
+	}
+	return strconv.Itoa(node)
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"github.com/urfave/cli"
+	"github.com/yunify/docker-plugin-hostnic/driver"
+	"github.com/yunify/docker-plugin-hostnic/qingcloud"
+)
+
+// providerQingCloud provisions nics by QingCloud iaas api.
+const providerQingCloud = "qingcloud"
+
+// nicProvider return the nic provider set by --nic-provider, nil if it is not set.
+func nicProvider(ctx *cli.Context) (driver.NicProvider, error) {
+	switch ctx.GlobalString("nic-provider") {
+	case "":
+		return nil, nil
+	case providerQingCloud:
+		client, err := qingcloud.NewClient(qingcloud.Config{
+			URL:             ctx.GlobalString("qingcloud-url"),
+			Zone:            ctx.GlobalString("qingcloud-zone"),
+			AccessKeyID:     ctx.GlobalString("qingcloud-access-key-id"),
+			SecretAccessKey: ctx.GlobalString("qingcloud-secret-access-key"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return qingcloud.NewProvider(client, ctx.GlobalString("qingcloud-instance"), qingcloud.DefaultJobTimeout)
+	}
+	return nil, fmt.Errorf("Unsupported nic provider [%s], supported providers are [%s]", ctx.GlobalString("nic-provider"), providerQingCloud)
+}
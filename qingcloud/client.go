@@ -0,0 +1,136 @@
+// Package qingcloud provisions nics by QingCloud iaas api, and provides an in-memory stub of the api for testing.
+package qingcloud
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultURL is the url of QingCloud iaas api.
+	DefaultURL = "https://api.qingcloud.com/iaas/"
+
+	// timeFormat is the format of time_stamp parameter.
+	timeFormat = "2006-01-02T15:04:05Z"
+
+	requestTimeout = 10 * time.Second
+)
+
+// Config is the config of api client.
+type Config struct {
+	URL             string
+	Zone            string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// Client calls QingCloud iaas api with signature version 1.
+type Client struct {
+	config Config
+	client *http.Client
+}
+
+// Error is the error returned by api.
+type Error struct {
+	Action  string
+	RetCode int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s error, ret_code [%d]: %s", e.Action, e.RetCode, e.Message)
+}
+
+// response is the common fields of api responses.
+type response struct {
+	Action  string `json:"action"`
+	RetCode int    `json:"ret_code"`
+	Message string `json:"message"`
+}
+
+func NewClient(config Config) (*Client, error) {
+	if config.URL == "" {
+		config.URL = DefaultURL
+	}
+	if _, err := url.Parse(config.URL); err != nil {
+		return nil, fmt.Errorf("Invalid api url [%s]: %s", config.URL, err.Error())
+	}
+	if config.Zone == "" || config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, fmt.Errorf("Zone, access key id and secret access key of QingCloud api are required")
+	}
+	return &Client{config: config, client: &http.Client{Timeout: requestTimeout}}, nil
+}
+
+// call the action with params, and decode the response to v.
+func (c *Client) call(action string, params url.Values, v interface{}) error {
+	u, err := url.Parse(c.config.URL)
+	if err != nil {
+		return err
+	}
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("action", action)
+	params.Set("zone", c.config.Zone)
+	params.Set("access_key_id", c.config.AccessKeyID)
+	params.Set("signature_method", "HmacSHA256")
+	params.Set("signature_version", "1")
+	params.Set("time_stamp", time.Now().UTC().Format(timeFormat))
+	params.Set("version", "1")
+	query := canonicalQuery(params)
+	u.RawQuery = query + "&signature=" + url.QueryEscape(sign(c.config.SecretAccessKey, "GET", u.Path, query))
+	resp, err := c.client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s error: %s", action, resp.Status)
+	}
+	r := response{}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return fmt.Errorf("Parse %s response error: %s", action, err.Error())
+	}
+	if r.RetCode != 0 {
+		return &Error{Action: action, RetCode: r.RetCode, Message: r.Message}
+	}
+	return json.Unmarshal(data, v)
+}
+
+// canonicalQuery return the params sorted by key, spaces are encoded as %20.
+func canonicalQuery(params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, escape(k)+"="+escape(params.Get(k)))
+	}
+	return strings.Join(parts, "&")
+}
+
+func escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// sign return the base64 encoded HmacSHA256 signature of the request.
+func sign(secret, method, path, query string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + path + "\n" + query))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,152 @@
+package qingcloud
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// DefaultJobTimeout is the default max time to wait attach and detach jobs, attach is waited in the docker plugin call.
+const DefaultJobTimeout = 15 * time.Second
+
+// jobPollInterval is the interval to describe the status of jobs.
+var jobPollInterval = time.Second
+
+// job status
+const (
+	jobWorking    = "working"
+	jobSuccessful = "successful"
+	jobFailed     = "failed"
+)
+
+// nic status
+const (
+	nicAvailable = "available"
+	nicInUse     = "in-use"
+)
+
+// Nic is the nic of api responses.
+type Nic struct {
+	NicID      string `json:"nic_id"` // hardware addr of the nic
+	NicName    string `json:"nic_name"`
+	VxNetID    string `json:"vxnet_id"`
+	PrivateIP  string `json:"private_ip"`
+	Status     string `json:"status"`
+	InstanceID string `json:"instance_id"`
+}
+
+// Job is the async job of api.
+type Job struct {
+	JobID  string `json:"job_id"`
+	Action string `json:"job_action"`
+	Status string `json:"status"`
+}
+
+// Provider creates nics on vxnets and attaches them to the instance, it implements driver.NicProvider.
+type Provider struct {
+	client     *Client
+	instance   string
+	jobTimeout time.Duration
+}
+
+// NewProvider return the provider attaching nics to the instance, the instance is the host of plugin.
+func NewProvider(client *Client, instance string, jobTimeout time.Duration) (*Provider, error) {
+	if instance == "" {
+		return nil, fmt.Errorf("Instance id of the host is required")
+	}
+	if jobTimeout <= 0 {
+		jobTimeout = DefaultJobTimeout
+	}
+	return &Provider{client: client, instance: instance, jobTimeout: jobTimeout}, nil
+}
+
+// CreateNic create a nic on the vxnet and attach it to the instance, return the hardware addr of nic.
+func (p *Provider) CreateNic(vxnet string, ip string, name string) (string, error) {
+	params := url.Values{"vxnet": {vxnet}, "nic_name": {name}, "count": {"1"}}
+	if ip != "" {
+		params.Set("private_ips.1", ip)
+	}
+	created := struct {
+		Nics []Nic `json:"nics"`
+	}{}
+	if err := p.client.call("CreateNics", params, &created); err != nil {
+		return "", err
+	}
+	if len(created.Nics) != 1 {
+		return "", fmt.Errorf("CreateNics error: expect 1 nic, got %d", len(created.Nics))
+	}
+	nicID := created.Nics[0].NicID
+	attached := struct {
+		JobID string `json:"job_id"`
+	}{}
+	err := p.client.call("AttachNics", url.Values{"nics.1": {nicID}, "instance": {p.instance}}, &attached)
+	if err == nil {
+		err = p.waitJob(attached.JobID)
+	}
+	if err != nil {
+		if deleteErr := p.deleteNic(nicID); deleteErr != nil {
+			return "", fmt.Errorf("Attach nic [%s] error: %s, and delete it error: %s", nicID, err.Error(), deleteErr.Error())
+		}
+		return "", fmt.Errorf("Attach nic [%s] error: %s", nicID, err.Error())
+	}
+	return nicID, nil
+}
+
+// DeleteNic detach the nic if it is in use, then delete it.
+func (p *Provider) DeleteNic(hardwareAddr string) error {
+	described := struct {
+		NicSet []Nic `json:"nic_set"`
+	}{}
+	if err := p.client.call("DescribeNics", url.Values{"nics.1": {hardwareAddr}}, &described); err != nil {
+		return err
+	}
+	if len(described.NicSet) == 0 {
+		return nil
+	}
+	nic := described.NicSet[0]
+	if nic.Status == nicInUse {
+		if nic.InstanceID != p.instance {
+			return fmt.Errorf("Nic [%s] is attached to instance [%s], not this host [%s]", hardwareAddr, nic.InstanceID, p.instance)
+		}
+		detached := struct {
+			JobID string `json:"job_id"`
+		}{}
+		if err := p.client.call("DetachNics", url.Values{"nics.1": {hardwareAddr}}, &detached); err != nil {
+			return err
+		}
+		if err := p.waitJob(detached.JobID); err != nil {
+			return fmt.Errorf("Detach nic [%s] error: %s", hardwareAddr, err.Error())
+		}
+	}
+	return p.deleteNic(hardwareAddr)
+}
+
+func (p *Provider) deleteNic(nicID string) error {
+	return p.client.call("DeleteNics", url.Values{"nics.1": {nicID}}, &struct{}{})
+}
+
+// waitJob wait the job finishes, return error if it fails or timeout.
+func (p *Provider) waitJob(jobID string) error {
+	deadline := time.Now().Add(p.jobTimeout)
+	for {
+		described := struct {
+			JobSet []Job `json:"job_set"`
+		}{}
+		if err := p.client.call("DescribeJobs", url.Values{"jobs.1": {jobID}}, &described); err != nil {
+			return err
+		}
+		if len(described.JobSet) == 0 {
+			return fmt.Errorf("Job [%s] is not found", jobID)
+		}
+		switch described.JobSet[0].Status {
+		case jobSuccessful:
+			return nil
+		case jobFailed:
+			return fmt.Errorf("Job [%s] failed", jobID)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Job [%s] does not finish after %s", jobID, p.jobTimeout)
+		}
+		time.Sleep(jobPollInterval)
+	}
+}
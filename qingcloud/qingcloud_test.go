@@ -0,0 +1,89 @@
+package qingcloud
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestProvider(t *testing.T, stub *Stub, secret string) (*Provider, func()) {
+	jobPollInterval = 10 * time.Millisecond
+	server := httptest.NewServer(stub)
+	client, err := NewClient(Config{URL: server.URL + "/iaas/", Zone: "test1", AccessKeyID: "key", SecretAccessKey: secret})
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	provider, err := NewProvider(client, "i-test", time.Second)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return provider, server.Close
+}
+
+func TestSignature(t *testing.T) {
+	stub := NewStub("test1", "key", "secret")
+	provider, closeServer := newTestProvider(t, stub, "wrong secret")
+	defer closeServer()
+	_, err := provider.CreateNic("vxnet-test", "", "hostnic-test")
+	if e, ok := err.(*Error); !ok || e.RetCode != retCodeAuthFailed {
+		t.Fatalf("expect auth error, got %v", err)
+	}
+	// spaces and special characters in params are signed
+	provider, closeServer = newTestProvider(t, stub, "secret")
+	defer closeServer()
+	if _, err := provider.CreateNic("vxnet-test", "", "hostnic test+/="); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProvider(t *testing.T) {
+	stub := NewStub("test1", "key", "secret")
+	attached := make(map[string]bool)
+	stub.OnAttach = func(nic Nic) error {
+		if nic.PrivateIP == "192.168.0.99" {
+			return fmt.Errorf("attach failed")
+		}
+		attached[nic.NicID] = true
+		return nil
+	}
+	stub.OnDetach = func(nic Nic) error {
+		delete(attached, nic.NicID)
+		return nil
+	}
+	provider, closeServer := newTestProvider(t, stub, "secret")
+	defer closeServer()
+
+	mac, err := provider.CreateNic("vxnet-test", "192.168.0.5", "hostnic-ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nics := stub.Nics()
+	if len(nics) != 1 || nics[0].NicID != mac || nics[0].Status != nicInUse || nics[0].InstanceID != "i-test" || nics[0].PrivateIP != "192.168.0.5" || !attached[mac] {
+		t.Fatalf("expect nic attached to instance, got %+v", nics)
+	}
+	if _, err := provider.CreateNic("vxnet-test", "192.168.0.5", "hostnic-ep2"); err == nil {
+		t.Fatal("expect error of ip in use")
+	}
+
+	// nic is deleted if attach fails
+	if _, err := provider.CreateNic("vxnet-test", "192.168.0.99", "hostnic-ep3"); err == nil {
+		t.Fatal("expect attach error")
+	}
+	if nics := stub.Nics(); len(nics) != 1 {
+		t.Fatalf("expect nic of failed attach deleted, got %+v", nics)
+	}
+
+	if err := provider.DeleteNic(mac); err != nil {
+		t.Fatal(err)
+	}
+	if nics := stub.Nics(); len(nics) != 0 || len(attached) != 0 {
+		t.Fatalf("expect nic detached and deleted, got %+v", nics)
+	}
+	// deleting a deleted nic is not an error
+	if err := provider.DeleteNic(mac); err != nil {
+		t.Fatal(err)
+	}
+}
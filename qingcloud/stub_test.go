@@ -0,0 +1,230 @@
+package qingcloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// error codes of api responses
+const (
+	retCodeAuthFailed     = 1200
+	retCodeNotFound       = 2100
+	retCodeInvalidRequest = 1400
+	retCodeResourceInUse  = 2400
+)
+
+// Stub is an in-memory http stub of the nic api, for testing the provider without the cloud.
+// Jobs finish on the second DescribeJobs, so pollers see them working first.
+type Stub struct {
+	zone            string
+	accessKeyID     string
+	secretAccessKey string
+
+	// OnAttach and OnDetach are called when a nic is attached to or detached from an instance,
+	// e.g., to add and remove a link of the nic on host. An error fails the job.
+	OnAttach func(nic Nic) error
+	OnDetach func(nic Nic) error
+
+	lock sync.Mutex
+	nics map[string]*Nic
+	jobs map[string]*stubJob
+	seq  int
+}
+
+// stubJob is the job with the status it finishes with.
+type stubJob struct {
+	Job
+	result string
+}
+
+func NewStub(zone, accessKeyID, secretAccessKey string) *Stub {
+	return &Stub{
+		zone:            zone,
+		accessKeyID:     accessKeyID,
+		secretAccessKey: secretAccessKey,
+		nics:            make(map[string]*Nic),
+		jobs:            make(map[string]*stubJob),
+	}
+}
+
+// Nics return all nics of the stub sorted by nic id.
+func (s *Stub) Nics() []Nic {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ids := make([]string, 0, len(s.nics))
+	for id := range s.nics {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	nics := make([]Nic, 0, len(ids))
+	for _, id := range ids {
+		nics = append(nics, *s.nics[id])
+	}
+	return nics
+}
+
+func (s *Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	action := params.Get("action")
+	result, retCode, err := s.handle(r.URL.Path, params)
+	if err != nil {
+		result = map[string]interface{}{"message": err.Error()}
+	}
+	result["action"] = action + "Response"
+	result["ret_code"] = retCode
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (s *Stub) handle(path string, params url.Values) (map[string]interface{}, int, error) {
+	signature := params.Get("signature")
+	params.Del("signature")
+	if params.Get("access_key_id") != s.accessKeyID || signature != sign(s.secretAccessKey, "GET", path, canonicalQuery(params)) {
+		return nil, retCodeAuthFailed, fmt.Errorf("Signature not matched")
+	}
+	if params.Get("zone") != s.zone {
+		return nil, retCodeInvalidRequest, fmt.Errorf("Invalid zone [%s]", params.Get("zone"))
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch params.Get("action") {
+	case "CreateNics":
+		return s.createNics(params)
+	case "AttachNics":
+		return s.attachNics(params)
+	case "DetachNics":
+		return s.detachNics(params)
+	case "DeleteNics":
+		return s.deleteNics(params)
+	case "DescribeNics":
+		return s.describeNics(params)
+	case "DescribeJobs":
+		return s.describeJobs(params)
+	}
+	return nil, retCodeInvalidRequest, fmt.Errorf("Unsupported action [%s]", params.Get("action"))
+}
+
+func (s *Stub) createNics(params url.Values) (map[string]interface{}, int, error) {
+	vxnet := params.Get("vxnet")
+	if vxnet == "" {
+		return nil, retCodeInvalidRequest, fmt.Errorf("Parameter vxnet is required")
+	}
+	ip := params.Get("private_ips.1")
+	if ip != "" && net.ParseIP(ip) == nil {
+		return nil, retCodeInvalidRequest, fmt.Errorf("Invalid private ip [%s]", ip)
+	}
+	for _, nic := range s.nics {
+		if ip != "" && nic.VxNetID == vxnet && nic.PrivateIP == ip {
+			return nil, retCodeResourceInUse, fmt.Errorf("Private ip [%s] is in use by nic [%s]", ip, nic.NicID)
+		}
+	}
+	s.seq++
+	if ip == "" {
+		ip = fmt.Sprintf("192.168.%d.%d", s.seq/250, s.seq%250+2)
+	}
+	nic := &Nic{
+		NicID:     fmt.Sprintf("52:54:9e:%02x:%02x:%02x", byte(s.seq>>16), byte(s.seq>>8), byte(s.seq)),
+		NicName:   params.Get("nic_name"),
+		VxNetID:   vxnet,
+		PrivateIP: ip,
+		Status:    nicAvailable,
+	}
+	s.nics[nic.NicID] = nic
+	return map[string]interface{}{"nics": []Nic{*nic}}, 0, nil
+}
+
+func (s *Stub) attachNics(params url.Values) (map[string]interface{}, int, error) {
+	nic, retCode, err := s.nic(params.Get("nics.1"))
+	if err != nil {
+		return nil, retCode, err
+	}
+	instance := params.Get("instance")
+	if instance == "" {
+		return nil, retCodeInvalidRequest, fmt.Errorf("Parameter instance is required")
+	}
+	if nic.Status != nicAvailable {
+		return nil, retCodeResourceInUse, fmt.Errorf("Nic [%s] is in use by instance [%s]", nic.NicID, nic.InstanceID)
+	}
+	status := jobSuccessful
+	nic.Status, nic.InstanceID = nicInUse, instance
+	if s.OnAttach != nil {
+		if err := s.OnAttach(*nic); err != nil {
+			nic.Status, nic.InstanceID = nicAvailable, ""
+			status = jobFailed
+		}
+	}
+	return map[string]interface{}{"job_id": s.job("AttachNics", status)}, 0, nil
+}
+
+func (s *Stub) detachNics(params url.Values) (map[string]interface{}, int, error) {
+	nic, retCode, err := s.nic(params.Get("nics.1"))
+	if err != nil {
+		return nil, retCode, err
+	}
+	if nic.Status != nicInUse {
+		return nil, retCodeInvalidRequest, fmt.Errorf("Nic [%s] is not attached", nic.NicID)
+	}
+	status := jobSuccessful
+	if s.OnDetach != nil {
+		if err := s.OnDetach(*nic); err != nil {
+			status = jobFailed
+		}
+	}
+	if status == jobSuccessful {
+		nic.Status, nic.InstanceID = nicAvailable, ""
+	}
+	return map[string]interface{}{"job_id": s.job("DetachNics", status)}, 0, nil
+}
+
+func (s *Stub) deleteNics(params url.Values) (map[string]interface{}, int, error) {
+	nic, retCode, err := s.nic(params.Get("nics.1"))
+	if err != nil {
+		return nil, retCode, err
+	}
+	if nic.Status != nicAvailable {
+		return nil, retCodeResourceInUse, fmt.Errorf("Nic [%s] is in use by instance [%s]", nic.NicID, nic.InstanceID)
+	}
+	delete(s.nics, nic.NicID)
+	return map[string]interface{}{"nics": []Nic{*nic}}, 0, nil
+}
+
+func (s *Stub) describeNics(params url.Values) (map[string]interface{}, int, error) {
+	nics := []Nic{}
+	if nic := s.nics[params.Get("nics.1")]; nic != nil {
+		nics = append(nics, *nic)
+	}
+	return map[string]interface{}{"nic_set": nics, "total_count": len(nics)}, 0, nil
+}
+
+func (s *Stub) describeJobs(params url.Values) (map[string]interface{}, int, error) {
+	jobs := []Job{}
+	if job := s.jobs[params.Get("jobs.1")]; job != nil {
+		jobs = append(jobs, job.Job)
+		// the job is working on the first describe, and finished on the next
+		if job.Status == jobWorking {
+			job.Status = job.result
+		}
+	}
+	return map[string]interface{}{"job_set": jobs, "total_count": len(jobs)}, 0, nil
+}
+
+func (s *Stub) nic(id string) (*Nic, int, error) {
+	nic := s.nics[id]
+	if nic == nil {
+		return nil, retCodeNotFound, fmt.Errorf("Nic [%s] is not found", id)
+	}
+	return nic, 0, nil
+}
+
+// job add a working job, which finishes with the status.
+func (s *Stub) job(action string, status string) string {
+	s.seq++
+	job := &stubJob{Job: Job{JobID: fmt.Sprintf("j-stub%06d", s.seq), Action: action, Status: jobWorking}, result: status}
+	s.jobs[job.JobID] = job
+	return job.JobID
+}
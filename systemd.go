@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"github.com/coreos/go-systemd/activation"
+	"github.com/yunify/docker-plugin-hostnic/driver"
+	"github.com/yunify/docker-plugin-hostnic/log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// activationListener return the plugin socket passed by systemd socket activation, nil if the process is not activated.
+func activationListener() (net.Listener, error) {
+	listeners, err := activation.Listeners(true)
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) == 0 {
+		return nil, nil
+	}
+	if len(listeners) > 1 || listeners[0] == nil {
+		return nil, fmt.Errorf("Expect one unix socket from systemd, got %d sockets", len(listeners))
+	}
+	return listeners[0], nil
+}
+
+// sdNotify send the state to systemd, e.g., READY=1, it does nothing if the process is not started by a notify service.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval return the interval to ping systemd watchdog, half of WatchdogSec, 0 if watchdog is disabled.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// watchdog ping systemd watchdog while the driver is alive, systemd restarts the plugin if the driver is wedged.
+func watchdog(d *driver.HostNicDriver, interval time.Duration) {
+	log.Info("Ping systemd watchdog every %s", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !d.Alive(interval / 2) {
+			log.Error("Driver is not alive, stop pinging systemd watchdog")
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Warning("Ping systemd watchdog error: %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/go-connections/sockets"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	pluginSpecDir = "/etc/docker/plugins"
+)
+
+// TLSOptions are the files of mutual tls, the server cert is verified by docker with CA,
+// and docker present the client cert signed by CA.
+type TLSOptions struct {
+	CAFile         string
+	CertFile       string
+	KeyFile        string
+	ClientCertFile string
+	ClientKeyFile  string
+}
+
+// pluginSpec is the json spec file of plugin discovery, see https://docs.docker.com/engine/extend/plugin_api/
+type pluginSpec struct {
+	Name      string
+	Addr      string
+	TLSConfig *specTLSConfig `json:",omitempty"`
+}
+
+type specTLSConfig struct {
+	InsecureSkipVerify bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+}
+
+// specListener remove the spec file when it is closed, so docker does not discover a stopped plugin.
+type specListener struct {
+	net.Listener
+	spec string
+}
+
+func (l *specListener) Close() error {
+	os.Remove(l.spec)
+	return l.Listener.Close()
+}
+
+// listenTCP listen on tcp address with mutual tls, and write the spec file of plugin name for docker to discover it.
+func listenTCP(name, address string, options TLSOptions) (net.Listener, error) {
+	if options.ClientCertFile == "" || options.ClientKeyFile == "" {
+		return nil, fmt.Errorf("TLS client cert and key are required for docker to connect the plugin")
+	}
+	config, err := serverTLSConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	l, err := sockets.NewTCPSocket(address, config)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := specAddress(address, l.Addr())
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	spec, err := writeSpec(name, addr, options)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &specListener{Listener: l, spec: spec}, nil
+}
+
+// serverTLSConfig return the tls config which requires client cert signed by CA.
+func serverTLSConfig(options TLSOptions) (*tls.Config, error) {
+	if options.CAFile == "" || options.CertFile == "" || options.KeyFile == "" {
+		return nil, fmt.Errorf("TLS ca, cert and key are required to listen on tcp")
+	}
+	cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Load tls cert [%s] error: %s", options.CertFile, err.Error())
+	}
+	ca, err := ioutil.ReadFile(options.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("Can not find certificate in tls ca [%s]", options.CAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// specAddress return the address docker connects to, the host of listen address must be specified,
+// the plugin can not know which address of an unspecified host docker can reach.
+func specAddress(address string, addr net.Addr) (string, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		return "", fmt.Errorf("Host of listen address [%s] is unspecified, listen on the address docker connects to, e.g., tcp://127.0.0.1:9477", address)
+	}
+	_, port, _ := net.SplitHostPort(addr.String())
+	return "tcp://" + net.JoinHostPort(host, port), nil
+}
+
+// writeSpec write the spec file of plugin to the plugin spec dir, return the path of spec file.
+func writeSpec(name, address string, options TLSOptions) (string, error) {
+	spec := pluginSpec{
+		Name: name,
+		Addr: address,
+		TLSConfig: &specTLSConfig{
+			CAFile:   absPath(options.CAFile),
+			CertFile: absPath(options.ClientCertFile),
+			KeyFile:  absPath(options.ClientKeyFile),
+		},
+	}
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(pluginSpecDir, os.FileMode(0755)); err != nil {
+		return "", err
+	}
+	path := filepath.Join(pluginSpecDir, name+".json")
+	if err := ioutil.WriteFile(path, data, os.FileMode(0644)); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// absPath return the absolute path, docker may run in other working dir.
+func absPath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return abs
+}
+
+// parseListen return the tcp address of listen flag, empty to listen on unix socket.
+func parseListen(listen string) (string, error) {
+	if listen == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(listen, "tcp://") {
+		return "", fmt.Errorf("Invalid listen address [%s], expect tcp://host:port", listen)
+	}
+	return strings.TrimPrefix(listen, "tcp://"), nil
+}